@@ -0,0 +1,186 @@
+package acl
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// POSIX ACLs in the format Linux uses for the system.posix_acl_access and
+// system.posix_acl_default extended attributes: a little endian version
+// word followed by (tag, perm, id) entries.
+
+const (
+	UserObj = 0x01
+	User = 0x02
+	GroupObj = 0x04
+	Group = 0x08
+	Mask = 0x10
+	Other = 0x20
+)
+
+const version = 2
+
+const undefinedId = ^uint32(0)
+
+type Entry struct {
+	Tag uint16
+	Perm uint16
+	Id uint32
+}
+
+type ACL []Entry
+
+var ErrInvalid = errors.New("invalid POSIX ACL")
+
+func Parse(data []byte) (ACL, error) {
+	if len(data) < 4 || (len(data) - 4) % 8 != 0 || binary.LittleEndian.Uint32(data) != version {
+		return nil, ErrInvalid
+	}
+	acl := make(ACL, 0, (len(data) - 4) / 8)
+	required := 0
+	for pos := 4; pos < len(data); pos += 8 {
+		entry := Entry{Tag: binary.LittleEndian.Uint16(data[pos:]),
+						Perm: binary.LittleEndian.Uint16(data[pos + 2:]),
+						Id: binary.LittleEndian.Uint32(data[pos + 4:])}
+		switch entry.Tag {
+		case UserObj, GroupObj, Other:
+			required++
+		case User, Group, Mask:
+		default:
+			return nil, ErrInvalid
+		}
+		if entry.Perm & ^uint16(7) != 0 {
+			return nil, ErrInvalid
+		}
+		acl = append(acl, entry)
+	}
+	if required != 3 || (acl.hasNamed() && acl.find(Mask) == nil) {
+		return nil, ErrInvalid
+	}
+	return acl, nil
+}
+
+func (acl ACL) Marshal() []byte {
+	data := make([]byte, 4 + 8 * len(acl))
+	binary.LittleEndian.PutUint32(data, version)
+	for i, entry := range acl {
+		pos := 4 + 8 * i
+		binary.LittleEndian.PutUint16(data[pos:], entry.Tag)
+		binary.LittleEndian.PutUint16(data[pos + 2:], entry.Perm)
+		binary.LittleEndian.PutUint32(data[pos + 4:], entry.Id)
+	}
+	return data
+}
+
+func (acl ACL) find(tag uint16) *Entry {
+	for i := range acl {
+		if acl[i].Tag == tag {
+			return &acl[i]
+		}
+	}
+	return nil
+}
+
+func (acl ACL) hasNamed() bool {
+	for _, entry := range acl {
+		if entry.Tag == User || entry.Tag == Group {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the ACL grants all of want (a combination of 4
+// for read, 2 for write and 1 for execute) to a caller with the given uid
+// on a file owned by owner and group.
+func (acl ACL) Allows(want uint32, uid uint32, inGroup func(gid uint32) bool, owner uint32, group uint32) bool {
+	mask := uint32(7)
+	if entry := acl.find(Mask); entry != nil {
+		mask = uint32(entry.Perm)
+	}
+	if uid == owner {
+		entry := acl.find(UserObj)
+		return entry != nil && uint32(entry.Perm) & want == want
+	}
+	for _, entry := range acl {
+		if entry.Tag == User && entry.Id == uid {
+			return uint32(entry.Perm) & mask & want == want
+		}
+	}
+	matched := false
+	for _, entry := range acl {
+		var member bool
+		switch entry.Tag {
+		case GroupObj:
+			member = inGroup(group)
+		case Group:
+			member = inGroup(entry.Id)
+		}
+		if member {
+			if uint32(entry.Perm) & mask & want == want {
+				return true
+			}
+			matched = true
+		}
+	}
+	if matched {
+		return false
+	}
+	entry := acl.find(Other)
+	return entry != nil && uint32(entry.Perm) & want == want
+}
+
+// groupClass is the entry the group bits of the file mode stand for: the
+// mask if there is one, the owning group otherwise.
+func (acl ACL) groupClass() *Entry {
+	if entry := acl.find(Mask); entry != nil {
+		return entry
+	}
+	return acl.find(GroupObj)
+}
+
+// Mode returns the permission bits of the file mode the ACL corresponds to.
+func (acl ACL) Mode() uint32 {
+	var mode uint32
+	if entry := acl.find(UserObj); entry != nil {
+		mode |= uint32(entry.Perm) << 6
+	}
+	if entry := acl.groupClass(); entry != nil {
+		mode |= uint32(entry.Perm) << 3
+	}
+	if entry := acl.find(Other); entry != nil {
+		mode |= uint32(entry.Perm)
+	}
+	return mode
+}
+
+// WithMode returns a copy of the ACL updated for a chmod to mode.
+func (acl ACL) WithMode(mode uint32) ACL {
+	out := append(ACL(nil), acl...)
+	if entry := out.find(UserObj); entry != nil {
+		entry.Perm = uint16((mode >> 6) & 7)
+	}
+	if entry := out.groupClass(); entry != nil {
+		entry.Perm = uint16((mode >> 3) & 7)
+	}
+	if entry := out.find(Other); entry != nil {
+		entry.Perm = uint16(mode & 7)
+	}
+	return out
+}
+
+// Inherit returns the access ACL of a file created with mode in a
+// directory whose default ACL this is.
+func (acl ACL) Inherit(mode uint32) ACL {
+	out := append(ACL(nil), acl...)
+	if entry := out.find(UserObj); entry != nil {
+		entry.Perm &= uint16((mode >> 6) & 7)
+	}
+	if entry := out.groupClass(); entry != nil {
+		entry.Perm &= uint16((mode >> 3) & 7)
+	}
+	if entry := out.find(Other); entry != nil {
+		entry.Perm &= uint16(mode & 7)
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package acl
+
+import (
+	"testing"
+)
+
+func noGroups(gid uint32) bool {
+	return false
+}
+
+func testACL() ACL {
+	return ACL{{Tag:UserObj, Perm:7, Id:undefinedId},
+				{Tag:User, Perm:6, Id:1001},
+				{Tag:GroupObj, Perm:4, Id:undefinedId},
+				{Tag:Group, Perm:2, Id:2001},
+				{Tag:Mask, Perm:6, Id:undefinedId},
+				{Tag:Other, Perm:0, Id:undefinedId}}
+}
+
+func TestRoundTrip(t *testing.T) {
+	acl, err := Parse(testACL().Marshal())
+	if err != nil {
+		t.Fatalf("Should parse: %v", err)
+	}
+	if len(acl) != 6 || acl[1].Id != 1001 || acl[1].Perm != 6 {
+		t.Fatalf("Entries changed in the round trip")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := Parse([]byte{1, 2, 3}); err == nil {
+		t.Fatalf("Should reject a short ACL")
+	}
+	noMask := testACL()[:4]
+	noMask = append(noMask, Entry{Tag:Other})
+	if _, err := Parse(noMask.Marshal()); err == nil {
+		t.Fatalf("Should reject named entries without a mask")
+	}
+}
+
+func TestAllows(t *testing.T) {
+	acl := testACL()
+	if !acl.Allows(7, 1000, noGroups, 1000, 100) {
+		t.Fatalf("Owner should have rwx")
+	}
+	if !acl.Allows(6, 1001, noGroups, 1000, 100) {
+		t.Fatalf("Named user should have rw")
+	}
+	if acl.Allows(1, 1001, noGroups, 1000, 100) {
+		t.Fatalf("Named user should not have x")
+	}
+	inGroup := func(gid uint32) bool { return gid == 2001 }
+	if !acl.Allows(2, 1002, inGroup, 1000, 100) {
+		t.Fatalf("Named group should have w")
+	}
+	if acl.Allows(4, 1002, inGroup, 1000, 100) {
+		t.Fatalf("A matching group entry without r should deny r")
+	}
+	if acl.Allows(4, 1003, noGroups, 1000, 100) {
+		t.Fatalf("Others should have nothing")
+	}
+}
+
+func TestMask(t *testing.T) {
+	acl := testACL().WithMode(0740)
+	if acl.Mode() != 0740 {
+		t.Fatalf("Mode should be 0740, was %o", acl.Mode())
+	}
+	if acl.Allows(2, 1001, noGroups, 1000, 100) {
+		t.Fatalf("Mask should now deny w to the named user")
+	}
+}
+
+func TestInherit(t *testing.T) {
+	acl := testACL().Inherit(0750)
+	if acl.Mode() != 0740 {
+		t.Fatalf("Mode should be 0740, was %o", acl.Mode())
+	}
+}
@@ -1,17 +1,20 @@
 package appendfs
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
 	"os"
 	"sync"
-	"errors"
 	"encoding/binary"
 	"io"
 	"fmt"
-	"bufio"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/golang/protobuf/proto"
+	"github.com/e-tothe-ipi/appendfs/merkle"
 	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/e-tothe-ipi/appendfs/rangelist"
 )
 
 
@@ -21,39 +24,201 @@ type AppendFS struct {
 	dataMutex sync.RWMutex
 	dataFile io.ReadWriter
 	dataFileOffset int
+	// Size of all the data segments
+	dataBytes int64
 	dataFilePath string
+	dataSegment uint64
+	segmentSize int
+	compression Codec
+	encryption *encryption
+	chunks *chunkIndex
+	// Held for reading by writes between storing their data and mapping
+	// it into the file, so dedup can't map a segment Compact is deleting
+	compactMutex sync.RWMutex
 	nodeIdMutex sync.RWMutex
 	lastNodeId uint64
+	nodesMutex sync.RWMutex
+	nodes map[uint64]*AppendFSNode
+	orphans map[uint64]*AppendFSNode
 	metadataMutex sync.RWMutex
 	metadataFile io.ReadWriteSeeker
+	// The segments each file's last recorded FileMap refers to, which
+	// are the ones replaying the metadata file would need
+	recordedSegments map[uint64][]uint64
+	metadataFileOffset int64
 	metadataFilePath string
+	// See chain.go
+	chainHash []byte
+	signingKey ed25519.PrivateKey
+	checkpointInterval time.Duration
+	lastCheckpoint time.Time
+	checksums bool
+	// See proof.go
+	proofs bool
+	records merkle.Tree
+	auditLog *auditLog
+	// See mirror.go
+	mirrors []string
+	repairMutex sync.Mutex
+	// See tiering.go, nil without a cold store
+	cold *coldTier
+	// See follower.go
+	follower bool
+	followInterval time.Duration
+	followStop chan struct{}
+	following sync.WaitGroup
+	// Closed and replaced whenever a metadata record is appended
+	appendSignal chan struct{}
+	syncPolicy SyncPolicy
+	capacityLimit int64
+	worm bool
+	wormRetention time.Duration
+	// Background compaction started by checkSpace
+	compacting int32
+	// One more than the current segment at the last of them
+	compactedBelow uint64
+	compactions sync.WaitGroup
+	checkPermissions bool
+	syncStop chan struct{}
+	// Limits and usage, see quota.go
+	quotaMutex sync.Mutex
+	quotas map[quotaKey]Quota
+	usage map[quotaKey]*quotaUsage
 }
 
-func NewAppendFS(dataFilePath string, metadataFilePath string) (*AppendFS, error) {
+type syncer interface {
+	Sync() error
+}
+
+func NewAppendFS(dataFilePath string, metadataFilePath string, options *Options) (*AppendFS, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+	if err := options.check(); err != nil {
+		return nil, err
+	}
 	fs := &AppendFS{}
 	fs.blockSize = 4096
+	fs.nodes = make(map[uint64]*AppendFSNode)
+	fs.orphans = make(map[uint64]*AppendFSNode)
+	fs.recordedSegments = make(map[uint64][]uint64)
+	fs.quotas = make(map[quotaKey]Quota)
+	fs.usage = make(map[quotaKey]*quotaUsage)
+	fs.syncPolicy = options.SyncPolicy
+	fs.checkPermissions = !options.DefaultPermissions
 	fs.dataFilePath = dataFilePath
-	dataFile, err := os.OpenFile(dataFilePath, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666)
+	fs.metadataFilePath = metadataFilePath
+	fs.mirrors = options.Mirrors
+	fs.segmentSize = options.SegmentSize
+	fs.compression = options.Compression
+	fs.capacityLimit = options.Capacity
+	fs.worm = options.Worm
+	fs.chainHash = chainStart()
+	fs.appendSignal = make(chan struct{})
+	fs.signingKey = options.SigningKey
+	fs.checkpointInterval = options.CheckpointInterval
+	fs.lastCheckpoint = time.Now()
+	fs.checksums = options.Checksums
+	fs.proofs = options.Proofs
+	fs.wormRetention = options.WormRetention
+	if options.Follow {
+		// Nothing is written, so there is nothing to sync or sign
+		fs.follower = true
+		fs.followInterval = options.FollowInterval
+		fs.syncPolicy = SyncUnsafe
+		fs.signingKey = nil
+	}
+	if options.EncryptionKey != nil {
+		encryption, err := newEncryption(options.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		fs.encryption = encryption
+	}
+	err := fs.checkKey()
 	if err != nil {
 		return nil, err
 	}
-	dataFileStat, err := dataFile.Stat()
+	err = fs.checkMirrors()
 	if err != nil {
 		return nil, err
 	}
-	fs.dataFile = dataFile
-	fs.dataFileOffset = int(dataFileStat.Size())
-	fs.metadataFilePath = metadataFilePath
-	metadataFile, err := os.OpenFile(metadataFilePath, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666)
+	err = fs.adoptLegacyDataFile()
+	if err != nil {
+		return nil, err
+	}
+	if !fs.follower {
+		err = fs.syncMirrors()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.ColdStore != nil {
+		err = fs.openColdTier(options.ColdStore, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = checkTiered(dataFilePath, options.ColdStore)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := fs.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		fs.dataSegment = segments[len(segments) - 1]
+	}
+	err = fs.countSegments(segments)
+	if err != nil {
+		return nil, err
+	}
+	if !fs.follower {
+		err = fs.openSegment(fs.dataSegment)
+		if err != nil {
+			return nil, err
+		}
+	}
+	metadataFlags := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	metadataCopies := fs.copies(metadataFilePath)
+	if fs.follower {
+		metadataFlags = os.O_RDONLY
+		metadataCopies = metadataCopies[:1]
+	}
+	metadataFile, metadataFileSize, err := openLog(metadataCopies, metadataFlags)
 	if err != nil {
 		return nil, err
 	}
 	fs.metadataFile = metadataFile
+	fs.metadataFileOffset = metadataFileSize
+	if options.Dedup && !fs.follower {
+		err = fs.openChunkIndex()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.AuditLog != "" && !fs.follower {
+		err = fs.openAuditLog(options.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+	}
 	fs.root = CreateNode(nil)
 	fs.root.attr.Mode = fuse.S_IFDIR | 0755
 	fs.root.attr.Nlink = 2
 	fs.root.fs = fs
 	fs.root.nodeId = fs.NextNodeId()
+	fs.registerNode(fs.root)
+	if fs.syncPolicy == SyncPeriodic {
+		fs.syncStop = make(chan struct{})
+		go fs.syncLoop(options.SyncInterval)
+	}
+	if fs.cold != nil && !fs.follower {
+		fs.cold.stop = make(chan struct{})
+		fs.cold.running.Add(1)
+		go fs.tierLoop(options.TierInterval)
+	}
 	return fs, nil
 }
 
@@ -70,19 +235,155 @@ func (fs *AppendFS) NextNodeId() uint64 {
 	return out
 }
 
+// Node returns the live node with the given id, or nil.
+func (fs *AppendFS) Node(nodeId uint64) *AppendFSNode {
+	fs.nodesMutex.RLock()
+	node := fs.nodes[nodeId]
+	fs.nodesMutex.RUnlock()
+	return node
+}
+
+func (fs *AppendFS) registerNode(node *AppendFSNode) {
+	fs.nodesMutex.Lock()
+	fs.nodes[node.nodeId] = node
+	fs.nodesMutex.Unlock()
+}
+
+func (fs *AppendFS) forgetNode(node *AppendFSNode) {
+	fs.nodesMutex.Lock()
+	delete(fs.nodes, node.nodeId)
+	fs.nodesMutex.Unlock()
+}
+
 func (fs *AppendFS) seenNodeId(lastNodeId uint64) {
 	if lastNodeId > fs.lastNodeId {
 		fs.lastNodeId = lastNodeId
 	}
 }
 
-func (fs *AppendFS) AppendData(data []byte) (int, error) {
+// AppendData writes data to the end of the current segment and returns
+// where it landed and how many bytes it takes up there, which differs from
+// len(data) on encrypted volumes. A single append is never split across
+// segments.
+func (fs *AppendFS) AppendData(data []byte) (uint64, int, int, error) {
+	if fs.follower {
+		return 0, 0, 0, errReadOnly
+	}
 	fs.dataMutex.Lock()
-	pos := fs.dataFileOffset
+	if fs.dataFileOffset >= fs.segmentSize {
+		err := fs.rotateSegment()
+		if err != nil {
+			fs.dataMutex.Unlock()
+			return 0, 0, 0, err
+		}
+	}
+	segment, pos := fs.dataSegment, fs.dataFileOffset
+	if fs.encryption != nil {
+		var err error
+		data, err = fs.encryption.seal(data, recordPosition(dataRecord, segment, int64(pos)))
+		if err != nil {
+			fs.dataMutex.Unlock()
+			return 0, 0, 0, err
+		}
+	}
 	n, err := fs.dataFile.Write(data)
 	fs.dataFileOffset += n
+	fs.dataBytes += int64(n)
 	fs.dataMutex.Unlock()
-	return pos, err
+	return segment, pos, n, err
+}
+
+// storeExtent appends data, compressed and sealed as the volume is set
+// up to, and returns the entry mapping logical offset off onto it.
+func (fs *AppendFS) storeExtent(data []byte, off int) (fileSegmentEntry, error) {
+	stored, codec := data, fs.compression
+	if codec != CodecNone {
+		compressed, err := codec.compress(data)
+		if err != nil {
+			return fileSegmentEntry{}, err
+		}
+		if len(compressed) < len(data) {
+			stored = compressed
+		} else {
+			codec = CodecNone
+		}
+	}
+	err := fs.checkSpace(len(stored), false)
+	if err != nil {
+		return fileSegmentEntry{}, err
+	}
+	segment, pos, length, err := fs.AppendData(stored)
+	if err != nil {
+		return fileSegmentEntry{}, err
+	}
+	fData := fileSegmentEntry{segment: segment, base: pos - off}
+	if codec != CodecNone || fs.encryption != nil || fs.checksums {
+		fData.codec, fData.origin, fData.length = codec, off, length
+	}
+	if fs.checksums {
+		sum := sha256.Sum256(stored)
+		fData.checksum = string(sum[:])
+	}
+	if fs.proofs {
+		fData.origin = off
+		fData.digest, fData.size = extentDigest(data), len(data)
+	}
+	return fData, nil
+}
+
+// readBlob reads the blob fse maps and returns its first size bytes of
+// data, checking its checksum if it has one. A copy of the segment whose
+// blob doesn't check out is repaired from the first one that does.
+func (fs *AppendFS) readBlob(segments *segmentReader, fse fileSegmentEntry, size int) ([]byte, error) {
+	blobPos := int64(fse.base + fse.origin)
+	var err error
+	bad := make([]int, 0)
+	for copy := 0; copy < segments.copies(); copy++ {
+		stored := make([]byte, fse.length)
+		_, err = segments.readCopy(copy, fse.segment, stored, blobPos)
+		if err != nil {
+			continue
+		}
+		var blob []byte
+		blob, err = fs.openBlob(stored, fse, blobPos)
+		if err != nil {
+			bad = append(bad, copy)
+			continue
+		}
+		fs.repair(fse.segment, blobPos, stored, copy, bad)
+		return fse.codec.decompress(blob, size)
+	}
+	return nil, err
+}
+
+// openBlob unseals a blob as stored at blobPos and checks its checksum.
+func (fs *AppendFS) openBlob(stored []byte, fse fileSegmentEntry, blobPos int64) ([]byte, error) {
+	blob := stored
+	var err error
+	if fs.encryption != nil {
+		blob, err = fs.encryption.open(blob, recordPosition(dataRecord, fse.segment, blobPos))
+	}
+	if err == nil && fse.checksum != "" {
+		sum := sha256.Sum256(blob)
+		if string(sum[:]) != fse.checksum {
+			err = fmt.Errorf("checksum mismatch in segment %d at %d", fse.segment, blobPos)
+		}
+	}
+	return blob, err
+}
+
+// storeData stores data written at logical offset off and returns the
+// range list entries that map it.
+func (fs *AppendFS) storeData(data []byte, off int) ([]*rangelist.RangeListEntry, error) {
+	if fs.chunks != nil {
+		return fs.storeChunks(data, off)
+	}
+	fData, err := fs.storeExtent(data, off)
+	if err != nil {
+		return nil, err
+	}
+	return []*rangelist.RangeListEntry{&rangelist.RangeListEntry{Min:off,
+			Max:off + len(data) - 1, Data:fData}}, nil
 }
 
 func (fs *AppendFS) AppendMetadata(metadata *messages.NodeMetadata) error {
@@ -90,54 +391,170 @@ func (fs *AppendFS) AppendMetadata(metadata *messages.NodeMetadata) error {
 	if err != nil {
 		return err
 	}
-	n := uint64(len(data))
-	nBuf := make([]byte, 12)
-	nBufLen := binary.PutUvarint(nBuf, n)
-	nBuf = nBuf[:nBufLen]
+	err = fs.checkSpace(len(data) + chainFieldSize, true)
+	if err != nil {
+		return err
+	}
 	fs.metadataMutex.Lock()
-	_, err = fs.metadataFile.Write(nBuf)
-	if err == nil {
-		_, err = fs.metadataFile.Write(data)
+	err = fs.appendRecord(metadata)
+	if err == nil && fs.checkpointDue() {
+		err = fs.appendCheckpoint()
 	}
 	fs.metadataMutex.Unlock()
 	return err
 }
 
+// appendRecord chains metadata to the records before it and appends it to
+// the metadata file. The caller must hold metadataMutex.
+func (fs *AppendFS) appendRecord(metadata *messages.NodeMetadata) error {
+	if fs.follower {
+		return errReadOnly
+	}
+	metadata.Chain = fs.chainHash
+	data, err := proto.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	leaf := merkle.LeafHash(data)
+	if fs.encryption != nil {
+		data, err = fs.encryption.seal(data, recordPosition(metadataRecord, 0, fs.metadataFileOffset))
+		if err != nil {
+			return err
+		}
+	}
+	record := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64 + len(data))
+	record = append(record[:binary.PutUvarint(record, uint64(len(data)))], data...)
+	written, err := fs.metadataFile.Write(record)
+	fs.metadataFileOffset += int64(written)
+	if err != nil {
+		return err
+	}
+	fs.chainHash = chainNext(fs.chainHash, record)
+	fs.records.Append(leaf)
+	fs.recordSegments(metadata)
+	close(fs.appendSignal)
+	fs.appendSignal = make(chan struct{})
+	return nil
+}
+
+// recordSegments notes which segments the FileMap in metadata, if it has
+// one, refers to. The caller must hold metadataMutex.
+func (fs *AppendFS) recordSegments(metadata *messages.NodeMetadata) {
+	if metadata.Valid != nil && !metadata.GetValid() {
+		delete(fs.recordedSegments, metadata.GetNodeId())
+	} else if metadata.Contents != nil {
+		fs.recordedSegments[metadata.GetNodeId()] = fileMapSegments(metadata.Contents)
+	}
+}
+
+func syncFile(file interface{}) error {
+	if s, ok := file.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// SyncData forces everything appended to the data file so far to stable
+// storage, and then writes and syncs the records of the chunks stored in
+// it to the chunk index.
+func (fs *AppendFS) SyncData() error {
+	var chunks []pendingChunk
+	if fs.chunks != nil {
+		// Taken first: their data was appended before they were added
+		fs.chunks.mutex.Lock()
+		chunks, fs.chunks.pending = fs.chunks.pending, nil
+		fs.chunks.mutex.Unlock()
+	}
+	fs.dataMutex.RLock()
+	err := syncFile(fs.dataFile)
+	fs.dataMutex.RUnlock()
+	if err != nil && fs.chunks != nil {
+		fs.chunks.mutex.Lock()
+		fs.chunks.pending = append(chunks, fs.chunks.pending...)
+		fs.chunks.mutex.Unlock()
+	}
+	if err != nil || fs.chunks == nil {
+		return err
+	}
+	return fs.writeChunks(chunks)
+}
+
+// SyncMetadata forces everything appended to the metadata file so far to
+// stable storage.
+func (fs *AppendFS) SyncMetadata() error {
+	fs.metadataMutex.RLock()
+	err := syncFile(fs.metadataFile)
+	fs.metadataMutex.RUnlock()
+	return err
+}
+
+// Sync forces both files to stable storage. The data file goes first so
+// that a FileMap never reaches the disk before the data it points at. The
+// audit log, if any, goes last.
+func (fs *AppendFS) Sync() error {
+	err := fs.SyncData()
+	if err != nil {
+		return err
+	}
+	err = fs.SyncMetadata()
+	if err != nil {
+		return err
+	}
+	return fs.syncAudit()
+}
+
+func (fs *AppendFS) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := fs.Sync(); err != nil {
+				fmt.Println(err)
+			}
+		case <-fs.syncStop:
+			return
+		}
+	}
+}
+
 func (fs *AppendFS) LoadMetadata() error {
 	ret := (error)(nil)
 	fs.metadataMutex.Lock()
 	nodes := make(map[uint64]*messages.NodeMetadata)
 	children := make(map[uint64][]uint64)
+	// Unlinked while open when the volume was last used
+	orphans := make([]uint64, 0)
 	_, err := fs.metadataFile.Seek(0, 0)
-	bufferedReader := bufio.NewReader(fs.metadataFile)
+	reader := newMetadataReader(fs.metadataFile, 0, fs.encryption)
 	if err != nil {
 		ret = err
 		goto Finally
 	}
 	for {
-		msgLen, err := binary.ReadUvarint(bufferedReader)
+		prev := reader.hash
+		metadata, start, err := reader.Next()
 		if err != nil {
-			// EOF is ok here
-			if err == io.EOF {
+			// EOF is ok here, as is a record still being written by the
+			// volume a follower follows
+			if err == io.EOF || (fs.follower && err == io.ErrUnexpectedEOF) {
 				fmt.Println("Reached expected EOF")
+				fs.chainHash = reader.hash
+				fs.metadataFileOffset = reader.offset
 				break
 			}
+			if fs.repairMetadata(start, prev) {
+				_, err = fs.metadataFile.Seek(start, 0)
+				if err == nil {
+					reader = newMetadataReader(fs.metadataFile, start, fs.encryption)
+					reader.hash = prev
+					continue
+				}
+			}
 			ret = err
 			goto Finally
 		}
-		msgBuf := make([]byte, msgLen)
-		//fmt.Printf("MsgLen: %d\n", msgLen)
-		_, err = io.ReadAtLeast(bufferedReader, msgBuf, int(msgLen))
-		if err != nil {
-			ret = err
-			goto Finally
-		}
-		metadata := &messages.NodeMetadata{}
-		err = proto.Unmarshal(msgBuf, metadata)
-		if err != nil {
-			ret = err
-			goto Finally
-		}
+		fs.records.Append(merkle.LeafHash(reader.record))
 		if currentNode, ok := nodes[metadata.GetNodeId()]; ok {
 			if metadata.Contents != nil {
 				currentNode.Contents = nil
@@ -149,9 +566,15 @@ func (fs *AppendFS) LoadMetadata() error {
 			//fmt.Printf("Added %d\n", metadata.GetNodeId())
 		}
 	}
+	fs.loadQuotas(nodes[volumeRecordId].GetQuota())
 	for id, node := range nodes {
 		fs.seenNodeId(id)
-		if !node.GetValid() {
+		fs.recordSegments(node)
+		if id == volumeRecordId || !node.GetValid() {
+			continue
+		}
+		if node.GetOrphan() {
+			orphans = append(orphans, id)
 			continue
 		}
 		if node.ParentNodeId != nil {
@@ -161,7 +584,7 @@ func (fs *AppendFS) LoadMetadata() error {
 				children[node.GetParentNodeId()] = append(make([]uint64, 0), id)
 			}
 		} else {
-			ret = errors.New("Corrupt metadata: missing ParentFileId for file " + string(id))
+			ret = fmt.Errorf("Corrupt metadata: missing ParentFileId for file %d", id)
 			goto Finally
 		}
 	}
@@ -170,6 +593,20 @@ func (fs *AppendFS) LoadMetadata() error {
 
 	Finally:
 	fs.metadataMutex.Unlock()
+	if ret == nil {
+		fs.recountQuotas()
+		if fs.follower {
+			// Left for the volume's own process to reclaim
+			orphans = nil
+		}
+		for _, id := range orphans {
+			fmt.Printf("Reclaiming orphan %d\n", id)
+			ret = fs.reclaimNode(id)
+			if ret != nil {
+				break
+			}
+		}
+	}
 	return  ret
 }
 
@@ -192,6 +629,35 @@ func (fs *AppendFS) addChildrenHelper(nodes map[uint64]*messages.NodeMetadata, c
 
 func (fs *AppendFS) Close() error {
 	var err error
+	if fs.syncStop != nil {
+		close(fs.syncStop)
+	}
+	if fs.followStop != nil {
+		close(fs.followStop)
+		fs.following.Wait()
+	}
+	if fs.cold != nil && fs.cold.stop != nil {
+		close(fs.cold.stop)
+		fs.cold.running.Wait()
+	}
+	fs.compactions.Wait()
+	err = fs.Checkpoint()
+	if err != nil {
+		return err
+	}
+	if fs.syncPolicy != SyncUnsafe {
+		err = fs.Sync()
+		if err != nil {
+			return err
+		}
+	} else if fs.chunks != nil && !fs.follower {
+		// The chunks stored since the volume was opened only get into the
+		// index once their data is synced
+		err = fs.SyncData()
+		if err != nil {
+			return err
+		}
+	}
 	fs.dataMutex.Lock()
 	if closer, ok := fs.dataFile.(io.Closer); ok {
 		err = closer.Close()
@@ -208,5 +674,13 @@ func (fs *AppendFS) Close() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	if fs.chunks != nil {
+		fs.chunks.mutex.Lock()
+		err = fs.chunks.file.Close()
+		fs.chunks.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return fs.closeAudit()
 }
@@ -8,7 +8,6 @@ import (
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/e-tothe-ipi/appendfs/messages"
-	"github.com/golang/protobuf/proto"
 )
 
 var _ nodefs.File = (*AppendFSFile)(nil)
@@ -16,13 +15,18 @@ var _ nodefs.File = (*AppendFSFile)(nil)
 type AppendFSFile struct {
 	node *AppendFSNode
 	flags uint32
+	// Who opened the file
+	opener fuse.Context
 	metadataMutex sync.RWMutex
 	dirty bool
+	// Whether anything was ever written through this file
+	written bool
 }
 
 func (f *AppendFSFile) SetDirty(dirty bool) {
 	f.metadataMutex.Lock()
 	f.dirty = dirty
+	f.written = f.written || dirty
 	f.metadataMutex.Unlock()
 }
 
@@ -66,8 +70,11 @@ func (f *AppendFSFile) Write(data []byte, off int64) (written uint32, code fuse.
 // Flush is called for close() call on a file descriptor. In
 // case of duplicated descriptor, it may be called more than
 // once for a file.
+//
+// close() makes no durability promise, so the FileMap is recorded but
+// nothing is forced to disk.
 func (f *AppendFSFile) Flush() fuse.Status {
-	return f.Fsync(0)
+	return f.appendMetadata(false)
 }
 
 // This is called to before the file handle is forgotten. This
@@ -75,29 +82,77 @@ func (f *AppendFSFile) Flush() fuse.Status {
 // the call. Any cleanup that requires specific synchronization or
 // could fail with I/O errors should happen in Flush instead.
 func (f *AppendFSFile) Release() {
-
+	f.metadataMutex.RLock()
+	written := f.written
+	f.metadataMutex.RUnlock()
+	if written {
+		f.node.committed()
+	}
+	f.node.released()
 }
 
+// FUSE_FSYNC_FDATASYNC
+const fsyncDataOnly = 1
+
+// Fsync makes the data written through this file and the FileMap that
+// points at it durable. Unless flags asks for fdatasync, the rest of the
+// attributes are recorded as well. The data file is synced before the
+// FileMap is appended so a crash can never leave a map pointing at data
+// that did not make it to disk.
 func (f *AppendFSFile) Fsync(flags int) (code fuse.Status) {
-	if(f.Dirty()) {
-		metadata := &messages.NodeMetadata{NodeId:&f.node.nodeId,
-											Contents:&messages.FileMap{},
-											Size:&f.node.attr.Size}
-		rlEntries := f.node.contentRanges.InRange(0, int(f.node.attr.Size))
-		metadata.Contents.Entry = make([]*messages.FileMapEntry,0,len(rlEntries))
-		for _, entry := range rlEntries {
-			if fData, ok := entry.Data.(fileSegmentEntry); ok {
-				newEntry := &messages.FileMapEntry{Start:proto.Uint64(uint64(entry.Min)),
-													End:proto.Uint64(uint64(entry.Max)),
-													Base:proto.Uint64(uint64(fData.base))}
-				metadata.Contents.Entry = append(metadata.Contents.Entry, newEntry)
-			}
+	strict := f.node.fs.syncPolicy == SyncStrict
+	if strict {
+		err := f.node.fs.SyncData()
+		if err != nil {
+			fmt.Println(err)
+			return errorStatus(err)
 		}
-		err := f.node.fs.AppendMetadata(metadata)
-		if (err != nil) {
+	}
+	code = f.appendMetadata(flags & fsyncDataOnly == 0)
+	if code != fuse.OK {
+		return code
+	}
+	if strict {
+		err := f.node.fs.SyncMetadata()
+		if err != nil {
 			fmt.Println(err)
-			return fuse.EIO
+			return errorStatus(err)
+		}
+	}
+	return fuse.OK
+}
+
+// appendMetadata records the FileMap if anything was written through
+// this file, and the full set of attributes if withAttributes is set.
+func (f *AppendFSFile) appendMetadata(withAttributes bool) fuse.Status {
+	// Cleared up front so that a Write racing with us marks the file
+	// dirty again rather than being forgotten.
+	f.metadataMutex.Lock()
+	dirty := f.dirty
+	f.dirty = false
+	f.metadataMutex.Unlock()
+	if !dirty && !withAttributes {
+		return fuse.OK
+	}
+	f.node.metadataMutex.RLock()
+	var metadata *messages.NodeMetadata
+	if withAttributes {
+		metadata = f.node.AsNodeMetadata()
+	} else {
+		metadata = &messages.NodeMetadata{NodeId:&f.node.nodeId,
+											Size:&f.node.attr.Size}
+	}
+	if dirty {
+		metadata.Contents = f.node.fileMap()
+	}
+	err := f.node.fs.AppendMetadata(metadata)
+	f.node.metadataMutex.RUnlock()
+	if (err != nil) {
+		fmt.Println(err)
+		if dirty {
+			f.SetDirty(true)
 		}
+		return errorStatus(err)
 	}
 	return fuse.OK
 }
@@ -2,13 +2,14 @@ package appendfs
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 	"syscall"
-	"os"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/e-tothe-ipi/appendfs/acl"
 	"github.com/e-tothe-ipi/appendfs/messages"
 	"github.com/e-tothe-ipi/appendfs/rangelist"
 	"github.com/golang/protobuf/proto"
@@ -25,10 +26,36 @@ type AppendFSNode struct {
 	xattr map[string][]byte
 	contentRanges rangelist.RangeList
 	symlink	[]byte
-}
-
+	// Number of open AppendFSFiles
+	openCount int
+	// Unlinked while open, see orphan.go
+	orphan bool
+	// POSIX ACLs, nil if the node has none
+	aclAccess acl.ACL
+	aclDefault acl.ACL
+	// See worm.go
+	worm bool
+	retainUntil uint64
+	// See attrflags.go
+	flags uint32
+}
+
+// For plain extents, logical offset x is at base + x in the segment.
+// Compressed or encrypted extents are a blob of length bytes at
+// base + origin, holding the data written at logical offset origin.
+// With checksums enabled every extent is a blob, and checksum is the
+// sha256 of the blob before it was sealed. With proofs enabled, digest is
+// the sha256 of the size bytes the extent was written with, starting at
+// origin.
 type fileSegmentEntry struct {
+	segment uint64
 	base int
+	codec Codec
+	origin int
+	length int
+	checksum string
+	digest string
+	size int
 }
 
 func (node *AppendFSNode) incrementLinks() {
@@ -76,6 +103,7 @@ func CreateNode(parent *AppendFSNode) *AppendFSNode {
 		node.fs = parent.fs
 		node.nodeId = node.fs.NextNodeId()
 		node.attr.Blksize = node.fs.blockSize
+		node.fs.registerNode(node)
 	}
 	return node
 }
@@ -85,35 +113,131 @@ func (node *AppendFSNode) AsNodeMetadata() *messages.NodeMetadata {
 					Uid:&node.attr.Uid, Gid:&node.attr.Gid, ParentNodeId:&node.parentNodeId,
 					Atime:&node.attr.Atime, Mtime:&node.attr.Mtime, Ctime:&node.attr.Ctime,
 					Name:&node.name, Nlink:&node.attr.Nlink, Symlink:node.symlink,
-					Size:&node.attr.Size, Valid:proto.Bool(true)}
+					Size:&node.attr.Size, Rdev:&node.attr.Rdev, Valid:proto.Bool(true),
+					AclAccess:aclBytes(node.aclAccess), AclDefault:aclBytes(node.aclDefault),
+					Worm:&node.worm, RetainUntil:&node.retainUntil, Flags:&node.flags}
 	return metadata
 }
 
 func FromNodeMetadata(fs *AppendFS, md *messages.NodeMetadata) (*AppendFSNode) {
-	node := &AppendFSNode{nodeId:md.GetNodeId(), parentNodeId:md.GetParentNodeId(),
-							name:md.GetName()}
-	node.attr.Uid = md.GetUid()
-	node.attr.Gid = md.GetGid()
-	node.attr.Mode = md.GetMode()
-	node.attr.Atime = md.GetAtime()
-	node.attr.Mtime = md.GetMtime()
-	node.attr.Ctime = md.GetCtime()
-	node.attr.Nlink = md.GetNlink()
-	node.attr.Size = md.GetSize()
-	node.symlink = md.GetSymlink()
+	node := &AppendFSNode{}
+	node.xattr = make(map[string][]byte)
 	node.fs = fs
 	node.attr.Blksize = fs.blockSize
-	for _, entry := range md.GetContents().GetEntry() {
-		fData := fileSegmentEntry{base:int(entry.GetBase())}
-		node.contentRanges.Overwrite(&rangelist.RangeListEntry{Min:int(entry.GetStart()),
-																Max:int(entry.GetEnd()),
-																Data:fData})
+	node.applyMetadata(md)
+	fs.registerNode(node)
+	return node
+}
 
+// applyMetadata sets whatever md records about the node, leaving the rest
+// as it is. The caller must hold metadataMutex if the node is live.
+func (node *AppendFSNode) applyMetadata(md *messages.NodeMetadata) {
+	if md.NodeId != nil {
+		node.nodeId = md.GetNodeId()
 	}
-	return node
+	if md.ParentNodeId != nil {
+		node.parentNodeId = md.GetParentNodeId()
+	}
+	if md.Name != nil {
+		node.name = md.GetName()
+	}
+	if md.Uid != nil {
+		node.attr.Uid = md.GetUid()
+	}
+	if md.Gid != nil {
+		node.attr.Gid = md.GetGid()
+	}
+	if md.Mode != nil {
+		node.attr.Mode = md.GetMode()
+	}
+	if md.Atime != nil {
+		node.attr.Atime = md.GetAtime()
+	}
+	if md.Mtime != nil {
+		node.attr.Mtime = md.GetMtime()
+	}
+	if md.Ctime != nil {
+		node.attr.Ctime = md.GetCtime()
+	}
+	if md.Nlink != nil {
+		node.attr.Nlink = md.GetNlink()
+	}
+	if md.Size != nil {
+		node.attr.Size = md.GetSize()
+	}
+	if md.Rdev != nil {
+		node.attr.Rdev = md.GetRdev()
+	}
+	if md.Symlink != nil {
+		node.symlink = md.GetSymlink()
+	}
+	if md.AclAccess != nil {
+		node.aclAccess = parseStoredACL(md.GetAclAccess())
+	}
+	if md.AclDefault != nil {
+		node.aclDefault = parseStoredACL(md.GetAclDefault())
+	}
+	if md.Worm != nil {
+		node.worm = md.GetWorm()
+	}
+	if md.RetainUntil != nil {
+		node.retainUntil = md.GetRetainUntil()
+	}
+	if md.Flags != nil {
+		node.flags = md.GetFlags()
+	}
+	if md.Contents != nil {
+		node.contentRanges = rangelist.RangeList{}
+		for _, entry := range md.GetContents().GetEntry() {
+			node.contentRanges.Overwrite(&rangelist.RangeListEntry{Min:int(entry.GetStart()),
+																	Max:int(entry.GetEnd()),
+																	Data:segmentEntry(entry)})
+		}
+	}
+}
+
+func segmentEntry(entry *messages.FileMapEntry) fileSegmentEntry {
+	return fileSegmentEntry{segment:entry.GetSegment(), base:int(entry.GetBase()),
+							codec:Codec(entry.GetCodec()), origin:int(entry.GetOrigin()),
+							length:int(entry.GetLength()), checksum:string(entry.GetChecksum()),
+							digest:string(entry.GetDigest()), size:int(entry.GetSize())}
+}
+
+// fileMap describes where the node's contents live in the data log. The
+// caller must hold metadataMutex.
+func (node *AppendFSNode) fileMap() *messages.FileMap {
+	fileMap := &messages.FileMap{}
+	rlEntries := node.contentRanges.InRange(0, int(node.attr.Size))
+	fileMap.Entry = make([]*messages.FileMapEntry,0,len(rlEntries))
+	for _, entry := range rlEntries {
+		if fData, ok := entry.Data.(fileSegmentEntry); ok {
+			newEntry := &messages.FileMapEntry{Start:proto.Uint64(uint64(entry.Min)),
+												End:proto.Uint64(uint64(entry.Max)),
+												Base:proto.Uint64(uint64(fData.base)),
+												Segment:proto.Uint64(fData.segment)}
+			if fData.length > 0 {
+				newEntry.Codec = proto.Uint32(uint32(fData.codec))
+				newEntry.Origin = proto.Uint64(uint64(fData.origin))
+				newEntry.Length = proto.Uint64(uint64(fData.length))
+			}
+			if fData.checksum != "" {
+				newEntry.Checksum = []byte(fData.checksum)
+			}
+			if fData.digest != "" {
+				newEntry.Origin = proto.Uint64(uint64(fData.origin))
+				newEntry.Digest = []byte(fData.digest)
+				newEntry.Size = proto.Uint64(uint64(fData.size))
+			}
+			fileMap.Entry = append(fileMap.Entry, newEntry)
+		}
+	}
+	return fileMap
 }
 
 func (parent *AppendFSNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+	if code := parent.checkAccess(fuse.X_OK, context); code != fuse.OK {
+		return nil, code
+	}
 	child := parent.inode.GetChild(name)
 	if child != nil {
 		if appendfsChild, success := child.Node().(*AppendFSNode); success {
@@ -139,32 +263,16 @@ func (node *AppendFSNode) OnForget() {
 
 
 func (node *AppendFSNode) Access(mode uint32, context *fuse.Context) (code fuse.Status) {
-
-	node.metadataMutex.RLock()
-	code = fuse.OK
-	if mode & fuse.R_OK > 0 {
-		if !( (node.attr.Uid == context.Uid && getBit(&node.attr.Mode, syscall.S_IRUSR)) ||
-		      (node.attr.Gid == context.Gid && getBit(&node.attr.Mode, syscall.S_IRGRP)) ||
-			  (getBit(&node.attr.Mode, syscall.S_IROTH)) ) {
-			code = fuse.EACCES
-		}
-	}
-	if mode & fuse.W_OK > 0 {
-		if !( (node.attr.Uid == context.Uid && getBit(&node.attr.Mode, syscall.S_IWUSR)) ||
-		      (node.attr.Gid == context.Gid && getBit(&node.attr.Mode, syscall.S_IWGRP)) ||
-			  (getBit(&node.attr.Mode, syscall.S_IWOTH)) ) {
-			code = fuse.EACCES
-		}
-	}
-	if mode & fuse.X_OK > 0 {
-		if !( (node.attr.Uid == context.Uid && getBit(&node.attr.Mode, syscall.S_IXUSR)) ||
-		      (node.attr.Gid == context.Gid && getBit(&node.attr.Mode, syscall.S_IXGRP)) ||
-			  (getBit(&node.attr.Mode, syscall.S_IXOTH)) ) {
-			code = fuse.EACCES
-		}
+	if mode & fuse.W_OK != 0 && node.fs.follower {
+		return fuse.Status(syscall.EROFS)
 	}
+	node.metadataMutex.RLock()
+	permitted := node.permits(mode, context)
 	node.metadataMutex.RUnlock()
-	return
+	if !permitted {
+		return fuse.EACCES
+	}
+	return fuse.OK
 }
 
 func (node *AppendFSNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
@@ -176,43 +284,104 @@ func (node *AppendFSNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
 	return node.symlink, fuse.OK
 }
 
-func (node *AppendFSNode) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
-	return nil, fuse.ENOSYS
+func (parent *AppendFSNode) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
+	defer parent.audit(&code, context, auditMknod, name, "%o %d", mode, dev)
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG, syscall.S_IFIFO, syscall.S_IFSOCK:
+		dev = 0
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		if context != nil && context.Uid != 0 {
+			return nil, fuse.EPERM
+		}
+	default:
+		return nil, fuse.EINVAL
+	}
+	if code := parent.checkAccess(fuse.W_OK | fuse.X_OK, context); code != fuse.OK {
+		return nil, code
+	}
+	if parent.Inode().GetChild(name) != nil {
+		return nil, fuse.Status(syscall.EEXIST)
+	}
+	if code := parent.checkCreate(context); code != fuse.OK {
+		return nil, code
+	}
+	node := CreateNode(parent)
+	node.attr.Mode = mode
+	node.attr.Rdev = dev
+	if context != nil {
+		node.attr.Uid = context.Uid
+		node.attr.Gid = context.Gid
+	}
+	node.inheritACL(parent)
+	node.chargeNode(0, 1)
+	node.name = name
+	inode := parent.Inode().NewChild(name, false, node)
+	parent.incrementLinks()
+
+	err := node.fs.AppendMetadata(node.AsNodeMetadata())
+	if err != nil {
+		return nil, errorStatus(err)
+	}
+
+	return inode, fuse.OK
 }
 
 func (parent *AppendFSNode) Mkdir(name string, mode uint32, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
+	defer parent.audit(&code, context, auditMkdir, name, "%o", mode)
+	if code := parent.checkAccess(fuse.W_OK | fuse.X_OK, context); code != fuse.OK {
+		return nil, code
+	}
 	if parent.Inode().GetChild(name) != nil {
 		return nil, fuse.Status(syscall.EEXIST)
 	}
+	if code := parent.checkCreate(context); code != fuse.OK {
+		return nil, code
+	}
 	node := CreateNode(parent)
 	node.attr.Mode = mode | fuse.S_IFDIR
 	node.attr.Nlink = 2
+	if context != nil {
+		node.attr.Uid = context.Uid
+		node.attr.Gid = context.Gid
+	}
+	node.inheritACL(parent)
+	node.chargeNode(0, 1)
 	node.name = name
 	inode := parent.inode.NewChild(name, true, node)
 	parent.incrementLinks()
 
 	err := node.fs.AppendMetadata(node.AsNodeMetadata())
 	if err != nil {
-		return nil, fuse.EIO
+		return nil, errorStatus(err)
 	}
 
 	return inode, fuse.OK
 }
 
 func (node *AppendFSNode) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	defer node.audit(&code, context, auditUnlink, name, "")
+	return node.unlink(name, context)
+}
+
+func (node *AppendFSNode) unlink(name string, context *fuse.Context) fuse.Status {
 	child := node.Inode().GetChild(name)
 	if(child == nil) {
 		return fuse.ENOENT
 	}
 	if appendfsChild, ok := child.Node().(*AppendFSNode); ok {
+		if code := node.checkRemove(appendfsChild, context); code != fuse.OK {
+			return code
+		}
+		if code := appendfsChild.checkRetained(); code != fuse.OK {
+			return code
+		}
 		appendfsChild.decrementLinks()
 		if appendfsChild.Deletable(){
 			node.decrementLinks()
 		}
-		metadata := &messages.NodeMetadata{NodeId:&appendfsChild.nodeId, Valid:proto.Bool(false)}
-		err := node.fs.AppendMetadata(metadata)
+		err := node.fs.removeNode(appendfsChild)
 		if err != nil {
-			return fuse.EIO
+			return errorStatus(err)
 		}
 	}
 	node.Inode().RmChild(name)
@@ -221,15 +390,33 @@ func (node *AppendFSNode) Unlink(name string, context *fuse.Context) (code fuse.
 }
 
 func (node *AppendFSNode) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
-	return node.Unlink(name, context)
+	defer node.audit(&code, context, auditRmdir, name, "")
+	child := node.Inode().GetChild(name)
+	if child != nil && len(child.FsChildren()) > 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	return node.unlink(name, context)
 }
 
-func (parent *AppendFSNode) Symlink(name string, content string, context *fuse.Context) (*nodefs.Inode, fuse.Status) {
+func (parent *AppendFSNode) Symlink(name string, content string, context *fuse.Context) (newNode *nodefs.Inode, code fuse.Status) {
+	defer parent.audit(&code, context, auditSymlink, name, "%s", content)
+	if code := parent.checkAccess(fuse.W_OK | fuse.X_OK, context); code != fuse.OK {
+		return nil, code
+	}
 	if parent.Inode().GetChild(name) != nil {
 		return nil, fuse.Status(syscall.EEXIST)
 	}
+	if code := parent.checkCreate(context); code != fuse.OK {
+		return nil, code
+	}
 	node := CreateNode(parent)
 	node.attr.Mode = 0777 | fuse.S_IFLNK
+	if context != nil {
+		node.attr.Uid = context.Uid
+		node.attr.Gid = context.Gid
+	}
+	node.inheritACL(parent)
+	node.chargeNode(0, 1)
 	contentBytes := []byte(content)
 	node.setSize(uint64(len(contentBytes)))
 	node.symlink = contentBytes
@@ -239,24 +426,84 @@ func (parent *AppendFSNode) Symlink(name string, content string, context *fuse.C
 
 	err := node.fs.AppendMetadata(node.AsNodeMetadata())
 	if err != nil {
-		return nil, fuse.EIO
+		return nil, errorStatus(err)
 	}
 
 	return node.Inode(), fuse.OK
 }
 
 func (parent *AppendFSNode) Rename(oldName string, newParent nodefs.Node, newName string, context *fuse.Context) (code fuse.Status) {
+	if appendfsNewParent, ok := newParent.(*AppendFSNode); ok && parent.fs.auditLog != nil {
+		newPath := strings.TrimSuffix(appendfsNewParent.path(), "/") + "/" + newName
+		defer parent.audit(&code, context, auditRename, oldName, "%s", newPath)
+	}
 	child := parent.Inode().GetChild(oldName)
 	if(child == nil) {
 		return fuse.ENOENT
 	}
+	appendfsChild, ok := child.Node().(*AppendFSNode)
+	if ok {
+		if code := parent.checkRemove(appendfsChild, context); code != fuse.OK {
+			return code
+		}
+		if code := appendfsChild.checkRetained(); code != fuse.OK {
+			return code
+		}
+	}
+	var appendfsTarget *AppendFSNode
+	appendfsNewParent, newParentOk := newParent.(*AppendFSNode)
+	if newParentOk {
+		code := appendfsNewParent.checkAccess(fuse.W_OK | fuse.X_OK, context)
+		if code == fuse.OK {
+			code = appendfsNewParent.checkFlags(flagImmutable)
+		}
+		if target := newParent.Inode().GetChild(newName); target != nil && code == fuse.OK {
+			if appendfsTarget, ok = target.Node().(*AppendFSNode); ok {
+				code = appendfsNewParent.checkRemove(appendfsTarget, context)
+				if code == fuse.OK {
+					code = appendfsTarget.checkRetained()
+				}
+			}
+		}
+		if code != fuse.OK {
+			return code
+		}
+		// Like a rename between filesystems, so that mv copies the
+		// files and the destination's quotas apply
+		if !parent.fs.sameQuotaDirs(parent.nodeId, appendfsNewParent.nodeId) {
+			return fuse.EXDEV
+		}
+	}
 	parent.Inode().RmChild(oldName)
 	parent.decrementLinks()
 	newParent.Inode().RmChild(newName)
+	if appendfsTarget != nil && appendfsTarget != appendfsChild {
+		appendfsTarget.decrementLinks()
+		if appendfsTarget.Deletable() {
+			appendfsNewParent.decrementLinks()
+		}
+		if err := parent.fs.removeNode(appendfsTarget); err != nil {
+			return errorStatus(err)
+		}
+	}
 	newParent.Inode().AddChild(newName, child)
-	if appendfsNewParent, ok := newParent.(*AppendFSNode); ok {
+	if newParentOk {
 		appendfsNewParent.incrementLinks()
 	}
+	if appendfsChild != nil && newParentOk {
+		appendfsChild.metadataMutex.Lock()
+		parent.fs.quotaMutex.Lock()
+		appendfsChild.parentNodeId = appendfsNewParent.nodeId
+		parent.fs.quotaMutex.Unlock()
+		appendfsChild.name = newName
+		metadata := &messages.NodeMetadata{NodeId:&appendfsChild.nodeId,
+						ParentNodeId:&appendfsChild.parentNodeId, Name:&appendfsChild.name}
+		err := parent.fs.AppendMetadata(metadata)
+		appendfsChild.metadataMutex.Unlock()
+		if err != nil {
+			return errorStatus(err)
+		}
+	}
 	return fuse.OK
 }
 
@@ -266,36 +513,73 @@ func (node *AppendFSNode) Link(name string, existing nodefs.Node, context *fuse.
 
 
 func (parent *AppendFSNode) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, child *nodefs.Inode, code fuse.Status) {
+	defer parent.audit(&code, context, auditCreate, name, "%o", mode)
+	if code := parent.checkAccess(fuse.W_OK | fuse.X_OK, context); code != fuse.OK {
+		return nil, nil, code
+	}
 	if parent.Inode().GetChild(name) != nil {
 		return nil, nil, fuse.Status(syscall.EEXIST)
 	}
+	if code := parent.checkCreate(context); code != fuse.OK {
+		return nil, nil, code
+	}
+	if err := parent.fs.checkSpace(0, false); err != nil {
+		return nil, nil, errorStatus(err)
+	}
 	node := CreateNode(parent)
 	node.attr.Mode = mode | fuse.S_IFREG
 	node.attr.Uid = context.Uid
 	node.attr.Gid = context.Gid
+	node.inheritACL(parent)
+	node.chargeNode(0, 1)
 	node.name = name
 	parent.Inode().NewChild(name, false, node)
 	parent.incrementLinks()
 
 	err := node.fs.AppendMetadata(node.AsNodeMetadata())
 	if err != nil {
-		return nil, nil, fuse.EIO
+		return nil, nil, errorStatus(err)
 	}
 
-	f, openStatus := node.Open(flags, context)
+	// creat() may ask for write access to a file whose mode doesn't grant it
+	f, openStatus := node.Open(flags, nil)
 	if openStatus != fuse.OK {
 		return nil, nil, openStatus
 	}
+	f.(*AppendFSFile).opener = *context
 	return f, node.Inode(), fuse.OK
 }
 
 func (node *AppendFSNode) Open(flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	if code := node.checkAccess(openModes(flags), context); code != fuse.OK {
+		return nil, code
+	}
+	if openModes(flags) & fuse.W_OK != 0 {
+		if code := node.checkModify(); code != fuse.OK {
+			return nil, code
+		}
+		if code := node.checkFlags(flagImmutable); code != fuse.OK {
+			return nil, code
+		}
+		if flags & syscall.O_APPEND == 0 || flags & syscall.O_TRUNC != 0 {
+			if code := node.checkFlags(flagAppend); code != fuse.OK {
+				return nil, code
+			}
+		}
+	}
 	f := CreateFile(node)
 	f.flags = flags
+	if context != nil {
+		f.opener = *context
+	}
+	node.opened()
 	return f, fuse.OK
 }
 
 func (node *AppendFSNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if code := node.checkAccess(fuse.R_OK, context); code != fuse.OK {
+		return nil, code
+	}
 	children := node.inode.FsChildren()
 	ls := make([]fuse.DirEntry, 0, len(children))
 	for name, inode := range children {
@@ -311,22 +595,31 @@ func (node *AppendFSNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.
 
 func (node *AppendFSNode) Read(file nodefs.File, dest []byte, off int64, context *fuse.Context) (fuse.ReadResult, fuse.Status) {
 	ret := fuse.OK
-	dataFile, err := os.Open(node.fs.dataFilePath)
-	if err != nil {
-		ret = fuse.EIO
-	}
+	segments := node.fs.newSegmentReader()
 	node.metadataMutex.RLock()
 	start, end := int(off), int(off) + len(dest) - 1
 	entries := node.contentRanges.InRange(start, end)
+	// Holes, such as those left by cloning a sparse range, read as zeros
+	for i := range dest {
+		dest[i] = 0
+	}
 	for _, entry := range entries {
 		readStart, readEnd := max(entry.Min, start), min(entry.Max, end) + 1
 		blockStart, blockEnd := readStart - int(off), readEnd - int(off)
 		blockDest := dest[blockStart:blockEnd]
-		if fse, ok := entry.Data.(fileSegmentEntry); ok {
+		if fse, ok := entry.Data.(fileSegmentEntry); ok && fse.length > 0 {
+			blob, err := node.fs.readBlob(segments, fse, readEnd - fse.origin)
+			if err != nil {
+				fmt.Printf("Read error: %v\n", err)
+				ret = fuse.EIO
+				continue
+			}
+			copy(blockDest, blob[readStart - fse.origin:])
+		} else if ok {
 			readPos :=  int64(fse.base + readStart)
 			//fmt.Printf("fileOffset: %d, blockStart: %d, blockEnd: %d, readPos: %d, min: %d, max: %d\n", 
 			//fse.fileOffset, blockStart, blockEnd, readPos, entry.Min, entry.Max)
-			_, err = dataFile.ReadAt(blockDest,readPos)
+			_, err := segments.ReadAt(fse.segment, blockDest, readPos)
 			if err != nil {
 				fmt.Printf("Read error\n")
 				ret = fuse.EIO
@@ -335,7 +628,7 @@ func (node *AppendFSNode) Read(file nodefs.File, dest []byte, off int64, context
 		}
 	}
 	node.metadataMutex.RUnlock()
-	err = dataFile.Close()
+	err := segments.Close()
 	if err != nil {
 		ret = fuse.EIO
 	}
@@ -347,6 +640,7 @@ func (node *AppendFSNode) Read(file nodefs.File, dest []byte, off int64, context
 
 
 func (node *AppendFSNode) setSize(size uint64) {
+	node.chargeNode(int64(size) - int64(node.attr.Size), 0)
 	node.attr.Size = size
 	node.attr.Blocks = uint64(node.attr.Size / 512)
 	if node.attr.Size % 512 > 0 {
@@ -355,25 +649,59 @@ func (node *AppendFSNode) setSize(size uint64) {
 }
 
 func (node *AppendFSNode) Write(file nodefs.File, data []byte, off int64, context *fuse.Context) (written uint32, code fuse.Status) {
+	defer node.audit(&code, caller(file, context), auditWrite, "", "%d %d", off, len(data))
+	var writer uint32
 	if f, ok := file.(*AppendFSFile); ok {
 		f.SetDirty(true)
+		writer = f.opener.Uid
 	}
-	pos, err := node.fs.AppendData(data)
-	if err != nil {
-		return 0, fuse.EIO
+	if context != nil {
+		writer = context.Uid
 	}
 	n := len(data)
+	if code := node.checkModify(); code != fuse.OK {
+		return 0, code
+	}
+	if code := node.checkFlags(flagImmutable); code != fuse.OK {
+		return 0, code
+	}
+	if code := node.checkAppend(off); code != fuse.OK {
+		return 0, code
+	}
+	if code := node.checkGrowth(uint64(int(off) + n)); code != fuse.OK {
+		return 0, code
+	}
+	node.fs.compactMutex.RLock()
+	extents, err := node.fs.storeData(data, int(off))
+	if err != nil {
+		node.fs.compactMutex.RUnlock()
+		fmt.Println(err)
+		return 0, errorStatus(err)
+	}
 	node.metadataMutex.Lock()
-	node.contentRanges.Overwrite(&rangelist.RangeListEntry{Min:int(off),
-			Max:int(off) + n - 1,
-			Data:fileSegmentEntry{base: pos - int(off)}})
+	for _, extent := range extents {
+		node.contentRanges.Overwrite(extent)
+	}
 	node.setSize(uint64(max(int(node.attr.Size), len(data) + int(off))))
+	killed := writer != 0 && node.killPrivileges()
 	node.metadataMutex.Unlock()
+	node.fs.compactMutex.RUnlock()
+	if killed {
+		if code := node.appendMode(); code != fuse.OK {
+			return 0, code
+		}
+	}
 	return uint32(n), fuse.OK
 }
 
 
 func (node *AppendFSNode) GetXAttr(attribute string, context *fuse.Context) (data []byte, code fuse.Status) {
+	if isControlXAttr(attribute) {
+		return node.getControlXAttr(attribute, context)
+	}
+	if isACLXAttr(attribute) {
+		return node.getACLXAttr(attribute)
+	}
 	node.metadataMutex.RLock()
 	xattr := node.xattr[attribute]
 	node.metadataMutex.RUnlock()
@@ -383,7 +711,17 @@ func (node *AppendFSNode) GetXAttr(attribute string, context *fuse.Context) (dat
 	return xattr, fuse.OK
 }
 
-func (node *AppendFSNode) RemoveXAttr(attr string, context *fuse.Context) fuse.Status {
+func (node *AppendFSNode) RemoveXAttr(attr string, context *fuse.Context) (code fuse.Status) {
+	defer node.audit(&code, context, auditRemoveXAttr, "", "%s", attr)
+	if isACLXAttr(attr) {
+		return node.setACLXAttr(attr, nil, context)
+	}
+	if code := node.checkAccess(fuse.W_OK, context); code != fuse.OK {
+		return code
+	}
+	if code := node.checkFlags(flagImmutable); code != fuse.OK {
+		return code
+	}
 	node.metadataMutex.Lock()
 	xattr := node.xattr[attr]
 	delete(node.xattr, attr)
@@ -394,7 +732,20 @@ func (node *AppendFSNode) RemoveXAttr(attr string, context *fuse.Context) fuse.S
 	return fuse.OK
 }
 
-func (node *AppendFSNode) SetXAttr(attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+func (node *AppendFSNode) SetXAttr(attr string, data []byte, flags int, context *fuse.Context) (code fuse.Status) {
+	defer node.audit(&code, context, auditSetXAttr, "", "%s", attr)
+	if isControlXAttr(attr) {
+		return node.setControlXAttr(attr, data, context)
+	}
+	if isACLXAttr(attr) {
+		return node.setACLXAttr(attr, data, context)
+	}
+	if code := node.checkAccess(fuse.W_OK, context); code != fuse.OK {
+		return code
+	}
+	if code := node.checkFlags(flagImmutable); code != fuse.OK {
+		return code
+	}
 	node.metadataMutex.Lock()
 	node.xattr[attr] = data
 	node.metadataMutex.Unlock()
@@ -407,6 +758,12 @@ func (node *AppendFSNode) ListXAttr(context *fuse.Context) (attrs []string, code
 	for key := range node.xattr {
 		out = append(out, key)
 	}
+	if node.aclAccess != nil {
+		out = append(out, aclAccessXAttr)
+	}
+	if node.aclDefault != nil {
+		out = append(out, aclDefaultXAttr)
+	}
 	node.metadataMutex.RUnlock()
 	return out, fuse.OK
 }
@@ -420,7 +777,21 @@ func (node *AppendFSNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fus
 
 
 func (node *AppendFSNode) Chmod(file nodefs.File, perms uint32, context *fuse.Context) (code fuse.Status) {
+	defer node.audit(&code, caller(file, context), auditChmod, "", "%o", perms)
+	if code := node.checkOwner(context); code != fuse.OK {
+		return code
+	}
+	if code := node.checkFlags(flagImmutable); code != fuse.OK {
+		return code
+	}
 	node.metadataMutex.Lock()
+	if context != nil && node.fs.checkPermissions && context.Uid != 0 && !inGroup(context, node.attr.Gid) {
+		// Only members of the group may hand out its privileges
+		perms &^= syscall.S_ISGID
+	}
+	setBit(&node.attr.Mode, syscall.S_ISUID, perms)
+	setBit(&node.attr.Mode, syscall.S_ISGID, perms)
+	setBit(&node.attr.Mode, syscall.S_ISVTX, perms)
 	setBit(&node.attr.Mode, syscall.S_IRUSR, perms)
 	setBit(&node.attr.Mode, syscall.S_IWUSR, perms)
 	setBit(&node.attr.Mode, syscall.S_IXUSR, perms)
@@ -430,19 +801,71 @@ func (node *AppendFSNode) Chmod(file nodefs.File, perms uint32, context *fuse.Co
 	setBit(&node.attr.Mode, syscall.S_IROTH, perms)
 	setBit(&node.attr.Mode, syscall.S_IWOTH, perms)
 	setBit(&node.attr.Mode, syscall.S_IXOTH, perms)
+	if node.aclAccess != nil {
+		node.aclAccess = node.aclAccess.WithMode(node.attr.Mode)
+	}
 	node.metadataMutex.Unlock()
+	return node.appendMode()
+}
+
+// appendMode records the node's mode, owner, group and access ACL.
+func (node *AppendFSNode) appendMode() fuse.Status {
+	node.metadataMutex.RLock()
+	metadata := &messages.NodeMetadata{NodeId:&node.nodeId, Mode:&node.attr.Mode,
+									Uid:&node.attr.Uid, Gid:&node.attr.Gid,
+									AclAccess:aclBytes(node.aclAccess)}
+	err := node.fs.AppendMetadata(metadata)
+	node.metadataMutex.RUnlock()
+	if err != nil {
+		fmt.Println(err)
+		return errorStatus(err)
+	}
 	return fuse.OK
 }
 
+// Passed to Chown for an id that isn't to be changed
+const unchangedId = ^uint32(0)
+
 func (node *AppendFSNode) Chown(file nodefs.File, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	defer node.audit(&code, caller(file, context), auditChown, "", "%d %d", int32(uid), int32(gid))
+	if code := node.checkFlags(flagImmutable); code != fuse.OK {
+		return code
+	}
 	node.metadataMutex.Lock()
-	node.attr.Uid = uid
-	node.attr.Gid = gid
+	if uid == unchangedId {
+		uid = node.attr.Uid
+	}
+	if gid == unchangedId {
+		gid = node.attr.Gid
+	}
+	if context != nil && node.fs.checkPermissions && context.Uid != 0 {
+		// The owner may only move the file between their own groups
+		if context.Uid != node.attr.Uid || uid != node.attr.Uid ||
+			(gid != node.attr.Gid && !inGroup(context, gid)) {
+			node.metadataMutex.Unlock()
+			return fuse.EPERM
+		}
+	}
+	if code := node.chown(uid, gid); code != fuse.OK {
+		node.metadataMutex.Unlock()
+		return code
+	}
+	node.killPrivileges()
 	node.metadataMutex.Unlock()
-	return fuse.OK
+	return node.appendMode()
 }
 
 func (node *AppendFSNode) Truncate(file nodefs.File, size uint64, context *fuse.Context) (code fuse.Status) {
+	defer node.audit(&code, caller(file, context), auditTruncate, "", "%d", size)
+	if code := node.checkAccess(fuse.W_OK, context); code != fuse.OK {
+		return code
+	}
+	if code := node.checkModify(); code != fuse.OK {
+		return code
+	}
+	if code := node.checkFlags(flagImmutable | flagAppend); code != fuse.OK {
+		return code
+	}
 	if size == 0 {
 		node.metadataMutex.Lock()
 		node.contentRanges = rangelist.RangeList{}
@@ -454,6 +877,14 @@ func (node *AppendFSNode) Truncate(file nodefs.File, size uint64, context *fuse.
 }
 
 func (node *AppendFSNode) Utimens(file nodefs.File, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	if code := node.checkFlags(flagImmutable); code != fuse.OK {
+		return code
+	}
+	if node.checkOwner(context) != fuse.OK {
+		if code := node.checkAccess(fuse.W_OK, context); code != fuse.OK {
+			return code
+		}
+	}
 	node.metadataMutex.Lock()
 	changeTime := node.attr.ChangeTime()
 	node.attr.SetTimes(atime, mtime, &changeTime)
@@ -466,5 +897,8 @@ func (node *AppendFSNode) Fallocate(file nodefs.File, off uint64, size uint64, m
 }
 
 func (node *AppendFSNode) StatFs() *fuse.StatfsOut {
-	return &fuse.StatfsOut{}
+	if out := node.quotaStatFs(); out != nil {
+		return out
+	}
+	return node.fs.statFs()
 }
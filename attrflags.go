@@ -0,0 +1,97 @@
+package appendfs
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/e-tothe-ipi/appendfs/messages"
+)
+
+// The append-only and immutable attributes of chattr(1). FUSE has no way
+// to pass FS_IOC_SETFLAGS on to us, so they are read and set through
+// xattrFlags as the letters lsattr uses, but stored with the same bits as
+// the ioctl. Unlike permissions they bind root as well; only root may
+// change them.
+
+const (
+	// FS_IMMUTABLE_FL: no writes, truncates, attribute changes, renames or
+	// unlinks, and no entries added or removed in a directory
+	flagImmutable uint32 = 0x10
+	// FS_APPEND_FL: writes only at the end, no truncates, renames or
+	// unlinks, and entries can only be added to a directory
+	flagAppend uint32 = 0x20
+)
+
+var flagLetters = []struct {
+	flag uint32
+	letter string
+}{{flagAppend, "a"}, {flagImmutable, "i"}}
+
+// checkFlags returns EPERM if node has any of flags set. On a follower
+// every node is immutable, and changing one gives EROFS.
+func (node *AppendFSNode) checkFlags(flags uint32) fuse.Status {
+	if node.fs.follower && flags & flagImmutable != 0 {
+		return fuse.Status(syscall.EROFS)
+	}
+	node.metadataMutex.RLock()
+	set := node.flags & flags
+	node.metadataMutex.RUnlock()
+	if set != 0 {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// checkAppend returns EPERM if node is append-only and off is not its end.
+func (node *AppendFSNode) checkAppend(off int64) fuse.Status {
+	node.metadataMutex.RLock()
+	appendOnly, size := node.flags & flagAppend != 0, node.attr.Size
+	node.metadataMutex.RUnlock()
+	if appendOnly && uint64(off) != size {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+func (node *AppendFSNode) getFlags() ([]byte, fuse.Status) {
+	node.metadataMutex.RLock()
+	flags := node.flags
+	node.metadataMutex.RUnlock()
+	out := ""
+	for _, entry := range flagLetters {
+		if flags & entry.flag != 0 {
+			out += entry.letter
+		}
+	}
+	return []byte(out), fuse.OK
+}
+
+// flagsControl replaces the flags of node with those named by arg.
+func (node *AppendFSNode) flagsControl(arg string, context *fuse.Context) fuse.Status {
+	if context != nil && context.Uid != 0 {
+		return fuse.EPERM
+	}
+	var flags uint32
+	for _, letter := range strings.Split(strings.TrimSpace(arg), "") {
+		found := false
+		for _, entry := range flagLetters {
+			if entry.letter == letter {
+				flags |= entry.flag
+				found = true
+			}
+		}
+		if !found {
+			return fuse.EINVAL
+		}
+	}
+	node.metadataMutex.Lock()
+	node.flags = flags
+	metadata := &messages.NodeMetadata{NodeId:&node.nodeId, Flags:&node.flags}
+	err := node.fs.AppendMetadata(metadata)
+	node.metadataMutex.Unlock()
+	if err != nil {
+		return errorStatus(err)
+	}
+	return fuse.OK
+}
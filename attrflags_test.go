@@ -0,0 +1,130 @@
+package appendfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func setTestFlags(t *testing.T, node *AppendFSNode, flags string) {
+	if code := node.SetXAttr(xattrFlags, []byte(flags), 0, rootCaller); code != fuse.OK {
+		t.Fatalf("Set flags %q: %v", flags, code)
+	}
+}
+
+func TestAppendOnlyFlag(t *testing.T) {
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	node := writeTestFile(t, fs, "log", []byte("first"))
+	setTestFlags(t, node, "a")
+	if _, code := node.Open(uint32(os.O_WRONLY), rootCaller); code != fuse.EPERM {
+		t.Fatalf("Open for writing without O_APPEND: %v, not EPERM", code)
+	}
+	if _, code := node.Open(uint32(os.O_WRONLY | os.O_APPEND | os.O_TRUNC), rootCaller); code != fuse.EPERM {
+		t.Fatalf("Open with O_TRUNC: %v, not EPERM", code)
+	}
+	file, code := node.Open(uint32(os.O_WRONLY | os.O_APPEND), rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Open with O_APPEND: %v", code)
+	}
+	if _, code = file.Write([]byte("over"), 0); code != fuse.EPERM {
+		t.Fatalf("Write before the end: %v, not EPERM", code)
+	}
+	if _, code = file.Write([]byte(" second"), 5); code != fuse.OK {
+		t.Fatalf("Write at the end: %v", code)
+	}
+	file.Flush()
+	file.Release()
+	if code = node.Truncate(nil, 0, rootCaller); code != fuse.EPERM {
+		t.Fatalf("Truncate: %v, not EPERM", code)
+	}
+	if code = fs.Root().Unlink("log", rootCaller); code != fuse.EPERM {
+		t.Fatalf("Unlink: %v, not EPERM", code)
+	}
+	if got := string(readTestFile(t, fs, "log", 12)); got != "first second" {
+		t.Fatalf("Read %q, not %q", got, "first second")
+	}
+}
+
+func TestImmutableFlag(t *testing.T) {
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	node := writeTestFile(t, fs, "file", []byte("fixed"))
+	setTestFlags(t, node, "i")
+	// Root included
+	if _, code := node.Open(uint32(os.O_WRONLY | os.O_APPEND), rootCaller); code != fuse.EPERM {
+		t.Fatalf("Open for writing: %v, not EPERM", code)
+	}
+	if code := node.Truncate(nil, 0, rootCaller); code != fuse.EPERM {
+		t.Fatalf("Truncate: %v, not EPERM", code)
+	}
+	if code := fs.Root().Unlink("file", rootCaller); code != fuse.EPERM {
+		t.Fatalf("Unlink: %v, not EPERM", code)
+	}
+	if code := fs.Root().Rename("file", fs.Root(), "renamed", rootCaller); code != fuse.EPERM {
+		t.Fatalf("Rename: %v, not EPERM", code)
+	}
+	if code := node.Chmod(nil, 0600, rootCaller); code != fuse.EPERM {
+		t.Fatalf("Chmod: %v, not EPERM", code)
+	}
+	// Nor can anything be added to or removed from an immutable directory
+	inode, _ := fs.Root().Mkdir("dir", 0755, rootCaller)
+	dir := inode.Node().(*AppendFSNode)
+	dir.Mkdir("sub", 0755, rootCaller)
+	setTestFlags(t, dir, "i")
+	if _, code := dir.Mkdir("other", 0755, rootCaller); code != fuse.EPERM {
+		t.Fatalf("Mkdir in an immutable directory: %v, not EPERM", code)
+	}
+	if code := dir.Rmdir("sub", rootCaller); code != fuse.EPERM {
+		t.Fatalf("Rmdir in an immutable directory: %v, not EPERM", code)
+	}
+	setTestFlags(t, node, "")
+	if code := fs.Root().Rename("file", fs.Root(), "renamed", rootCaller); code != fuse.OK {
+		t.Fatalf("Rename once the flag is cleared: %v", code)
+	}
+}
+
+func TestOnlyRootSetsFlags(t *testing.T) {
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	node := ownedTestFile(t, fs, "file", 0644)
+	if code := node.SetXAttr(xattrFlags, []byte("a"), 0, ownerCaller); code != fuse.EPERM {
+		t.Fatalf("Set flags as the owner: %v, not EPERM", code)
+	}
+	setTestFlags(t, node, "a")
+	if code := node.SetXAttr(xattrFlags, []byte(""), 0, ownerCaller); code != fuse.EPERM {
+		t.Fatalf("Clear flags as the owner: %v, not EPERM", code)
+	}
+	if code := node.SetXAttr(xattrFlags, []byte("x"), 0, rootCaller); code != fuse.EINVAL {
+		t.Fatalf("Set an unknown flag: %v, not EINVAL", code)
+	}
+	if flags, _ := node.GetXAttr(xattrFlags, ownerCaller); string(flags) != "a" {
+		t.Fatalf("Flags %q, not %q", flags, "a")
+	}
+}
+
+func TestFlagsSurviveRemount(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestVolume(t, dir, nil)
+	setTestFlags(t, writeTestFile(t, fs, "log", []byte("first")), "a")
+	setTestFlags(t, writeTestFile(t, fs, "fixed", []byte("fixed")), "ai")
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs = openTestVolume(t, dir, nil)
+	defer fs.Close()
+	for name, want := range map[string]string{"log": "a", "fixed": "ai"} {
+		node := fs.Root().Inode().GetChild(name).Node().(*AppendFSNode)
+		if flags, _ := node.GetXAttr(xattrFlags, rootCaller); string(flags) != want {
+			t.Fatalf("Flags of %s %q after remounting, not %q", name, flags, want)
+		}
+		if code := fs.Root().Unlink(name, rootCaller); code != fuse.EPERM {
+			t.Fatalf("Unlink %s after remounting: %v, not EPERM", name, code)
+		}
+	}
+	node := fs.Root().Inode().GetChild("log").Node().(*AppendFSNode)
+	if code := node.Truncate(nil, 0, rootCaller); code != fuse.EPERM {
+		t.Fatalf("Truncate after remounting: %v, not EPERM", code)
+	}
+}
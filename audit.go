@@ -0,0 +1,273 @@
+package appendfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/golang/protobuf/proto"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// With an audit log, every operation that changes the filesystem is
+// recorded, whether it succeeded or not, with who asked for it. The log is
+// a file of its own, written like the metadata file: AuditRecords preceded
+// by their length, sealed if the volume is encrypted.
+
+const (
+	auditCreate = "create"
+	auditMkdir = "mkdir"
+	auditMknod = "mknod"
+	auditSymlink = "symlink"
+	auditWrite = "write"
+	auditTruncate = "truncate"
+	auditRename = "rename"
+	auditUnlink = "unlink"
+	auditRmdir = "rmdir"
+	auditChmod = "chmod"
+	auditChown = "chown"
+	auditSetXAttr = "setxattr"
+	auditRemoveXAttr = "removexattr"
+)
+
+type auditLog struct {
+	mutex sync.Mutex
+	file *os.File
+	offset int64
+}
+
+func (fs *AppendFS) openAuditLog(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fs.auditLog = &auditLog{file: file, offset: info.Size()}
+	return nil
+}
+
+// path returns where node is in the volume, as far as it can be followed
+// from the live nodes.
+func (node *AppendFSNode) path() string {
+	names := make([]string, 0)
+	for node != nil && node.nodeId != node.fs.root.nodeId {
+		node.metadataMutex.RLock()
+		name, parentId := node.name, node.parentNodeId
+		node.metadataMutex.RUnlock()
+		names = append([]string{name}, names...)
+		node = node.fs.Node(parentId)
+	}
+	if node == nil {
+		names = append([]string{"?"}, names...)
+	}
+	return "/" + strings.Join(names, "/")
+}
+
+// caller returns who an operation on file is for: the FUSE context if
+// there is one, and otherwise whoever opened the file.
+func caller(file nodefs.File, context *fuse.Context) *fuse.Context {
+	if context != nil {
+		return context
+	}
+	if f, ok := file.(*AppendFSFile); ok {
+		return &f.opener
+	}
+	return nil
+}
+
+// audit records op on name in the directory node, or on node itself if
+// name is empty, once it has finished with *code. It is meant to be
+// deferred.
+func (node *AppendFSNode) audit(code *fuse.Status, context *fuse.Context, op string, name string,
+								format string, args ...interface{}) {
+	log := node.fs.auditLog
+	if log == nil {
+		return
+	}
+	path := node.path()
+	if name != "" {
+		path = strings.TrimSuffix(path, "/") + "/" + name
+	}
+	record := &messages.AuditRecord{Time: proto.Uint64(uint64(time.Now().UnixNano())),
+									Op: proto.String(op), Path: proto.String(path),
+									Status: proto.Int32(int32(*code))}
+	if format != "" {
+		record.Detail = proto.String(fmt.Sprintf(format, args...))
+	}
+	if context != nil {
+		record.Uid = proto.Uint32(context.Uid)
+		record.Gid = proto.Uint32(context.Gid)
+		record.Pid = proto.Uint32(context.Pid)
+	}
+	err := node.fs.appendAudit(record)
+	if err != nil {
+		fmt.Printf("Audit fail: %v\n", err)
+	}
+}
+
+func (fs *AppendFS) appendAudit(record *messages.AuditRecord) error {
+	data, err := proto.Marshal(record)
+	if err != nil {
+		return err
+	}
+	log := fs.auditLog
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	if fs.encryption != nil {
+		data, err = fs.encryption.seal(data, recordPosition(auditRecord, 0, log.offset))
+		if err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64 + len(data))
+	buf = append(buf[:binary.PutUvarint(buf, uint64(len(data)))], data...)
+	n, err := log.file.Write(buf)
+	log.offset += int64(n)
+	return err
+}
+
+func (fs *AppendFS) syncAudit() error {
+	if fs.auditLog == nil {
+		return nil
+	}
+	fs.auditLog.mutex.Lock()
+	defer fs.auditLog.mutex.Unlock()
+	return fs.auditLog.file.Sync()
+}
+
+func (fs *AppendFS) closeAudit() error {
+	if fs.auditLog == nil {
+		return nil
+	}
+	fs.auditLog.mutex.Lock()
+	defer fs.auditLog.mutex.Unlock()
+	return fs.auditLog.file.Close()
+}
+
+type AuditEntry struct {
+	Time time.Time
+	Op string
+	Path string
+	Detail string
+	// Unknown for operations the kernel didn't say who asked for
+	Known bool
+	Uid uint32
+	Gid uint32
+	Pid uint32
+	Status fuse.Status
+}
+
+func (entry AuditEntry) String() string {
+	who := "unknown"
+	if entry.Known {
+		who = fmt.Sprintf("uid=%d gid=%d pid=%d", entry.Uid, entry.Gid, entry.Pid)
+	}
+	result := "OK"
+	if entry.Status != fuse.OK {
+		result = syscall.Errno(entry.Status).Error()
+	}
+	line := fmt.Sprintf("%s %s %s %s", entry.Time.Format(time.RFC3339Nano), who, entry.Op, entry.Path)
+	if entry.Detail != "" {
+		line += " " + entry.Detail
+	}
+	return line + ": " + result
+}
+
+// AuditQuery selects entries of the audit log. Zero values match
+// everything, except that Uid must be -1 to match any user.
+type AuditQuery struct {
+	// Entries for this path or anything below it
+	Path string
+	Uid int64
+	Since time.Time
+	Until time.Time
+}
+
+func underPath(path string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix + "/")
+}
+
+func (query AuditQuery) matches(entry AuditEntry) bool {
+	if query.Path != "" && !underPath(entry.Path, query.Path) &&
+			!(entry.Op == auditRename && underPath(entry.Detail, query.Path)) {
+		return false
+	}
+	if query.Uid >= 0 && (!entry.Known || int64(entry.Uid) != query.Uid) {
+		return false
+	}
+	if !query.Since.IsZero() && entry.Time.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && entry.Time.After(query.Until) {
+		return false
+	}
+	return true
+}
+
+// QueryAuditLog calls fn with every entry of the audit log at path that
+// query matches, oldest first. encryptionKey is needed for encrypted
+// volumes.
+func QueryAuditLog(path string, encryptionKey []byte, query AuditQuery, fn func(AuditEntry)) error {
+	var enc *encryption
+	if encryptionKey != nil {
+		var err error
+		enc, err = newEncryption(encryptionKey)
+		if err != nil {
+			return err
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		start := offset
+		recordLen, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data := make([]byte, recordLen)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return fmt.Errorf("Corrupt audit log at offset %d: %v", start, err)
+		}
+		offset += int64(uvarintSize(recordLen)) + int64(recordLen)
+		if enc != nil {
+			data, err = enc.open(data, recordPosition(auditRecord, 0, start))
+			if err != nil {
+				return fmt.Errorf("audit record at offset %d: %v", start, err)
+			}
+		}
+		record := &messages.AuditRecord{}
+		err = proto.Unmarshal(data, record)
+		if err != nil {
+			return fmt.Errorf("audit record at offset %d: %v", start, err)
+		}
+		entry := AuditEntry{Time: time.Unix(0, int64(record.GetTime())), Op: record.GetOp(),
+							Path: record.GetPath(), Detail: record.GetDetail(),
+							Known: record.Uid != nil, Uid: record.GetUid(), Gid: record.GetGid(),
+							Pid: record.GetPid(), Status: fuse.Status(record.GetStatus())}
+		if query.matches(entry) {
+			fn(entry)
+		}
+	}
+}
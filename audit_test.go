@@ -0,0 +1,91 @@
+package appendfs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func queryTestAudit(t *testing.T, path string, query AuditQuery) []AuditEntry {
+	entries := make([]AuditEntry, 0)
+	err := QueryAuditLog(path, nil, query, func(entry AuditEntry) {
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		t.Fatalf("QueryAuditLog: %v", err)
+	}
+	return entries
+}
+
+func auditOps(entries []AuditEntry) []string {
+	ops := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ops = append(ops, entry.Op + " " + entry.Path)
+	}
+	return ops
+}
+
+func TestAuditQueries(t *testing.T) {
+	dir := t.TempDir()
+	auditPath := filepath.Join(dir, "audit")
+	options := NewOptions()
+	options.AuditLog = auditPath
+	fs := openTestVolume(t, dir, options)
+	start := time.Now()
+	inode, _ := fs.Root().Mkdir("dir", 0755, rootCaller)
+	subdir := inode.Node().(*AppendFSNode)
+	subdir.Chmod(nil, 0777, rootCaller)
+	file, _, code := subdir.Create("a", uint32(os.O_WRONLY), fuse.S_IFREG | 0644, ownerCaller)
+	if code != fuse.OK {
+		t.Fatalf("Create: %v", code)
+	}
+	// Attributed to whoever opened the file
+	file.Write([]byte("hello"), 0)
+	file.Flush()
+	file.Release()
+	subdir.Rename("a", fs.Root(), "moved", rootCaller)
+	if code = fs.Root().Unlink("moved", otherCaller); code != fuse.EACCES {
+		t.Fatalf("Unlink by someone who may not: %v, not EACCES", code)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	all := queryTestAudit(t, auditPath, AuditQuery{Uid: -1})
+	want := []string{"mkdir /dir", "chmod /dir", "create /dir/a", "write /dir/a", "rename /dir/a", "unlink /moved"}
+	if got := auditOps(all); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Audit log holds %v, not %v", got, want)
+	}
+	if all[4].Detail != "/moved" {
+		t.Errorf("Rename went to %q, not /moved", all[4].Detail)
+	}
+	unlink := all[5]
+	if unlink.Status != fuse.EACCES || !unlink.Known || unlink.Uid != otherCaller.Uid {
+		t.Errorf("Failed unlink recorded as %v", unlink)
+	}
+	if all[0].Time.Before(start) || all[5].Time.Before(all[0].Time) {
+		t.Errorf("Entries are timed %v to %v, for operations from %v", all[0].Time, all[5].Time, start)
+	}
+
+	queries := []struct {
+		query AuditQuery
+		ops []string
+	}{
+		{AuditQuery{Path: "/dir", Uid: -1}, want[:5]},
+		// A rename shows up under both names
+		{AuditQuery{Path: "/moved", Uid: -1}, want[4:]},
+		{AuditQuery{Path: "/di", Uid: -1}, []string{}},
+		{AuditQuery{Uid: int64(ownerCaller.Uid)}, want[2:4]},
+		{AuditQuery{Uid: -1, Since: all[2].Time, Until: all[3].Time}, want[2:4]},
+		{AuditQuery{Uid: -1, Since: time.Now().Add(time.Hour)}, []string{}},
+	}
+	for _, q := range queries {
+		if got := auditOps(queryTestAudit(t, auditPath, q.query)); !reflect.DeepEqual(got, q.ops) {
+			t.Errorf("Query %+v found %v, not %v", q.query, got, q.ops)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package appendfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Both logs only ever grow, so a backup is just what was appended to each
+// since the last one. A bundle is a tar file: first manifest.json, then a
+// file for every log the backup has bytes of. The manifest says where each
+// log's bytes start and end, with their sha256, and also holds the sha256
+// of the metadata file where the bundle starts (its base) and ends (its
+// head). A bundle's base is the previous bundle's head, so restoring
+// checks that the bundles form an unbroken chain, and that the first of
+// them carries on from whatever is already there, before writing anything.
+//
+// As with replication, bundles only hold whole metadata records, and only
+// ones whose data is in the bundle too. Keys are not backed up, but the
+// salt of a volume encrypted with a passphrase is, in the manifest, as
+// without it the passphrase can't open the volume.
+
+const (
+	bundleVersion = 1
+	manifestName = "manifest.json"
+)
+
+// BundleLog is the bytes of a log from From up to To.
+type BundleLog struct {
+	Metadata bool `json:"metadata,omitempty"`
+	Segment uint64 `json:"segment"`
+	From int64 `json:"from"`
+	To int64 `json:"to"`
+	Sha256 string `json:"sha256"`
+}
+
+func (log BundleLog) ReplicaLog() ReplicaLog {
+	return ReplicaLog{Metadata: log.Metadata, Segment: log.Segment}
+}
+
+// name is what the log's bytes are called in the bundle.
+func (log BundleLog) name() string {
+	if log.Metadata {
+		return "metadata"
+	}
+	return fmt.Sprintf("data.%06d", log.Segment)
+}
+
+type BundleManifest struct {
+	Version int `json:"version"`
+	Created time.Time `json:"created"`
+	// sha256 of the metadata file up to the start and the end of the bundle
+	Base string `json:"base"`
+	Head string `json:"head"`
+	// Every log there was, including those the bundle has no bytes of
+	Logs []BundleLog `json:"logs"`
+	// Hex of the passphrase salt, if the volume has one
+	Salt string `json:"salt,omitempty"`
+}
+
+// Positions returns how long each log was when the bundle was made.
+func (manifest *BundleManifest) Positions() Positions {
+	positions := make(Positions)
+	for _, log := range manifest.Logs {
+		positions[log.ReplicaLog()] = log.To
+	}
+	return positions
+}
+
+func hexDigest(path string, length int64) (string, error) {
+	if length == 0 {
+		return hex.EncodeToString(sha256.New().Sum(nil)), nil
+	}
+	digest, err := digestFile(path, length)
+	return hex.EncodeToString(digest), err
+}
+
+// WriteBackup writes a bundle of what has been appended to the volume
+// since the bundle whose manifest is since, or of everything if it is
+// nil, to w. cold is the volume's cold store, if it has one.
+func WriteBackup(dataFilePath string, metadataFilePath string, cold ObjectStore, since *BundleManifest, w io.Writer) (*BundleManifest, error) {
+	logs, err := openVolumeLogs(dataFilePath, metadataFilePath, cold)
+	if err != nil {
+		return nil, err
+	}
+	start := make(Positions)
+	if since != nil {
+		start = since.Positions()
+	}
+	metadata := ReplicaLog{Metadata: true}
+	metadataEnd, err := recordsEnd(metadataFilePath, start[metadata])
+	if err != nil {
+		return nil, err
+	}
+	// Taken after the records to back up are known, so their data is in
+	positions, err := logs.positions()
+	if err != nil {
+		return nil, err
+	}
+	positions[metadata] = metadataEnd
+	manifest := &BundleManifest{Version: bundleVersion, Created: time.Now().UTC()}
+	manifest.Base, err = hexDigest(metadataFilePath, start[metadata])
+	if err != nil {
+		return nil, err
+	}
+	if since != nil && manifest.Base != since.Head {
+		return nil, errors.New("the metadata file is not the one the previous backup was of")
+	}
+	manifest.Head, err = hexDigest(metadataFilePath, metadataEnd)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := os.ReadFile(SaltPath(metadataFilePath))
+	if err == nil {
+		manifest.Salt = hex.EncodeToString(salt)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for log, end := range positions {
+		if end < start[log] {
+			return nil, fmt.Errorf("%v is shorter than when it was last backed up", log)
+		}
+		manifest.Logs = append(manifest.Logs, BundleLog{Metadata: log.Metadata, Segment: log.Segment,
+														From: start[log], To: end})
+	}
+	// Data before metadata, so a restore cut short never has records
+	// without their data
+	sort.Slice(manifest.Logs, func(i, j int) bool {
+		a, b := manifest.Logs[i], manifest.Logs[j]
+		return !a.Metadata && (b.Metadata || a.Segment < b.Segment)
+	})
+	for i := range manifest.Logs {
+		log := &manifest.Logs[i]
+		digest, err := logs.digest(log.ReplicaLog(), log.From, log.To)
+		if err != nil {
+			return nil, err
+		}
+		log.Sha256 = hex.EncodeToString(digest)
+	}
+	out := tar.NewWriter(w)
+	encoded, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	err = writeTarEntry(out, manifestName, bytes.NewReader(encoded), int64(len(encoded)))
+	if err != nil {
+		return nil, err
+	}
+	for _, log := range manifest.Logs {
+		if log.From == log.To {
+			continue
+		}
+		file, err := logs.open(log.ReplicaLog())
+		if err != nil {
+			return nil, err
+		}
+		err = writeTarEntry(out, log.name(), io.NewSectionReader(file, log.From, log.To - log.From), log.To - log.From)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifest, out.Close()
+}
+
+func writeTarEntry(out *tar.Writer, name string, r io.Reader, size int64) error {
+	err := out.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	return err
+}
+
+// readBundle reads the manifest of the bundle at path, and calls fn, if
+// set, with each log the bundle has bytes of and a reader of them. It
+// fails if the bytes of any log do not match the manifest.
+func readBundle(path string, fn func(log BundleLog, r io.Reader) error) (*BundleManifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	in := tar.NewReader(file)
+	header, err := in.Next()
+	if err != nil || header.Name != manifestName {
+		return nil, fmt.Errorf("%s is not a backup bundle", path)
+	}
+	manifest := &BundleManifest{}
+	err = json.NewDecoder(in).Decode(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("%s: manifest: %v", path, err)
+	}
+	if manifest.Version != bundleVersion {
+		return nil, fmt.Errorf("%s: unknown bundle version %d", path, manifest.Version)
+	}
+	logs := make(map[string]BundleLog)
+	for _, log := range manifest.Logs {
+		if log.From < log.To {
+			logs[log.name()] = log
+		}
+	}
+	for {
+		header, err = in.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		log, ok := logs[header.Name]
+		if !ok || header.Size != log.To - log.From {
+			return nil, fmt.Errorf("%s: unexpected %s", path, header.Name)
+		}
+		delete(logs, header.Name)
+		hash := sha256.New()
+		r := io.TeeReader(in, hash)
+		if fn != nil {
+			err = fn(log, r)
+		} else {
+			_, err = io.Copy(ioutil.Discard, r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, header.Name, err)
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != log.Sha256 {
+			return nil, fmt.Errorf("%s: %s does not match its checksum", path, header.Name)
+		}
+	}
+	for name := range logs {
+		return nil, fmt.Errorf("%s: %s is missing", path, name)
+	}
+	return manifest, nil
+}
+
+// ReadBundleManifest checks the bundle at path and returns its manifest.
+func ReadBundleManifest(path string) (*BundleManifest, error) {
+	return readBundle(path, nil)
+}
+
+// Restore appends the bundles, in order, to the volume, which must not be
+// mounted. It checks all of them first, and refuses to restore any if a
+// bundle is damaged or doesn't start where the volume, with the bundles
+// before it, ends.
+func Restore(dataFilePath string, metadataFilePath string, bundles []string) error {
+	logs, err := openVolumeLogs(dataFilePath, metadataFilePath, nil)
+	if err != nil {
+		return err
+	}
+	positions, err := logs.positions()
+	if err != nil {
+		return err
+	}
+	metadata := ReplicaLog{Metadata: true}
+	head, err := hexDigest(metadataFilePath, positions[metadata])
+	if err != nil {
+		return err
+	}
+	var salt []byte
+	have, err := os.ReadFile(SaltPath(metadataFilePath))
+	if err == nil {
+		salt = have
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, bundle := range bundles {
+		manifest, err := ReadBundleManifest(bundle)
+		if err != nil {
+			return err
+		}
+		for _, log := range manifest.Logs {
+			have := positions[log.ReplicaLog()]
+			if log.From > have {
+				return fmt.Errorf("%s starts %v at %d, leaving a gap after %d", bundle, log.ReplicaLog(), log.From, have)
+			}
+			if log.From < have {
+				return fmt.Errorf("%s starts %v at %d, but there are already %d bytes", bundle, log.ReplicaLog(), log.From, have)
+			}
+			positions[log.ReplicaLog()] = log.To
+		}
+		if manifest.Base != head {
+			return fmt.Errorf("%s does not carry on from the metadata file so far", bundle)
+		}
+		head = manifest.Head
+		if manifest.Salt != "" {
+			bundleSalt, err := hex.DecodeString(manifest.Salt)
+			if err != nil {
+				return fmt.Errorf("%s: salt: %v", bundle, err)
+			}
+			if salt != nil && !bytes.Equal(salt, bundleSalt) {
+				return fmt.Errorf("%s is of a volume with another salt", bundle)
+			}
+			salt = bundleSalt
+		}
+	}
+	if salt != nil {
+		err = os.MkdirAll(filepath.Dir(metadataFilePath), 0755)
+		if err == nil {
+			err = keepSalt(SaltPath(metadataFilePath), salt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, bundle := range bundles {
+		_, err := readBundle(bundle, func(log BundleLog, r io.Reader) error {
+			path := metadataFilePath
+			if !log.Metadata {
+				path = segmentFile(dataFilePath, log.Segment)
+			}
+			return appendFrom(path, log.From, r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendFrom appends what r holds to the file at path, which must be
+// offset bytes long.
+func appendFrom(path string, offset int64, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() != offset {
+		err = fmt.Errorf("%s is %d bytes long, not %d", path, info.Size(), offset)
+	}
+	if err == nil {
+		_, err = io.Copy(file, r)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package appendfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestBundle backs up the volume in dir since the bundle since, if
+// any, to a new bundle in bundles.
+func writeTestBundle(t *testing.T, dir string, since string, bundles string, name string) string {
+	var manifest *BundleManifest
+	if since != "" {
+		var err error
+		manifest, err = ReadBundleManifest(since)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(bundles, name)
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	_, err = WriteBackup(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), nil, manifest, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRestore(t *testing.T) {
+	dir, bundles := t.TempDir(), t.TempDir()
+	salt := []byte("the salt of the passphrase")
+	if err := os.WriteFile(SaltPath(filepath.Join(dir, "metadata")), salt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs := openTestVolume(t, dir, nil)
+	writeTestFile(t, fs, "first", []byte("first write"))
+	first := writeTestBundle(t, dir, "", bundles, "first")
+	writeTestFile(t, fs, "second", []byte("second write"))
+	second := writeTestBundle(t, dir, first, bundles, "second")
+	writeTestFile(t, fs, "third", []byte("third write"))
+	third := writeTestBundle(t, dir, second, bundles, "third")
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := filepath.Join(bundles, "tampered")
+	err = os.WriteFile(tampered, bytes.Replace(stored, []byte("second write"), []byte("Second write"), 1), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		// Already in the volume restored to
+		salt []byte
+		bundles []string
+		err string
+	}{
+		{"chain", nil, []string{first, second, third}, ""},
+		{"gapped chain", nil, []string{first, third}, "gap"},
+		{"out of order chain", nil, []string{second, first, third}, "gap"},
+		{"repeated bundle", nil, []string{first, first}, "already"},
+		{"tampered bundle", nil, []string{first, tampered, third}, "checksum"},
+		{"another salt", []byte("another salt"), []string{first, second, third}, "another salt"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			restored := t.TempDir()
+			saltPath := SaltPath(filepath.Join(restored, "metadata"))
+			if test.salt != nil {
+				if err := os.WriteFile(saltPath, test.salt, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := Restore(filepath.Join(restored, "data"), filepath.Join(restored, "metadata"), test.bundles)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Restore returned %v, not an error saying %q", err, test.err)
+				}
+				// Nothing but the salt the volume already had
+				want := 0
+				if test.salt != nil {
+					want = 1
+				}
+				if entries, _ := os.ReadDir(restored); len(entries) != want {
+					t.Fatalf("Restore wrote %d files before refusing", len(entries) - want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Restore: %v", err)
+			}
+			if got, err := os.ReadFile(saltPath); err != nil || !bytes.Equal(got, salt) {
+				t.Fatalf("Restored salt %q (%v), not %q", got, err, salt)
+			}
+			fs := openTestVolume(t, restored, nil)
+			defer fs.Close()
+			for name, contents := range map[string]string{"first": "first write", "second": "second write", "third": "third write"} {
+				if got := string(readTestFile(t, fs, name, len(contents))); got != contents {
+					t.Fatalf("Read %q from %s, not %q", got, name, contents)
+				}
+			}
+		})
+	}
+}
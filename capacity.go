@@ -0,0 +1,84 @@
+package appendfs
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"sync/atomic"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// With a capacity set, data may only fill the volume up to a reserve kept
+// for metadata, so that once it is full files can still be unlinked and
+// compaction can still record the FileMaps it needs to. Getting close to
+// the limit starts a compaction in the background.
+
+var errNoSpace = errors.New("volume is full")
+
+// Fraction of the capacity only metadata may use
+const reserveShare = 32
+
+// Fraction of the capacity that, when all that is left, triggers compaction
+const compactShare = 10
+
+// checkSpace returns errNoSpace if the volume has no room for bytes more
+// data, or for bytes more metadata if isMetadata is set.
+func (fs *AppendFS) checkSpace(bytes int, isMetadata bool) error {
+	if fs.capacityLimit <= 0 {
+		return nil
+	}
+	data, metadata := fs.volumeBytes()
+	used := data + metadata + int64(bytes)
+	limit := fs.capacityLimit
+	if !isMetadata {
+		limit -= fs.capacityLimit / reserveShare
+	}
+	if used > limit - fs.capacityLimit / compactShare {
+		fs.compactSoon()
+	}
+	if used > limit {
+		return errNoSpace
+	}
+	return nil
+}
+
+// compactSoon starts a compaction unless one is already running. Only
+// sealed segments can be deleted, and compacting records every FileMap, so
+// nothing is done until a segment has been sealed since the last one.
+func (fs *AppendFS) compactSoon() {
+	fs.dataMutex.RLock()
+	current := fs.dataSegment
+	fs.dataMutex.RUnlock()
+	if !atomic.CompareAndSwapInt32(&fs.compacting, 0, 1) {
+		return
+	}
+	if fs.compactedBelow == current + 1 {
+		atomic.StoreInt32(&fs.compacting, 0)
+		return
+	}
+	fs.compactedBelow = current + 1
+	fs.compactions.Add(1)
+	go func() {
+		defer fs.compactions.Done()
+		removed, err := fs.Compact()
+		if err != nil {
+			fmt.Printf("Compaction fail: %v\n", err)
+		} else if len(removed) > 0 {
+			fmt.Printf("Removed %d data segments\n", len(removed))
+		}
+		atomic.StoreInt32(&fs.compacting, 0)
+	}()
+}
+
+// errorStatus turns an error from storing data or metadata into the status
+// to return, telling a full volume or disk apart from other failures.
+func errorStatus(err error) fuse.Status {
+	if errors.Is(err, errNoSpace) || errors.Is(err, syscall.ENOSPC) {
+		return fuse.Status(syscall.ENOSPC)
+	}
+	if errors.Is(err, errReadOnly) {
+		return fuse.Status(syscall.EROFS)
+	}
+	return fuse.EIO
+}
@@ -0,0 +1,98 @@
+package appendfs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func capacityTestVolume(t *testing.T, dir string, capacity int64) *AppendFS {
+	options := NewOptions()
+	options.Capacity = capacity
+	options.SegmentSize = 4096
+	return openTestVolume(t, dir, options)
+}
+
+// fillTestFile writes name 4096 bytes at a time until it holds size bytes
+// or a write fails, and returns how much was written and why it stopped.
+func fillTestFile(t *testing.T, fs *AppendFS, name string, size int) (int, fuse.Status) {
+	file, _, code := fs.Root().Create(name, uint32(os.O_WRONLY), fuse.S_IFREG | 0644, rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Create %s: %v", name, code)
+	}
+	defer file.Release()
+	written := 0
+	for written < size {
+		if _, code = file.Write(make([]byte, 4096), int64(written)); code != fuse.OK {
+			break
+		}
+		written += 4096
+	}
+	if flushed := file.Flush(); flushed != fuse.OK {
+		t.Fatalf("Flush %s: %v", name, flushed)
+	}
+	return written, code
+}
+
+func TestCapacityLimit(t *testing.T) {
+	fs := capacityTestVolume(t, t.TempDir(), 64 << 10)
+	defer fs.Close()
+	written, code := fillTestFile(t, fs, "full", 64 << 10)
+	if code != fuse.Status(syscall.ENOSPC) {
+		t.Fatalf("Filling the volume stopped with %v after %d bytes, not ENOSPC", code, written)
+	}
+	fs.compactions.Wait()
+	data, metadata := fs.volumeBytes()
+	if data + metadata > 64 << 10 - 64 << 10 / reserveShare {
+		t.Fatalf("Data went into the metadata reserve: %d + %d bytes used", data, metadata)
+	}
+	if _, code = fillTestFile(t, fs, "more", 4 << 10); code != fuse.Status(syscall.ENOSPC) {
+		t.Fatalf("Write to another file on a full volume: %v, not ENOSPC", code)
+	}
+	// The reserve leaves room to delete and compact
+	if code = fs.Root().Unlink("full", rootCaller); code != fuse.OK {
+		t.Fatalf("Unlink on a full volume: %v", code)
+	}
+	removed, err := fs.Compact()
+	if err != nil {
+		t.Fatalf("Compact on a full volume: %v", err)
+	}
+	if len(removed) == 0 {
+		t.Fatal("Compact removed nothing")
+	}
+	if _, code = fillTestFile(t, fs, "again", 4 << 10); code != fuse.OK {
+		t.Fatalf("Write after compacting: %v", code)
+	}
+}
+
+func TestCompactionWhenNearlyFull(t *testing.T) {
+	dir := t.TempDir()
+	fs := capacityTestVolume(t, dir, 128 << 10)
+	defer fs.Close()
+	if _, code := fillTestFile(t, fs, "garbage", 48 << 10); code != fuse.OK {
+		t.Fatalf("Write garbage: %v", code)
+	}
+	if code := fs.Root().Unlink("garbage", rootCaller); code != fuse.OK {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if _, err := os.Stat(fs.segmentPath(0)); err != nil {
+		t.Fatalf("Compacted too early: %v", err)
+	}
+	// Within compactShare of the limit, but short of it
+	if _, code := fillTestFile(t, fs, "live", 64 << 10); code != fuse.OK {
+		t.Fatalf("Write: %v", code)
+	}
+	fs.compactions.Wait()
+	if _, err := os.Stat(fs.segmentPath(0)); !os.IsNotExist(err) {
+		t.Fatalf("Segment 0 wasn't compacted away: %v", err)
+	}
+	data, _ := fs.volumeBytes()
+	if data > 64 << 10 + 4096 {
+		t.Fatalf("%d bytes of data left after compacting", data)
+	}
+	if got := readTestFile(t, fs, "live", 64 << 10); len(got) != 64 << 10 {
+		t.Fatalf("Read %d bytes", len(got))
+	}
+}
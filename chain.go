@@ -0,0 +1,286 @@
+package appendfs
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/golang/protobuf/proto"
+)
+
+// Every metadata record carries the hash of the metadata file before it,
+// so editing or removing a record breaks the chain at every record after
+// it. Cutting records off the end leaves a valid chain, which is what
+// checkpoints are for: with a signing key, the offset and hash of the file
+// are signed every checkpointInterval and on close, both as a volume
+// record and in a checkpoint file next to the metadata file that a
+// truncated log can be checked against.
+//
+// The hash covers records as they are on disk, sealed if the volume is
+// encrypted.
+
+// Size of the chain field in a marshalled NodeMetadata
+const chainFieldSize = 2 + 1 + sha256.Size
+
+var errBrokenChain = errors.New("metadata record does not chain to the one before it")
+
+// chainNext returns the hash of the metadata file once record is appended
+// to a file that hashed to prev.
+func chainNext(prev []byte, record []byte) []byte {
+	hash := sha256.New()
+	hash.Write(prev)
+	hash.Write(record)
+	return hash.Sum(nil)
+}
+
+// Hash of an empty metadata file
+func chainStart() []byte {
+	return make([]byte, sha256.Size)
+}
+
+func (fs *AppendFS) checkpointPath() string {
+	return fs.metadataFilePath + ".checkpoint"
+}
+
+// checkpointMessage is what a checkpoint's signature covers.
+func checkpointMessage(checkpoint *messages.Checkpoint) []byte {
+	msg := make([]byte, 0, 64)
+	msg = append(msg, "appendfs checkpoint\x00"...)
+	msg = binary.BigEndian.AppendUint64(msg, checkpoint.GetOffset())
+	msg = append(msg, checkpoint.GetHash()...)
+	return binary.BigEndian.AppendUint64(msg, checkpoint.GetTime())
+}
+
+func (fs *AppendFS) checkpointDue() bool {
+	return fs.signingKey != nil && time.Since(fs.lastCheckpoint) >= fs.checkpointInterval
+}
+
+// appendCheckpoint signs the metadata file as it is now and records the
+// checkpoint. The caller must hold metadataMutex.
+func (fs *AppendFS) appendCheckpoint() error {
+	now := time.Now()
+	checkpoint := &messages.Checkpoint{Offset:proto.Uint64(uint64(fs.metadataFileOffset)),
+									Hash:fs.chainHash, Time:proto.Uint64(uint64(now.Unix()))}
+	checkpoint.Signature = ed25519.Sign(fs.signingKey, checkpointMessage(checkpoint))
+	err := fs.appendRecord(&messages.NodeMetadata{NodeId:proto.Uint64(volumeRecordId),
+									Checkpoint:checkpoint})
+	if err != nil {
+		return err
+	}
+	fs.lastCheckpoint = now
+	if fs.syncPolicy != SyncUnsafe {
+		// The checkpoint file must never get ahead of the log on disk
+		err = syncFile(fs.metadataFile)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := proto.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmpPath := fs.checkpointPath() + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, fs.checkpointPath())
+}
+
+// Checkpoint signs the metadata file as it is now. It does nothing
+// without a signing key.
+func (fs *AppendFS) Checkpoint() error {
+	if fs.signingKey == nil {
+		return nil
+	}
+	fs.metadataMutex.Lock()
+	err := fs.appendCheckpoint()
+	fs.metadataMutex.Unlock()
+	return err
+}
+
+// LoadSigningKey reads the ed25519 key in path. If there is none, a new
+// one is created, with its public half in path.pub for verifiers.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(path, private.Seed(), 0600)
+		if err != nil {
+			return nil, err
+		}
+		return private, os.WriteFile(path + ".pub", public, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not an ed25519 key", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", path)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+type LogReport struct {
+	Records int
+	// Records from before the chain was introduced, which can only come
+	// first
+	Unchained int
+	Checkpoints int
+	// How much of the log the last checkpoint covers
+	CheckpointOffset int64
+	Length int64
+}
+
+func checkCheckpoint(checkpoint *messages.Checkpoint, publicKey ed25519.PublicKey) error {
+	if publicKey != nil && !ed25519.Verify(publicKey, checkpointMessage(checkpoint), checkpoint.GetSignature()) {
+		return errors.New("checkpoint signature is not valid")
+	}
+	return nil
+}
+
+// VerifyLog checks that the metadata file is a single unbroken chain, that
+// every checkpoint in it matches, and that it still holds everything the
+// checkpoint file says it did. If publicKey is set, signatures are checked,
+// and the checkpoint file and at least one checkpoint in the log are
+// required, since without them a log cut short can't be told apart from
+// one that was never longer. encryptionKey is needed for encrypted
+// volumes.
+func VerifyLog(metadataFilePath string, encryptionKey []byte, publicKey ed25519.PublicKey) (LogReport, error) {
+	var report LogReport
+	var enc *encryption
+	if encryptionKey != nil {
+		var err error
+		enc, err = newEncryption(encryptionKey)
+		if err != nil {
+			return report, err
+		}
+	}
+	var latest *messages.Checkpoint
+	data, err := os.ReadFile(metadataFilePath + ".checkpoint")
+	if err == nil {
+		latest = &messages.Checkpoint{}
+		err = proto.Unmarshal(data, latest)
+		if err == nil {
+			err = checkCheckpoint(latest, publicKey)
+		}
+		if err != nil {
+			return report, fmt.Errorf("checkpoint file: %v", err)
+		}
+	} else if os.IsNotExist(err) && publicKey != nil {
+		return report, errors.New("there is no checkpoint file, so the log can't be checked for truncation")
+	} else if !os.IsNotExist(err) {
+		return report, err
+	}
+	file, err := os.Open(metadataFilePath)
+	if err != nil {
+		return report, err
+	}
+	defer file.Close()
+	reader := newMetadataReader(file, 0, enc)
+	latestSeen := latest == nil
+	for {
+		prev := reader.hash
+		if latest != nil && reader.offset == int64(latest.GetOffset()) {
+			if !bytes.Equal(prev, latest.GetHash()) {
+				return report, fmt.Errorf("log at offset %d does not match the checkpoint file", reader.offset)
+			}
+		}
+		metadata, start, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("record at offset %d: %v", start, err)
+		}
+		report.Records += 1
+		if metadata.Chain == nil {
+			if report.Records > report.Unchained + 1 {
+				return report, fmt.Errorf("record at offset %d: %v", start, errBrokenChain)
+			}
+			report.Unchained += 1
+		} else if !bytes.Equal(metadata.Chain, prev) {
+			return report, fmt.Errorf("record at offset %d: %v", start, errBrokenChain)
+		}
+		if checkpoint := metadata.GetCheckpoint(); checkpoint != nil {
+			if int64(checkpoint.GetOffset()) != start || !bytes.Equal(checkpoint.GetHash(), prev) {
+				return report, fmt.Errorf("checkpoint at offset %d does not match the log", start)
+			}
+			err = checkCheckpoint(checkpoint, publicKey)
+			if err != nil {
+				return report, fmt.Errorf("checkpoint at offset %d: %v", start, err)
+			}
+			report.Checkpoints += 1
+			report.CheckpointOffset = start
+			// The record itself has to be there too, or cutting off just
+			// the last checkpoint would go unnoticed
+			if latest != nil && start == int64(latest.GetOffset()) {
+				latestSeen = true
+			}
+		}
+	}
+	report.Length = reader.offset
+	if !latestSeen {
+		return report, fmt.Errorf("log was truncated: it has %d bytes but was checkpointed at %d, and that checkpoint is gone",
+			reader.offset, latest.GetOffset())
+	}
+	if publicKey != nil && report.Checkpoints == 0 {
+		return report, errors.New("the log has no signed checkpoint")
+	}
+	return report, nil
+}
+
+// VerifyExtents checks every extent stored with a checksum against it and
+// returns how many it checked. Extents from before checksums were enabled
+// are skipped.
+func (fs *AppendFS) VerifyExtents() (int, error) {
+	type blobKey struct {
+		segment uint64
+		pos int
+	}
+	segments := fs.newSegmentReader()
+	checked := make(map[blobKey]bool)
+	var ret error
+	fs.walkNodes(func(node *AppendFSNode) {
+		node.metadataMutex.RLock()
+		for _, entry := range node.contentRanges.InRange(0, int(node.attr.Size)) {
+			fse, ok := entry.Data.(fileSegmentEntry)
+			key := blobKey{fse.segment, fse.base + fse.origin}
+			if !ok || fse.checksum == "" || checked[key] {
+				continue
+			}
+			checked[key] = true
+			_, err := fs.readBlob(segments, fse, entry.Max + 1 - fse.origin)
+			if err != nil && ret == nil {
+				ret = fmt.Errorf("node %d at offset %d: %v", node.nodeId, entry.Min, err)
+			}
+		}
+		node.metadataMutex.RUnlock()
+	})
+	err := segments.Close()
+	if ret == nil {
+		ret = err
+	}
+	return len(checked), ret
+}
@@ -0,0 +1,119 @@
+package appendfs
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// signedTestVolume writes a volume signed with a new key, checkpointed
+// after its first file and on close, and returns the public key.
+func signedTestVolume(t *testing.T, dir string) ed25519.PublicKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := NewOptions()
+	options.SigningKey = private
+	fs := openTestVolume(t, dir, options)
+	writeTestFile(t, fs, "first", []byte("checkpointed"))
+	if err = fs.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, fs, "second", []byte("checkpointed on close"))
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return public
+}
+
+// recordOffsets returns where each record of the metadata file starts.
+func recordOffsets(t *testing.T, path string) []int64 {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader := newMetadataReader(file, 0, nil)
+	offsets := make([]int64, 0)
+	for {
+		_, start, err := reader.Next()
+		if err != nil {
+			return offsets
+		}
+		offsets = append(offsets, start)
+	}
+}
+
+func TestVerifyLog(t *testing.T) {
+	tests := []struct {
+		name string
+		// Changes the volume, and returns the key to verify with
+		tamper func(t *testing.T, metadata string, public ed25519.PublicKey) ed25519.PublicKey
+		err string
+	}{
+		{"intact", func(t *testing.T, metadata string, public ed25519.PublicKey) ed25519.PublicKey {
+			return public
+		}, ""},
+		{"edited record", func(t *testing.T, metadata string, public ed25519.PublicKey) ed25519.PublicKey {
+			data, err := os.ReadFile(metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			edited := bytes.Replace(data, []byte("first"), []byte("First"), 1)
+			if bytes.Equal(edited, data) {
+				t.Fatal("Nothing to edit")
+			}
+			if err = os.WriteFile(metadata, edited, 0666); err != nil {
+				t.Fatal(err)
+			}
+			return public
+		}, errBrokenChain.Error()},
+		{"truncated", func(t *testing.T, metadata string, public ed25519.PublicKey) ed25519.PublicKey {
+			offsets := recordOffsets(t, metadata)
+			if err := os.Truncate(metadata, offsets[len(offsets) - 1]); err != nil {
+				t.Fatal(err)
+			}
+			return public
+		}, "truncated"},
+		{"truncated before the first checkpoint without the checkpoint file",
+			func(t *testing.T, metadata string, public ed25519.PublicKey) ed25519.PublicKey {
+			if err := os.Truncate(metadata, recordOffsets(t, metadata)[1]); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(metadata + ".checkpoint"); err != nil {
+				t.Fatal(err)
+			}
+			return public
+		}, "no checkpoint file"},
+		{"bad signature", func(t *testing.T, metadata string, public ed25519.PublicKey) ed25519.PublicKey {
+			other, _, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return other
+		}, "signature is not valid"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			metadata := filepath.Join(dir, "metadata")
+			public := test.tamper(t, metadata, signedTestVolume(t, dir))
+			report, err := VerifyLog(metadata, nil, public)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("VerifyLog: %v", err)
+				}
+				if report.Checkpoints != 2 {
+					t.Fatalf("VerifyLog found %d checkpoints, not 2", report.Checkpoints)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("VerifyLog returned %v, not an error saying %q", err, test.err)
+			}
+		})
+	}
+}
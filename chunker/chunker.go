@@ -0,0 +1,65 @@
+package chunker
+
+// Content-defined chunking with a gear rolling hash: a chunk ends where
+// the hash of the bytes before it matches a mask, so inserting or removing
+// data only changes the chunks around the edit.
+
+var gear [256]uint64
+
+func init() {
+	// Any fixed table of random-looking values will do, but it must never
+	// change or previously stored chunks stop matching.
+	state := uint64(0x9e3779b97f4a7c15)
+	for i := range gear {
+		state ^= state << 13
+		state ^= state >> 7
+		state ^= state << 17
+		gear[i] = state
+	}
+}
+
+type Chunker struct {
+	Min int
+	Max int
+	mask uint64
+}
+
+// New returns a Chunker whose chunks are between min and max bytes long
+// and average roughly avg bytes, which is rounded down to a power of two.
+func New(min int, avg int, max int) *Chunker {
+	bits := uint(0)
+	for (1 << (bits + 1)) <= avg {
+		bits++
+	}
+	return &Chunker{Min: min, Max: max, mask: (uint64(1) << bits) - 1}
+}
+
+// Next returns the length of the chunk at the start of data.
+func (c *Chunker) Next(data []byte) int {
+	if len(data) <= c.Min {
+		return len(data)
+	}
+	end := len(data)
+	if end > c.Max {
+		end = c.Max
+	}
+	hash := uint64(0)
+	for i := c.Min; i < end; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash & c.mask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
+
+// Split cuts data into chunks.
+func (c *Chunker) Split(data []byte) [][]byte {
+	chunks := make([][]byte, 0)
+	for len(data) > 0 {
+		n := c.Next(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
@@ -0,0 +1,57 @@
+package chunker
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestSplitCoversInput(t *testing.T) {
+	c := New(512, 2048, 8192)
+	data := randomData(100000)
+	chunks := c.Split(data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatalf("Chunks should concatenate to the input")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > 8192 {
+			t.Fatalf("Chunk %d is %d bytes, over the maximum", i, len(chunk))
+		}
+		if len(chunk) < 512 && i != len(chunks) - 1 {
+			t.Fatalf("Chunk %d is %d bytes, under the minimum", i, len(chunk))
+		}
+	}
+}
+
+func TestSplitEmpty(t *testing.T) {
+	c := New(512, 2048, 8192)
+	if len(c.Split(nil)) != 0 {
+		t.Fatalf("Should have no chunks")
+	}
+}
+
+func TestSplitResynchronises(t *testing.T) {
+	c := New(512, 2048, 8192)
+	data := randomData(100000)
+	shifted := append([]byte("a few extra bytes"), data...)
+	seen := make(map[string]bool)
+	for _, chunk := range c.Split(data) {
+		seen[string(chunk)] = true
+	}
+	shared := 0
+	chunks := c.Split(shifted)
+	for _, chunk := range chunks {
+		if seen[string(chunk)] {
+			shared++
+		}
+	}
+	if shared < len(chunks) - 2 {
+		t.Fatalf("Only %d of %d chunks survived an insert at the start", shared, len(chunks))
+	}
+}
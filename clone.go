@@ -0,0 +1,118 @@
+package appendfs
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/e-tothe-ipi/appendfs/rangelist"
+)
+
+// Lookup finds the node at a slash separated path relative to the root.
+func (fs *AppendFS) Lookup(path string) *AppendFSNode {
+	node := fs.root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		child := node.Inode().GetChild(name)
+		if child == nil {
+			return nil
+		}
+		appendfsChild, ok := child.Node().(*AppendFSNode)
+		if !ok {
+			return nil
+		}
+		node = appendfsChild
+	}
+	return node
+}
+
+// isAncestorOf reports whether node is other or one of its parents.
+func (node *AppendFSNode) isAncestorOf(other *AppendFSNode) bool {
+	for other != nil {
+		if other == node {
+			return true
+		}
+		if other == node.fs.root {
+			return false
+		}
+		other = node.fs.Node(other.parentNodeId)
+	}
+	return false
+}
+
+// CloneTree creates name in parent as a copy-on-write duplicate of src and
+// everything below it. No data is copied: the new files share the extents
+// of the old ones, and only their NodeMetadata is appended.
+func (parent *AppendFSNode) CloneTree(src *AppendFSNode, name string) fuse.Status {
+	if parent.Inode().GetChild(name) != nil {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if src.isAncestorOf(parent) {
+		return fuse.EINVAL
+	}
+	if code := parent.checkFlags(flagImmutable); code != fuse.OK {
+		return code
+	}
+	parent.fs.compactMutex.RLock()
+	defer parent.fs.compactMutex.RUnlock()
+	return parent.cloneChild(src, name)
+}
+
+func (parent *AppendFSNode) cloneChild(src *AppendFSNode, name string) fuse.Status {
+	src.metadataMutex.RLock()
+	code := parent.fs.checkQuota(src.attr.Uid, src.attr.Gid, parent.nodeId, src.attr.Size, 1)
+	src.metadataMutex.RUnlock()
+	if code != fuse.OK {
+		return code
+	}
+	node := CreateNode(parent)
+	node.name = name
+	src.metadataMutex.RLock()
+	node.attr.Mode = src.attr.Mode
+	node.attr.Uid = src.attr.Uid
+	node.attr.Gid = src.attr.Gid
+	node.attr.Atime, node.attr.Mtime = src.attr.Atime, src.attr.Mtime
+	node.chargeNode(0, 1)
+	node.setSize(src.attr.Size)
+	node.symlink = src.symlink
+	for key, value := range src.xattr {
+		node.xattr[key] = value
+	}
+	node.aclAccess, node.aclDefault = src.aclAccess, src.aclDefault
+	for _, entry := range src.contentRanges.InRange(0, int(src.attr.Size)) {
+		node.contentRanges.Overwrite(&rangelist.RangeListEntry{Min:entry.Min,
+				Max:entry.Max, Data:entry.Data})
+	}
+	src.metadataMutex.RUnlock()
+	isDir := node.attr.IsDir()
+	if isDir {
+		node.attr.Nlink = 2
+	}
+	parent.Inode().NewChild(name, isDir, node)
+	parent.incrementLinks()
+
+	metadata := node.AsNodeMetadata()
+	if node.attr.IsRegular() {
+		metadata.Contents = node.fileMap()
+	}
+	err := node.fs.AppendMetadata(metadata)
+	if err != nil {
+		fmt.Println(err)
+		return fuse.EIO
+	}
+
+	if isDir {
+		for childName, child := range src.Inode().FsChildren() {
+			if appendfsChild, ok := child.Node().(*AppendFSNode); ok {
+				code := node.cloneChild(appendfsChild, childName)
+				if code != fuse.OK {
+					return code
+				}
+			}
+		}
+	}
+	return fuse.OK
+}
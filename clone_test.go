@@ -0,0 +1,99 @@
+package appendfs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// writeTestFileIn writes name in the directory parent.
+func writeTestFileIn(t *testing.T, parent *AppendFSNode, name string, data string) {
+	file, _, code := parent.Create(name, uint32(os.O_WRONLY), fuse.S_IFREG | 0644, rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Create %s: %v", name, code)
+	}
+	if _, code = file.Write([]byte(data), 0); code != fuse.OK {
+		t.Fatalf("Write %s: %v", name, code)
+	}
+	file.Flush()
+	file.Release()
+}
+
+func readTestPath(t *testing.T, fs *AppendFS, path string) string {
+	node := fs.Lookup(path)
+	if node == nil {
+		t.Fatalf("%s is missing", path)
+	}
+	dest := make([]byte, node.attr.Size)
+	result, code := node.Read(nil, dest, 0, rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Read %s: %v", path, code)
+	}
+	out, _ := result.Bytes(dest)
+	return string(out)
+}
+
+func TestCloneTree(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestVolume(t, dir, nil)
+	inode, _ := fs.Root().Mkdir("src", 0755, rootCaller)
+	src := inode.Node().(*AppendFSNode)
+	writeTestFileIn(t, src, "a", "first file")
+	inode, _ = src.Mkdir("sub", 0700, rootCaller)
+	writeTestFileIn(t, inode.Node().(*AppendFSNode), "b", "second file")
+	src.Symlink("link", "a", rootCaller)
+	fs.Lookup("src/a").SetXAttr("user.kept", []byte("yes"), 0, rootCaller)
+	data, _ := fs.volumeBytes()
+
+	if code := fs.Root().CloneTree(src, "copy"); code != fuse.OK {
+		t.Fatalf("CloneTree: %v", code)
+	}
+	if after, _ := fs.volumeBytes(); after != data {
+		t.Fatalf("Cloning wrote %d bytes of data", after - data)
+	}
+	if code := fs.Root().CloneTree(src, "copy"); code != fuse.Status(syscall.EEXIST) {
+		t.Fatalf("CloneTree onto an existing name: %v, not EEXIST", code)
+	}
+	if code := fs.Lookup("src/sub").CloneTree(src, "loop"); code != fuse.EINVAL {
+		t.Fatalf("CloneTree into itself: %v, not EINVAL", code)
+	}
+	// Extended attributes only live in memory, so are only checked here
+	if kept, _ := fs.Lookup("copy/a").GetXAttr("user.kept", rootCaller); string(kept) != "yes" {
+		t.Errorf("copy/a has user.kept %q, not %q", kept, "yes")
+	}
+	// Copy on write: changing the clone leaves the original alone
+	file, code := fs.Lookup("copy/a").Open(uint32(os.O_WRONLY), rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Open: %v", code)
+	}
+	file.Write([]byte("FIRST"), 0)
+	file.Flush()
+	file.Release()
+	if code = fs.Lookup("src/sub").Unlink("b", rootCaller); code != fuse.OK {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = openTestVolume(t, dir, nil)
+	defer fs.Close()
+	files := map[string]string{"src/a": "first file", "copy/a": "FIRST file",
+								"copy/sub/b": "second file"}
+	for path, want := range files {
+		if got := readTestPath(t, fs, path); got != want {
+			t.Errorf("%s holds %q, not %q", path, got, want)
+		}
+	}
+	if fs.Lookup("src/sub/b") != nil {
+		t.Error("src/sub/b came back")
+	}
+	if link, _ := fs.Lookup("copy/link").Readlink(rootCaller); string(link) != "a" {
+		t.Errorf("copy/link points at %q, not %q", link, "a")
+	}
+	if mode := testMode(fs.Lookup("copy/sub")); mode != 0700 {
+		t.Errorf("copy/sub has mode %o, not 700", mode)
+	}
+}
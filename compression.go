@@ -0,0 +1,79 @@
+package appendfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Codec says how an extent is stored in the data log. Compressed extents
+// are always decompressed as a whole, so a write is compressed on its own
+// rather than as part of a stream.
+type Codec uint32
+
+const (
+	CodecNone Codec = iota
+	CodecFlate
+)
+
+func (codec Codec) String() string {
+	switch codec {
+	case CodecNone:
+		return "none"
+	case CodecFlate:
+		return "flate"
+	}
+	return fmt.Sprintf("Codec(%d)", uint32(codec))
+}
+
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "none":
+		return CodecNone, nil
+	case "flate":
+		return CodecFlate, nil
+	}
+	return CodecNone, fmt.Errorf("unknown compression codec %q", name)
+}
+
+func (codec Codec) compress(data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecFlate:
+		var buf bytes.Buffer
+		writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		_, err = writer.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %d", uint32(codec))
+}
+
+// decompress returns the first size bytes that data decompresses to.
+func (codec Codec) decompress(data []byte, size int) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecFlate:
+		reader := flate.NewReader(bytes.NewReader(data))
+		out := make([]byte, size)
+		_, err := io.ReadFull(reader, out)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		return out, reader.Close()
+	}
+	return nil, fmt.Errorf("unknown compression codec %d", uint32(codec))
+}
@@ -0,0 +1,77 @@
+package appendfs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// readTestRange reads size bytes of name from off.
+func readTestRange(t *testing.T, fs *AppendFS, name string, off int64, size int) []byte {
+	child := fs.Root().Inode().GetChild(name)
+	if child == nil {
+		t.Fatalf("%s is missing", name)
+	}
+	dest := make([]byte, size)
+	result, code := child.Node().(*AppendFSNode).Read(nil, dest, off, &fuse.Context{})
+	if code != fuse.OK {
+		t.Fatalf("Read %s at %d: %v", name, off, code)
+	}
+	out, _ := result.Bytes(dest)
+	return out
+}
+
+func compressedTestContents() []byte {
+	return bytes.Repeat([]byte("appendfs compresses every write on its own. "), 1000)
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	options := NewOptions()
+	options.Compression = CodecFlate
+	fs := openTestVolume(t, dir, options)
+	contents := compressedTestContents()
+	writeTestFile(t, fs, "file", contents)
+	// Overwrite the middle, so reads cross from one extent into another
+	file, code := fs.Root().Inode().GetChild("file").Node().Open(uint32(os.O_WRONLY), rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Open: %v", code)
+	}
+	patch := bytes.Repeat([]byte("X"), 5000)
+	if _, code = file.Write(patch, 20000); code != fuse.OK {
+		t.Fatalf("Write: %v", code)
+	}
+	file.Flush()
+	file.Release()
+	copy(contents[20000:], patch)
+	data, _ := fs.volumeBytes()
+	if data >= int64(len(contents)) / 2 {
+		t.Fatalf("%d bytes of data stored for %d bytes written", data, len(contents) + len(patch))
+	}
+	check := func(fs *AppendFS) {
+		if got := readTestFile(t, fs, "file", len(contents)); !bytes.Equal(got, contents) {
+			t.Fatal("Read back something other than what was written")
+		}
+		ranges := []struct {
+			off int64
+			size int
+		}{{1, 10}, {19990, 20}, {24990, 20}, {19000, 7000}, {int64(len(contents)) - 5, 5}}
+		for _, r := range ranges {
+			got := readTestRange(t, fs, "file", r.off, r.size)
+			if !bytes.Equal(got, contents[r.off:r.off + int64(r.size)]) {
+				t.Fatalf("Read %d bytes at %d: %q", r.size, r.off, got)
+			}
+		}
+	}
+	check(fs)
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The codec is recorded per extent, so it doesn't matter what the
+	// volume is mounted with later
+	fs = openTestVolume(t, dir, nil)
+	defer fs.Close()
+	check(fs)
+}
@@ -0,0 +1,176 @@
+package appendfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Operations the kernel has no FUSE request for are driven through
+// extended attributes in the user.appendfs. namespace. They are never
+// stored or listed.
+const (
+	controlPrefix = "user.appendfs."
+	// Reading it gives the node id, which other control attributes take
+	xattrNodeId = controlPrefix + "nodeid"
+	// Setting it to "<src node id> [<src offset> <dst offset> <length>]"
+	// clones that range of the source into this file; without a range the
+	// whole source replaces the file's contents.
+	xattrReflink = controlPrefix + "reflink"
+	// Setting it on a directory to "<src node id> <name>" creates name in
+	// the directory as a clone of the source's subtree.
+	xattrClone = controlPrefix + "clone"
+	// Reading it gives the quota report, one quota per line. Root may set
+	// it to "user <uid> <bytes> <inodes>", "group <gid> <bytes> <inodes>"
+	// or, on a directory, "dir <bytes> <inodes>".
+	xattrQuota = controlPrefix + "quota"
+	// Reading it gives the volume's space usage
+	xattrStats = controlPrefix + "stats"
+	// The unix time until which a file is retained, see worm.go
+	xattrRetention = controlPrefix + "retention"
+	// The chattr flags of a node, see attrflags.go
+	xattrFlags = controlPrefix + "flags"
+	// Reading it gives the metadata log's size and Merkle root, see proof.go
+	xattrRoot = controlPrefix + "root"
+)
+
+func isControlXAttr(attr string) bool {
+	return strings.HasPrefix(attr, controlPrefix)
+}
+
+func (node *AppendFSNode) getControlXAttr(attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	switch attr {
+	case xattrNodeId:
+		return []byte(fmt.Sprintf("%d", node.nodeId)), fuse.OK
+	case xattrQuota:
+		report := ""
+		for _, quota := range node.fs.Quotas() {
+			report += quota.String() + "\n"
+		}
+		return []byte(report), fuse.OK
+	case xattrStats:
+		return []byte(node.fs.Stats().String()), fuse.OK
+	case xattrRetention:
+		return node.getRetention()
+	case xattrFlags:
+		return node.getFlags()
+	case xattrRoot:
+		return []byte(node.fs.MerkleRoot().String()), fuse.OK
+	}
+	return nil, fuse.ENODATA
+}
+
+func (node *AppendFSNode) setControlXAttr(attr string, data []byte, context *fuse.Context) fuse.Status {
+	if node.fs.follower {
+		return fuse.Status(syscall.EROFS)
+	}
+	switch attr {
+	case xattrReflink:
+		return node.reflinkControl(string(data), context)
+	case xattrClone:
+		return node.cloneControl(string(data), context)
+	case xattrQuota:
+		return node.quotaControl(string(data), context)
+	case xattrRetention:
+		return node.retentionControl(string(data), context)
+	case xattrFlags:
+		return node.flagsControl(string(data), context)
+	}
+	return fuse.EINVAL
+}
+
+func (node *AppendFSNode) reflinkControl(arg string, context *fuse.Context) fuse.Status {
+	var srcId, srcOff, dstOff, length uint64
+	n, _ := fmt.Sscan(arg, &srcId, &srcOff, &dstOff, &length)
+	src := node.fs.Node(srcId)
+	if src == nil {
+		return fuse.ENOENT
+	}
+	if code := node.checkAccess(fuse.W_OK, context); code != fuse.OK {
+		return code
+	}
+	if code := src.checkAccess(fuse.R_OK, context); code != fuse.OK {
+		return code
+	}
+	switch n {
+	case 1:
+		src.metadataMutex.RLock()
+		length = src.attr.Size
+		src.metadataMutex.RUnlock()
+		code := node.Truncate(nil, 0, context)
+		if code != fuse.OK {
+			return code
+		}
+	case 4:
+	default:
+		return fuse.EINVAL
+	}
+	_, code := node.CloneRange(src, srcOff, dstOff, length)
+	return code
+}
+
+func (node *AppendFSNode) cloneControl(arg string, context *fuse.Context) fuse.Status {
+	parts := strings.SplitN(arg, " ", 2)
+	if len(parts) != 2 || parts[1] == "" || strings.Contains(parts[1], "/") {
+		return fuse.EINVAL
+	}
+	srcId, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return fuse.EINVAL
+	}
+	name := parts[1]
+	if !node.attr.IsDir() {
+		return fuse.ENOTDIR
+	}
+	src := node.fs.Node(srcId)
+	if src == nil {
+		return fuse.ENOENT
+	}
+	if code := node.checkAccess(fuse.W_OK | fuse.X_OK, context); code != fuse.OK {
+		return code
+	}
+	if code := src.checkAccess(fuse.R_OK, context); code != fuse.OK {
+		return code
+	}
+	return node.CloneTree(src, name)
+}
+
+func (node *AppendFSNode) quotaControl(arg string, context *fuse.Context) fuse.Status {
+	if context != nil && context.Uid != 0 {
+		return fuse.EPERM
+	}
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return fuse.EINVAL
+	}
+	kind, err := ParseQuotaKind(fields[0])
+	if err != nil {
+		return fuse.EINVAL
+	}
+	quota := Quota{Kind: kind, Id: node.nodeId}
+	var n int
+	if kind == QuotaDir {
+		n, _ = fmt.Sscan(strings.Join(fields[1:], " "), &quota.Bytes, &quota.Inodes)
+	} else {
+		n, _ = fmt.Sscan(strings.Join(fields[1:], " "), &quota.Id, &quota.Bytes, &quota.Inodes)
+		n -= 1
+	}
+	if n != 2 {
+		return fuse.EINVAL
+	}
+	node.metadataMutex.RLock()
+	isDir := node.attr.IsDir()
+	node.metadataMutex.RUnlock()
+	if kind == QuotaDir && !isDir {
+		return fuse.ENOTDIR
+	}
+	err = node.fs.SetQuota(quota)
+	if err != nil {
+		fmt.Println(err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
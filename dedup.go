@@ -0,0 +1,287 @@
+package appendfs
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/e-tothe-ipi/appendfs/chunker"
+	"github.com/e-tothe-ipi/appendfs/rangelist"
+)
+
+// With dedup enabled, writes are cut into content-defined chunks and a
+// chunk whose hash is already in the chunk index is mapped onto the copy
+// in the data log instead of being appended again. The index lives in its
+// own append-only file next to the metadata file. A chunk's record is only
+// written to it once the data has been synced, so that after a crash the
+// index never points at data that didn't make it to disk; chunks that
+// weren't synced are simply not deduplicated against after that.
+
+type chunkHash [sha256.Size]byte
+
+// Where a chunk is stored. length is only set if the chunk was stored as
+// a blob, and checksum if checksums are enabled.
+type chunkLocation struct {
+	segment uint64
+	pos int
+	length int
+	codec Codec
+	checksum string
+}
+
+// Records of chunks with a checksum have it appended
+const chunkRecordSize = sha256.Size + 8 + 8 + 8 + 4
+
+type chunkIndex struct {
+	mutex sync.Mutex
+	chunker *chunker.Chunker
+	file *os.File
+	offset int64
+	chunks map[chunkHash]chunkLocation
+	// Chunks whose records wait for their data to be synced
+	pending []pendingChunk
+	// Bytes written by clients, and bytes that actually had to be stored
+	logicalBytes uint64
+	storedBytes uint64
+}
+
+type pendingChunk struct {
+	hash chunkHash
+	location chunkLocation
+}
+
+type DedupStats struct {
+	Chunks int
+	LogicalBytes uint64
+	StoredBytes uint64
+}
+
+// Ratio is how many bytes were written for every byte stored.
+func (stats DedupStats) Ratio() float64 {
+	if stats.StoredBytes == 0 {
+		return 1
+	}
+	return float64(stats.LogicalBytes) / float64(stats.StoredBytes)
+}
+
+func (fs *AppendFS) chunkIndexPath() string {
+	return fs.metadataFilePath + ".chunks"
+}
+
+// openChunkIndex loads the chunk index, forgetting chunks whose segment
+// has been compacted away, locally and from the cold store.
+func (fs *AppendFS) openChunkIndex() error {
+	file, err := os.OpenFile(fs.chunkIndexPath(), os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	segments, err := fs.listSegments()
+	if err == nil && fs.cold != nil {
+		var cold []uint64
+		cold, err = fs.cold.segments()
+		segments = append(segments, cold...)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	existing := make(map[uint64]bool)
+	for _, segment := range segments {
+		existing[segment] = true
+	}
+	index := &chunkIndex{chunker: chunker.New(2 << 10, 8 << 10, 64 << 10), file: file,
+						chunks: make(map[chunkHash]chunkLocation)}
+	reader := bufio.NewReader(file)
+	for {
+		start := index.offset
+		recordLen, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+		record := make([]byte, recordLen)
+		_, err = io.ReadFull(reader, record)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("Corrupt chunk index at offset %d: %v", start, err)
+		}
+		index.offset += int64(uvarintSize(recordLen)) + int64(recordLen)
+		if fs.encryption != nil {
+			record, err = fs.encryption.open(record, recordPosition(chunkRecord, 0, start))
+			if err != nil {
+				file.Close()
+				return err
+			}
+		}
+		if len(record) != chunkRecordSize && len(record) != chunkRecordSize + sha256.Size {
+			file.Close()
+			return fmt.Errorf("Corrupt chunk index at offset %d", start)
+		}
+		var hash chunkHash
+		copy(hash[:], record)
+		location := chunkLocation{segment: binary.BigEndian.Uint64(record[32:40]),
+								pos: int(binary.BigEndian.Uint64(record[40:48])),
+								length: int(binary.BigEndian.Uint64(record[48:56])),
+								codec: Codec(binary.BigEndian.Uint32(record[56:60])),
+								checksum: string(record[chunkRecordSize:])}
+		if existing[location.segment] {
+			index.chunks[hash] = location
+		}
+	}
+	fs.chunks = index
+	return nil
+}
+
+func (fs *AppendFS) hashChunk(chunk []byte) chunkHash {
+	var hash chunkHash
+	if fs.encryption != nil {
+		// A plain hash would tell anyone with the index which chunks
+		// hold known contents
+		mac := hmac.New(sha256.New, fs.encryption.hashKey)
+		mac.Write(chunk)
+		copy(hash[:], mac.Sum(nil))
+	} else {
+		hash = sha256.Sum256(chunk)
+	}
+	return hash
+}
+
+// addChunk records where a chunk is stored, in the index file once its
+// data is synced. The caller must hold the index mutex.
+func (fs *AppendFS) addChunk(hash chunkHash, location chunkLocation) {
+	fs.chunks.chunks[hash] = location
+	fs.chunks.pending = append(fs.chunks.pending, pendingChunk{hash, location})
+}
+
+// writeChunks appends the records of chunks whose data has been synced to
+// the index file and syncs it. Chunks forgotten since are left out, and
+// those that fail to be written are tried again next time.
+func (fs *AppendFS) writeChunks(chunks []pendingChunk) error {
+	index := fs.chunks
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	for i, chunk := range chunks {
+		if location, ok := index.chunks[chunk.hash]; !ok || location != chunk.location {
+			continue
+		}
+		err := fs.writeChunk(chunk.hash, chunk.location)
+		if err != nil {
+			index.pending = append(chunks[i:], index.pending...)
+			return err
+		}
+	}
+	return index.file.Sync()
+}
+
+// writeChunk appends the record of a chunk to the index file. The caller
+// must hold the index mutex.
+func (fs *AppendFS) writeChunk(hash chunkHash, location chunkLocation) error {
+	index := fs.chunks
+	record := make([]byte, chunkRecordSize, chunkRecordSize + sha256.Size)
+	copy(record, hash[:])
+	binary.BigEndian.PutUint64(record[32:40], location.segment)
+	binary.BigEndian.PutUint64(record[40:48], uint64(location.pos))
+	binary.BigEndian.PutUint64(record[48:56], uint64(location.length))
+	binary.BigEndian.PutUint32(record[56:60], uint32(location.codec))
+	record = append(record, location.checksum...)
+	if fs.encryption != nil {
+		var err error
+		record, err = fs.encryption.seal(record, recordPosition(chunkRecord, 0, index.offset))
+		if err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64 + len(record))
+	buf = append(buf[:binary.PutUvarint(buf, uint64(len(record)))], record...)
+	n, err := index.file.Write(buf)
+	index.offset += int64(n)
+	return err
+}
+
+// storeChunks is storeData for volumes with dedup enabled.
+func (fs *AppendFS) storeChunks(data []byte, off int) ([]*rangelist.RangeListEntry, error) {
+	index := fs.chunks
+	out := make([]*rangelist.RangeListEntry, 0)
+	chunkOff := off
+	for _, chunk := range index.chunker.Split(data) {
+		hash := fs.hashChunk(chunk)
+		index.mutex.Lock()
+		location, ok := index.chunks[hash]
+		index.mutex.Unlock()
+		if !ok {
+			fData, err := fs.storeExtent(chunk, chunkOff)
+			if err != nil {
+				return nil, err
+			}
+			location = chunkLocation{segment: fData.segment, pos: fData.base + chunkOff,
+									length: fData.length, codec: fData.codec,
+									checksum: fData.checksum}
+			index.mutex.Lock()
+			fs.addChunk(hash, location)
+			stored := len(chunk)
+			if location.length > 0 {
+				stored = location.length
+			}
+			index.storedBytes += uint64(stored)
+			index.mutex.Unlock()
+		}
+		index.mutex.Lock()
+		index.logicalBytes += uint64(len(chunk))
+		index.mutex.Unlock()
+		fData := fileSegmentEntry{segment: location.segment, base: location.pos - chunkOff}
+		if location.length > 0 {
+			fData.codec, fData.origin, fData.length = location.codec, chunkOff, location.length
+		}
+		fData.checksum = location.checksum
+		if fs.proofs {
+			fData.origin = chunkOff
+			fData.digest, fData.size = extentDigest(chunk), len(chunk)
+		}
+		out = append(out, &rangelist.RangeListEntry{Min:chunkOff,
+				Max:chunkOff + len(chunk) - 1, Data:fData})
+		chunkOff += len(chunk)
+	}
+	return out, nil
+}
+
+// forgetSegments drops chunks stored in segments that have been deleted.
+// The caller must hold the index mutex.
+func (fs *AppendFS) forgetSegments(segments []uint64) {
+	removed := make(map[uint64]bool)
+	for _, segment := range segments {
+		removed[segment] = true
+	}
+	for hash, location := range fs.chunks.chunks {
+		if removed[location.segment] {
+			delete(fs.chunks.chunks, hash)
+		}
+	}
+	pending := fs.chunks.pending[:0]
+	for _, chunk := range fs.chunks.pending {
+		if !removed[chunk.location.segment] {
+			pending = append(pending, chunk)
+		}
+	}
+	fs.chunks.pending = pending
+}
+
+// DedupStats reports how much data dedup has avoided storing since the
+// volume was opened. It returns false if dedup isn't enabled.
+func (fs *AppendFS) DedupStats() (DedupStats, bool) {
+	if fs.chunks == nil {
+		return DedupStats{}, false
+	}
+	fs.chunks.mutex.Lock()
+	stats := DedupStats{Chunks: len(fs.chunks.chunks), LogicalBytes: fs.chunks.logicalBytes,
+						StoredBytes: fs.chunks.storedBytes}
+	fs.chunks.mutex.Unlock()
+	return stats, true
+}
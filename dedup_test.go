@@ -0,0 +1,56 @@
+package appendfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func chunkIndexSize(t *testing.T, dir string) int64 {
+	info, err := os.Stat(filepath.Join(dir, "metadata.chunks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestChunkIndexWaitsForData(t *testing.T) {
+	dir := t.TempDir()
+	options := NewOptions()
+	options.Dedup = true
+	options.SyncPolicy = SyncUnsafe
+	fs := openTestVolume(t, dir, options)
+	data := bytes.Repeat([]byte("appendfs dedup "), 4096)
+	if _, err := fs.storeData(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	stats, _ := fs.DedupStats()
+	if stats.Chunks == 0 {
+		t.Fatalf("No chunks were stored")
+	}
+	if size := chunkIndexSize(t, dir); size != 0 {
+		t.Fatalf("The index has %d bytes before the data was synced", size)
+	}
+	if _, err := fs.storeData(data, len(data)); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ = fs.DedupStats(); stats.StoredBytes >= stats.LogicalBytes {
+		t.Fatalf("Writing the same data again stored it again: %+v", stats)
+	}
+	if err := fs.SyncData(); err != nil {
+		t.Fatal(err)
+	}
+	if size := chunkIndexSize(t, dir); size == 0 {
+		t.Fatalf("The index is empty after the data was synced")
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs = openTestVolume(t, dir, options)
+	defer fs.Close()
+	reopened, _ := fs.DedupStats()
+	if reopened.Chunks != stats.Chunks {
+		t.Fatalf("The index has %d chunks after reopening, not %d", reopened.Chunks, stats.Chunks)
+	}
+}
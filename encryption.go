@@ -0,0 +1,234 @@
+package appendfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/golang/protobuf/proto"
+)
+
+// Every record in the data and metadata files is sealed on its own with
+// AES-256-GCM and a fresh random nonce, so the files stay append only. The
+// position of the record is authenticated along with it, which stops
+// records from being moved around or replayed elsewhere in the log.
+type encryption struct {
+	aead cipher.AEAD
+	// Keys the chunk hashes used by dedup
+	hashKey []byte
+}
+
+var errTampered = errors.New("record failed authentication: wrong key or tampered data")
+
+const (
+	dataRecord = 'd'
+	metadataRecord = 'm'
+	chunkRecord = 'c'
+	auditRecord = 'a'
+	keyCheckRecord = 'k'
+)
+
+var (
+	errNoKey = errors.New("volume is encrypted: it has to be opened with its key")
+	errWrongKey = errors.New("wrong key, or the volume isn't encrypted")
+)
+
+// What the key check file holds, sealed with the volume's key
+const keyCheckValue = "appendfs key check"
+
+func newEncryption(key []byte) (*encryption, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hashKey := sha256.Sum256(append([]byte("appendfs chunk hash "), key...))
+	return &encryption{aead: aead, hashKey: hashKey[:]}, nil
+}
+
+// recordPosition builds the additional data that ties a record to where it
+// was written.
+func recordPosition(kind byte, segment uint64, pos int64) []byte {
+	ad := make([]byte, 17)
+	ad[0] = kind
+	binary.BigEndian.PutUint64(ad[1:9], segment)
+	binary.BigEndian.PutUint64(ad[9:17], uint64(pos))
+	return ad
+}
+
+func (e *encryption) Overhead() int {
+	return e.aead.NonceSize() + e.aead.Overhead()
+}
+
+func (e *encryption) seal(plaintext []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize(), e.Overhead() + len(plaintext))
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func (e *encryption) open(sealed []byte, ad []byte) ([]byte, error) {
+	if len(sealed) < e.Overhead() {
+		return nil, errTampered
+	}
+	nonce := sealed[:e.aead.NonceSize()]
+	plaintext, err := e.aead.Open(nil, nonce, sealed[e.aead.NonceSize():], ad)
+	if err != nil {
+		return nil, errTampered
+	}
+	return plaintext, nil
+}
+
+// KeyFromFile derives a key from the contents of a keyfile, which should
+// hold at least 32 random bytes.
+func KeyFromFile(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) < 32 {
+		return nil, errors.New("keyfile must hold at least 32 bytes")
+	}
+	key := sha256.Sum256(contents)
+	return key[:], nil
+}
+
+// SaltPath is where the salt for the passphrase of the volume whose
+// metadata file is metadataFilePath is kept.
+func SaltPath(metadataFilePath string) string {
+	return metadataFilePath + ".salt"
+}
+
+// keepSalt makes salt the one in saltPath, which must not already hold
+// another, for a copy of a volume made without the passphrase.
+func keepSalt(saltPath string, salt []byte) error {
+	have, err := os.ReadFile(saltPath)
+	if err == nil {
+		if !bytes.Equal(have, salt) {
+			return fmt.Errorf("%s holds another salt", saltPath)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	tmpPath := saltPath + ".tmp"
+	err = os.WriteFile(tmpPath, salt, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, saltPath)
+}
+
+// KeyFromPassphrase stretches a passphrase into a key. The salt is kept in
+// saltPath and is created the first time the volume is used.
+func KeyFromPassphrase(passphrase []byte, saltPath string) ([]byte, error) {
+	salt, err := os.ReadFile(saltPath)
+	if os.IsNotExist(err) {
+		salt = make([]byte, 32)
+		_, err = io.ReadFull(rand.Reader, salt)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(saltPath, salt, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pbkdf2.Key(sha256.New, string(passphrase), salt, 600000, 32)
+}
+
+func (fs *AppendFS) keyCheckPath() string {
+	return fs.metadataFilePath + ".keycheck"
+}
+
+// checkKey makes sure the volume is opened with the key it was created
+// with, or without one if it isn't encrypted, so that the wrong key is
+// reported as such instead of as records that can't be read. An encrypted
+// volume keeps keyCheckValue, sealed, in the key check file. One from
+// before there was a key check file is checked against its first record,
+// and given one.
+func (fs *AppendFS) checkKey() error {
+	check, err := os.ReadFile(fs.keyCheckPath())
+	if err == nil {
+		if fs.encryption == nil {
+			return errNoKey
+		}
+		value, err := fs.encryption.open(check, recordPosition(keyCheckRecord, 0, 0))
+		if err != nil || string(value) != keyCheckValue {
+			return errWrongKey
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	first, err := firstRecord(fs.metadataFilePath)
+	switch {
+	case err == io.EOF:
+		// A new volume
+	case err != nil:
+		return err
+	case fs.encryption == nil:
+		if proto.Unmarshal(first, &messages.NodeMetadata{}) != nil {
+			return errNoKey
+		}
+		return nil
+	default:
+		_, err = fs.encryption.open(first, recordPosition(metadataRecord, 0, 0))
+		if err != nil {
+			return errWrongKey
+		}
+	}
+	if fs.encryption == nil || fs.follower {
+		return nil
+	}
+	check, err = fs.encryption.seal([]byte(keyCheckValue), recordPosition(keyCheckRecord, 0, 0))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fs.keyCheckPath(), check, 0600)
+}
+
+// firstRecord returns the first record of the metadata file at path as it
+// is stored, or io.EOF if there is none.
+func firstRecord(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	recordLen, err := binary.ReadUvarint(reader)
+	if err == io.ErrUnexpectedEOF {
+		// Cut short while the first record was being written
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, recordLen)
+	_, err = io.ReadFull(reader, record)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, io.EOF
+	}
+	return record, err
+}
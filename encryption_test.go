@@ -0,0 +1,141 @@
+package appendfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/golang/protobuf/proto"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestSealOpen(t *testing.T) {
+	e, err := newEncryption(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("some record")
+	position := recordPosition(dataRecord, 3, 4096)
+	sealed, err := e.seal(plaintext, position)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := e.open(sealed, position)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("Round trip gave %q, %v", opened, err)
+	}
+	other, _ := newEncryption(testKey(2))
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered) - 1] ^= 1
+	cases := []struct {
+		name string
+		e *encryption
+		sealed []byte
+		position []byte
+	}{
+		{"tampered", e, tampered, position},
+		{"moved", e, sealed, recordPosition(dataRecord, 3, 8192)},
+		{"other kind", e, sealed, recordPosition(metadataRecord, 3, 4096)},
+		{"cut short", e, sealed[:e.Overhead() - 1], position},
+		{"other key", other, sealed, position},
+	}
+	for _, c := range cases {
+		if _, err := c.e.open(c.sealed, c.position); err != errTampered {
+			t.Errorf("%s: should fail authentication, got %v", c.name, err)
+		}
+	}
+}
+
+func TestTamperedMetadataRecord(t *testing.T) {
+	dir := t.TempDir()
+	options := NewOptions()
+	options.EncryptionKey = testKey(1)
+	fs := openTestVolume(t, dir, options)
+	err := fs.AppendMetadata(&messages.NodeMetadata{NodeId: proto.Uint64(7), Name: proto.String("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "metadata")
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("secret")) {
+		t.Fatalf("The metadata file holds a name in the clear")
+	}
+	stored[len(stored) - 1] ^= 1
+	e, _ := newEncryption(testKey(1))
+	_, _, err = newMetadataReader(bytes.NewReader(stored), 0, e).Next()
+	if err != errTampered {
+		t.Fatalf("A tampered record should fail authentication, got %v", err)
+	}
+}
+
+func TestOpenWithWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	options := NewOptions()
+	options.EncryptionKey = testKey(1)
+	fs := openTestVolume(t, dir, options)
+	err := fs.AppendMetadata(&messages.NodeMetadata{NodeId: proto.Uint64(7)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	open := func(key []byte) error {
+		options := NewOptions()
+		options.EncryptionKey = key
+		fs, err := NewAppendFS(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), options)
+		if err == nil {
+			fs.Close()
+		}
+		return err
+	}
+	check := func(when string) {
+		if err := open(nil); err != errNoKey {
+			t.Errorf("%s: opening without a key should fail with %v, got %v", when, errNoKey, err)
+		}
+		if err := open(testKey(2)); err != errWrongKey {
+			t.Errorf("%s: opening with another key should fail with %v, got %v", when, errWrongKey, err)
+		}
+		if err := open(testKey(1)); err != nil {
+			t.Errorf("%s: opening with the key failed: %v", when, err)
+		}
+	}
+	check("with a key check file")
+	// As volumes from before the key check file were
+	if err := os.Remove(filepath.Join(dir, "metadata.keycheck")); err != nil {
+		t.Fatal(err)
+	}
+	check("without a key check file")
+	if _, err := os.Stat(filepath.Join(dir, "metadata.keycheck")); err != nil {
+		t.Errorf("Opening with the key should have written a key check file: %v", err)
+	}
+}
+
+func TestOpenUnencryptedWithKey(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestVolume(t, dir, nil)
+	err := fs.AppendMetadata(&messages.NodeMetadata{NodeId: proto.Uint64(7)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	options := NewOptions()
+	options.EncryptionKey = testKey(1)
+	_, err = NewAppendFS(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), options)
+	if err != errWrongKey {
+		t.Fatalf("Opening with a key should fail with %v, got %v", errWrongKey, err)
+	}
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/e-tothe-ipi/appendfs"
+)
+
+// Commands other than mounting, selected by the first argument.
+var commands = map[string]func(args []string){
+	"reflink": reflinkCommand,
+	"clone": cloneCommand,
+	"quota": quotaCommand,
+	"stats": statsCommand,
+	"verify": verifyCommand,
+	"root": rootCommand,
+	"prove": proveCommand,
+	"verify-proof": verifyProofCommand,
+	"audit": auditCommand,
+	"watch": watchCommand,
+	"replica": replicaCommand,
+	"replicate": replicateCommand,
+	"backup": backupCommand,
+	"restore": restoreCommand,
+}
+
+// keyFlags are the flags needed to open an encrypted volume.
+type keyFlags struct {
+	keyFile *string
+	passphraseFile *string
+}
+
+func addKeyFlags(flags *flag.FlagSet) *keyFlags {
+	return &keyFlags{
+		keyFile: flags.String("keyfile", "", "encrypt the volume with a key read from this file."),
+		passphraseFile: flags.String("passphrase-file", "", "encrypt the volume with a passphrase read from this file."),
+	}
+}
+
+// key returns the encryption key asked for, or nil if the volume isn't
+// encrypted.
+func (keys *keyFlags) key(metadataFile string) ([]byte, error) {
+	if *keys.keyFile != "" {
+		return appendfs.KeyFromFile(*keys.keyFile)
+	}
+	if *keys.passphraseFile != "" {
+		passphrase, err := os.ReadFile(*keys.passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = bytes.TrimRight(passphrase, "\r\n")
+		return appendfs.KeyFromPassphrase(passphrase, appendfs.SaltPath(metadataFile))
+	}
+	return nil, nil
+}
+
+// volumeFlags are the flags needed to open a volume that isn't mounted:
+// its keys, and where the volume keeps its cold segments and mirrors.
+type volumeFlags struct {
+	keys *keyFlags
+	coldDir *string
+	mirrors *string
+}
+
+func addVolumeFlags(flags *flag.FlagSet) *volumeFlags {
+	return &volumeFlags{
+		keys: addKeyFlags(flags),
+		coldDir: flags.String("cold-dir", "", "the directory the volume's cold segments were moved to."),
+		mirrors: flags.String("mirrors", "", "comma-separated directories the volume keeps another copy in."),
+	}
+}
+
+// openVolume opens a volume that isn't mounted and loads its metadata.
+// A readOnly volume is opened as a follower, so that looking at it never
+// writes to it, not even to reclaim orphans.
+func openVolume(dataFile string, metadataFile string, volume *volumeFlags, readOnly bool) *appendfs.AppendFS {
+	fsOptions := appendfs.NewOptions()
+	fsOptions.Follow = readOnly
+	key, err := volume.keys.key(metadataFile)
+	if err != nil {
+		fail("%v", err)
+	}
+	fsOptions.EncryptionKey = key
+	fsOptions.ColdStore = coldStore(*volume.coldDir)
+	if *volume.mirrors != "" {
+		fsOptions.Mirrors = strings.Split(*volume.mirrors, ",")
+	}
+	fs, err := appendfs.NewAppendFS(dataFile, metadataFile, fsOptions)
+	if err != nil {
+		fail("%v", err)
+	}
+	// Connecting the root is what replays the metadata file
+	nodefs.NewFileSystemConnector(fs.Root(), nodefs.NewOptions())
+	return fs
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Printf(format + "\n", args...)
+	os.Exit(1)
+}
+
+// nodeId asks a mounted appendfs for the node id behind path.
+func nodeId(path string) string {
+	buf := make([]byte, 32)
+	n, err := syscall.Getxattr(path, "user.appendfs.nodeid", buf)
+	if err != nil {
+		fail("%s is not on an appendfs mount: %v", path, err)
+	}
+	return string(buf[:n])
+}
+
+// controlReport reads a report from a control attribute of a mounted
+// appendfs.
+func controlReport(path string, attr string) string {
+	size, err := syscall.Getxattr(path, attr, nil)
+	if err != nil {
+		fail("%s is not on an appendfs mount: %v", path, err)
+	}
+	buf := make([]byte, size)
+	n, err := syscall.Getxattr(path, attr, buf)
+	if err != nil {
+		fail("%v", err)
+	}
+	return string(buf[:n])
+}
+
+// reflinkCommand makes <dst> a copy of <src> that shares its data. Both
+// have to be on the same mounted appendfs.
+func reflinkCommand(args []string) {
+	if len(args) != 2 {
+		fmt.Println("usage: appendfs reflink <src> <dst>")
+		os.Exit(2)
+	}
+	src, dst := args[0], args[1]
+	srcStat, err := os.Stat(src)
+	if err != nil {
+		fail("%v", err)
+	}
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY | os.O_CREATE, srcStat.Mode().Perm())
+	if err != nil {
+		fail("%v", err)
+	}
+	dstFile.Close()
+	err = syscall.Setxattr(dst, "user.appendfs.reflink", []byte(nodeId(src)), 0)
+	if err != nil {
+		fail("reflink %s to %s: %v", src, dst, err)
+	}
+}
+
+// cloneCommand creates <dst> as a copy-on-write duplicate of the directory
+// tree at <src>. Without -data and -metadata both paths are on a mounted
+// appendfs; with them they are paths inside that volume, which must not be
+// mounted.
+func cloneCommand(args []string) {
+	flags := flag.NewFlagSet("clone", flag.ExitOnError)
+	dataFile := flags.String("data", "", "data file of an unmounted volume.")
+	metadataFile := flags.String("metadata", "", "metadata file of an unmounted volume.")
+	volume := addVolumeFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Println("usage: appendfs clone [-data <datafile> -metadata <metadatafile>] <src> <dst>")
+		os.Exit(2)
+	}
+	src, dst := flags.Arg(0), flags.Arg(1)
+	dstDir, dstName := filepath.Split(filepath.Clean(dst))
+	if *dataFile == "" {
+		if dstDir == "" {
+			dstDir = "."
+		}
+		err := syscall.Setxattr(dstDir, "user.appendfs.clone", []byte(nodeId(src) + " " + dstName), 0)
+		if err != nil {
+			fail("clone %s to %s: %v", src, dst, err)
+		}
+		return
+	}
+	fs := openVolume(*dataFile, *metadataFile, volume, false)
+	srcNode, parent := fs.Lookup(src), fs.Lookup(dstDir)
+	if srcNode == nil || parent == nil {
+		fail("clone %s to %s: no such file or directory", src, dst)
+	}
+	code := parent.CloneTree(srcNode, dstName)
+	err := fs.Close()
+	if code != fuse.OK {
+		fail("clone %s to %s: %v", src, dst, code)
+	}
+	if err != nil {
+		fail("%v", err)
+	}
+}
+
+// quotaCommand prints the quota report, or sets a quota if -user, -group or
+// -dir is given. As with clone, <path> is on a mounted appendfs unless
+// -data and -metadata name an unmounted volume; for -dir it is the
+// directory the quota applies to.
+func quotaCommand(args []string) {
+	flags := flag.NewFlagSet("quota", flag.ExitOnError)
+	dataFile := flags.String("data", "", "data file of an unmounted volume.")
+	metadataFile := flags.String("metadata", "", "metadata file of an unmounted volume.")
+	volume := addVolumeFlags(flags)
+	uid := flags.Int64("user", -1, "set the quota of this uid.")
+	gid := flags.Int64("group", -1, "set the quota of this gid.")
+	dir := flags.Bool("dir", false, "set the quota of the directory tree at <path>.")
+	limitBytes := flags.Uint64("bytes", 0, "byte limit to set, 0 for none.")
+	limitInodes := flags.Uint64("inodes", 0, "inode limit to set, 0 for none.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("usage: appendfs quota [-data <datafile> -metadata <metadatafile>] [-user <uid> | -group <gid> | -dir] [-bytes <n>] [-inodes <n>] <path>")
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+	var setting string
+	switch {
+	case *uid >= 0:
+		setting = fmt.Sprintf("user %d %d %d", *uid, *limitBytes, *limitInodes)
+	case *gid >= 0:
+		setting = fmt.Sprintf("group %d %d %d", *gid, *limitBytes, *limitInodes)
+	case *dir:
+		setting = fmt.Sprintf("dir %d %d", *limitBytes, *limitInodes)
+	}
+	if *dataFile == "" {
+		if setting != "" {
+			err := syscall.Setxattr(path, "user.appendfs.quota", []byte(setting), 0)
+			if err != nil {
+				fail("set quota on %s: %v", path, err)
+			}
+			return
+		}
+		fmt.Print(controlReport(path, "user.appendfs.quota"))
+		return
+	}
+	fs := openVolume(*dataFile, *metadataFile, volume, false)
+	node := fs.Lookup(path)
+	if node == nil {
+		fail("%s: no such file or directory", path)
+	}
+	if setting != "" {
+		code := node.SetXAttr("user.appendfs.quota", []byte(setting), 0, nil)
+		if code != fuse.OK {
+			fail("set quota on %s: %v", path, code)
+		}
+	} else {
+		for _, quota := range fs.Quotas() {
+			fmt.Println(quota)
+		}
+	}
+	err := fs.Close()
+	if err != nil {
+		fail("%v", err)
+	}
+}
+
+// verifyCommand checks that a metadata file hasn't been edited or cut
+// short since it was written, checking checkpoint signatures if given the
+// public key. With -data it also checks the volume's extent checksums.
+// The volume must not be mounted.
+func verifyCommand(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	dataFile := flags.String("data", "", "also check the extents in this data file.")
+	publicKeyFile := flags.String("public-key", "", "ed25519 public key checkpoints must be signed with.")
+	volume := addVolumeFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("usage: appendfs verify [-public-key <file>] [-data <datafile>] <metadatafile>")
+		os.Exit(2)
+	}
+	metadataFile := flags.Arg(0)
+	var publicKey ed25519.PublicKey
+	if *publicKeyFile != "" {
+		var err error
+		publicKey, err = appendfs.LoadPublicKey(*publicKeyFile)
+		if err != nil {
+			fail("%v", err)
+		}
+	}
+	key, err := volume.keys.key(metadataFile)
+	if err != nil {
+		fail("%v", err)
+	}
+	report, err := appendfs.VerifyLog(metadataFile, key, publicKey)
+	if err != nil {
+		fail("%s: %v", metadataFile, err)
+	}
+	fmt.Printf("%s: %d records, %d bytes, %d checkpoints\n", metadataFile,
+		report.Records, report.Length, report.Checkpoints)
+	if report.Unchained > 0 {
+		fmt.Printf("the first %d records are from before the log was chained\n", report.Unchained)
+	}
+	if report.Checkpoints > 0 {
+		fmt.Printf("signed up to offset %d\n", report.CheckpointOffset)
+	}
+	if *dataFile == "" {
+		return
+	}
+	fs := openVolume(*dataFile, metadataFile, volume, true)
+	checked, err := fs.VerifyExtents()
+	if err != nil {
+		fail("%s: %v", *dataFile, err)
+	}
+	fmt.Printf("%s: %d extents match their checksums\n", *dataFile, checked)
+	err = fs.Close()
+	if err != nil {
+		fail("%v", err)
+	}
+}
+
+// statsCommand prints how a volume uses its space, given any path on the
+// mount or, with -data and -metadata, an unmounted volume.
+func statsCommand(args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	dataFile := flags.String("data", "", "data file of an unmounted volume.")
+	metadataFile := flags.String("metadata", "", "metadata file of an unmounted volume.")
+	volume := addVolumeFlags(flags)
+	flags.Parse(args)
+	if *dataFile == "" {
+		if flags.NArg() != 1 {
+			fmt.Println("usage: appendfs stats [-data <datafile> -metadata <metadatafile>] [<path>]")
+			os.Exit(2)
+		}
+		fmt.Print(controlReport(flags.Arg(0), "user.appendfs.stats"))
+		return
+	}
+	fs := openVolume(*dataFile, *metadataFile, volume, true)
+	fmt.Print(fs.Stats())
+	err := fs.Close()
+	if err != nil {
+		fail("%v", err)
+	}
+}
+
+// rootCommand prints the Merkle root of a volume's metadata log, which
+// proofs from prove are checked against.
+func rootCommand(args []string) {
+	flags := flag.NewFlagSet("root", flag.ExitOnError)
+	dataFile := flags.String("data", "", "data file of an unmounted volume.")
+	metadataFile := flags.String("metadata", "", "metadata file of an unmounted volume.")
+	volume := addVolumeFlags(flags)
+	flags.Parse(args)
+	if *dataFile == "" {
+		if flags.NArg() != 1 {
+			fmt.Println("usage: appendfs root [-data <datafile> -metadata <metadatafile>] [<path>]")
+			os.Exit(2)
+		}
+		fmt.Print(controlReport(flags.Arg(0), "user.appendfs.root"))
+		return
+	}
+	fs := openVolume(*dataFile, *metadataFile, volume, true)
+	fmt.Print(fs.MerkleRoot())
+	err := fs.Close()
+	if err != nil {
+		fail("%v", err)
+	}
+}
+
+// proveCommand prints a proof of the contents <path> had in an unmounted
+// volume when its metadata log was -offset bytes long.
+func proveCommand(args []string) {
+	flags := flag.NewFlagSet("prove", flag.ExitOnError)
+	dataFile := flags.String("data", "", "data file of the volume.")
+	metadataFile := flags.String("metadata", "", "metadata file of the volume.")
+	offset := flags.Int64("offset", 0, "length of the metadata log to prove against, 0 for all of it.")
+	volume := addVolumeFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 || *dataFile == "" || *metadataFile == "" {
+		fmt.Println("usage: appendfs prove -data <datafile> -metadata <metadatafile> [-offset <n>] <path>")
+		os.Exit(2)
+	}
+	fs := openVolume(*dataFile, *metadataFile, volume, true)
+	proof, err := fs.Prove(flags.Arg(0), *offset)
+	if err != nil {
+		fail("%v", err)
+	}
+	out, err := json.Marshal(proof)
+	if err != nil {
+		fail("%v", err)
+	}
+	fmt.Println(string(out))
+	err = fs.Close()
+	if err != nil {
+		fail("%v", err)
+	}
+}
+
+// verifyProofCommand checks that <file> holds the contents <proof> proves
+// against a published root.
+func verifyProofCommand(args []string) {
+	flags := flag.NewFlagSet("verify-proof", flag.ExitOnError)
+	root := flags.String("root", "", "published Merkle root, in hex.")
+	flags.Parse(args)
+	if flags.NArg() != 2 || *root == "" {
+		fmt.Println("usage: appendfs verify-proof -root <hex> <prooffile> <file>")
+		os.Exit(2)
+	}
+	rootHash, err := appendfs.ParseRoot(*root)
+	if err != nil {
+		fail("bad root: %v", err)
+	}
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		fail("%v", err)
+	}
+	proof := &appendfs.FileProof{}
+	err = json.Unmarshal(data, proof)
+	if err != nil {
+		fail("%s: %v", flags.Arg(0), err)
+	}
+	content, err := os.ReadFile(flags.Arg(1))
+	if err != nil {
+		fail("%v", err)
+	}
+	err = appendfs.VerifyProof(proof, content, rootHash)
+	if err != nil {
+		fail("%s: %v", flags.Arg(1), err)
+	}
+	fmt.Printf("%s had these contents as %s at or before offset %d\n", flags.Arg(1), proof.Path, proof.Offset)
+}
+
+// auditCommand prints the entries of an audit log, optionally only those
+// for a path, a user or a time range.
+func auditCommand(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	path := flags.String("path", "", "only operations on this path or below it.")
+	uid := flags.Int64("user", -1, "only operations by this uid.")
+	since := flags.String("since", "", "only operations at or after this RFC 3339 time.")
+	until := flags.String("until", "", "only operations at or before this RFC 3339 time.")
+	metadataFile := flags.String("metadata", "", "metadata file of the volume, needed with -passphrase-file.")
+	keys := addKeyFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("usage: appendfs audit [-path <path>] [-user <uid>] [-since <time>] [-until <time>] <auditfile>")
+		os.Exit(2)
+	}
+	query := appendfs.AuditQuery{Path: *path, Uid: *uid}
+	var err error
+	if *since != "" {
+		query.Since, err = time.Parse(time.RFC3339, *since)
+		if err != nil {
+			fail("bad -since: %v", err)
+		}
+	}
+	if *until != "" {
+		query.Until, err = time.Parse(time.RFC3339, *until)
+		if err != nil {
+			fail("bad -until: %v", err)
+		}
+	}
+	key, err := keys.key(*metadataFile)
+	if err != nil {
+		fail("%v", err)
+	}
+	err = appendfs.QueryAuditLog(flags.Arg(0), key, query, func(entry appendfs.AuditEntry) {
+		fmt.Println(entry)
+	})
+	if err != nil {
+		fail("%s: %v", flags.Arg(0), err)
+	}
+}
+
+// watchCommand prints the changes recorded in a metadata file after
+// -offset as they happen, one per line. Each starts with the offset to
+// pass to -offset to carry on after it.
+func watchCommand(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	offset := flags.Int64("offset", 0, "offset in the metadata log to start after.")
+	asJSON := flags.Bool("json", false, "print each change as a JSON object.")
+	follow := flags.Bool("follow", true, "wait for more changes once all recorded ones are printed.")
+	keys := addKeyFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println("usage: appendfs watch [-offset <n>] [-json] [-follow=false] <metadatafile>")
+		os.Exit(2)
+	}
+	metadataFile := flags.Arg(0)
+	key, err := keys.key(metadataFile)
+	if err != nil {
+		fail("%v", err)
+	}
+	feed, err := appendfs.OpenChangeFeed(metadataFile, key, *offset)
+	if err != nil {
+		fail("%s: %v", metadataFile, err)
+	}
+	defer feed.Close()
+	print := func(event appendfs.ChangeEvent) {
+		if !*asJSON {
+			fmt.Println(event)
+			return
+		}
+		out, err := json.Marshal(event)
+		if err != nil {
+			fail("%v", err)
+		}
+		fmt.Println(string(out))
+	}
+	if !*follow {
+		for {
+			event, err := feed.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				fail("%s: %v", metadataFile, err)
+			}
+			print(event)
+		}
+	}
+	events, errs := feed.Follow(nil, nil)
+	for event := range events {
+		print(event)
+	}
+	fail("%s: %v", metadataFile, <-errs)
+}
+
+// replicaTarget is target as a replica of the volume: an existing
+// directory to keep copies of the volume's files in, or else the address
+// of an appendfs replica, which is sent the secret in secretFile.
+func replicaTarget(target string, dataFile string, metadataFile string, secretFile string) appendfs.ReplicaTarget {
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		return appendfs.NewLocalReplica(filepath.Join(target, filepath.Base(dataFile)),
+										filepath.Join(target, filepath.Base(metadataFile)))
+	}
+	return appendfs.DialReplica(target, readSecret(secretFile))
+}
+
+// readSecret returns the replication secret in path, or nil if path is
+// empty.
+func readSecret(path string) []byte {
+	if path == "" {
+		return nil
+	}
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		fail("%v", err)
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		fail("%s is empty", path)
+	}
+	return secret
+}
+
+// coldStore returns the cold store in dir, or nil if dir is empty.
+func coldStore(dir string) appendfs.ObjectStore {
+	if dir == "" {
+		return nil
+	}
+	store, err := appendfs.NewDirStore(dir)
+	if err != nil {
+		fail("%v", err)
+	}
+	return store
+}
+
+// isLoopback says whether address only listens on the loopback interface.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// replicaCommand keeps a replica of a volume for appendfs replicate, or a
+// mount with -replicate, to ship its logs to.
+func replicaCommand(args []string) {
+	flags := flag.NewFlagSet("replica", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:7040", "address to accept replication connections on.")
+	secretFile := flags.String("secret-file", "", "only accept replicators that have the secret in this file.")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		fmt.Println("usage: appendfs replica [-listen <address>] [-secret-file <file>] <datafile> <metadatafile>")
+		os.Exit(2)
+	}
+	secret := readSecret(*secretFile)
+	if secret == nil && !isLoopback(*listen) {
+		fail("listening on %s needs -secret-file", *listen)
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fail("%v", err)
+	}
+	fmt.Printf("Replicating to %s and %s from %s\n", flags.Arg(0), flags.Arg(1), listener.Addr())
+	replica := appendfs.NewLocalReplica(flags.Arg(0), flags.Arg(1))
+	err = appendfs.ServeReplica(listener, replica, secret)
+	replica.Close()
+	fail("%v", err)
+}
+
+// replicateCommand ships a volume's logs to a replica, once or, with
+// -follow, for as long as it runs.
+func replicateCommand(args []string) {
+	flags := flag.NewFlagSet("replicate", flag.ExitOnError)
+	follow := flags.Bool("follow", false, "keep shipping whatever is appended to the volume.")
+	interval := flags.Duration("interval", time.Second, "how often -follow looks for more to ship.")
+	verify := flags.Bool("verify", false, "check that the replica is the same as the volume as far as it goes.")
+	secretFile := flags.String("secret-file", "", "file holding the secret shared with the replica.")
+	coldDir := flags.String("cold-dir", "", "the directory the volume's cold segments were moved to.")
+	flags.Parse(args)
+	if flags.NArg() != 3 {
+		fmt.Println("usage: appendfs replicate [-follow] [-interval <duration>] [-verify] [-secret-file <file>] [-cold-dir <dir>] <datafile> <metadatafile> <directory or address>")
+		os.Exit(2)
+	}
+	dataFile, metadataFile := flags.Arg(0), flags.Arg(1)
+	target := replicaTarget(flags.Arg(2), dataFile, metadataFile, *secretFile)
+	defer target.Close()
+	replicator := appendfs.NewReplicator(dataFile, metadataFile, coldStore(*coldDir), target)
+	if *follow {
+		fail("%v", replicator.Run(nil, *interval))
+	}
+	err := replicator.Replicate()
+	if err != nil {
+		fail("%v", err)
+	}
+	acked := replicator.Acked()
+	if *verify {
+		acked, err = replicator.Verify()
+		if err != nil {
+			fail("%v", err)
+		}
+	}
+	logs := make([]appendfs.ReplicaLog, 0, len(acked))
+	for log := range acked {
+		logs = append(logs, log)
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return !logs[i].Metadata && (logs[j].Metadata || logs[i].Segment < logs[j].Segment)
+	})
+	for _, log := range logs {
+		fmt.Printf("%v: %d\n", log, acked[log])
+	}
+}
+
+// backupCommand writes a bundle of what has been appended to a volume since
+// the bundle given with -since, or of all of it.
+func backupCommand(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	since := flags.String("since", "", "the previous bundle, to back up only what came after it.")
+	coldDir := flags.String("cold-dir", "", "the directory the volume's cold segments were moved to.")
+	flags.Parse(args)
+	if flags.NArg() != 3 {
+		fmt.Println("usage: appendfs backup [-since <bundle>] [-cold-dir <dir>] <datafile> <metadatafile> <bundle>")
+		os.Exit(2)
+	}
+	dataFile, metadataFile, bundle := flags.Arg(0), flags.Arg(1), flags.Arg(2)
+	var previous *appendfs.BundleManifest
+	if *since != "" {
+		var err error
+		previous, err = appendfs.ReadBundleManifest(*since)
+		if err != nil {
+			fail("%v", err)
+		}
+	}
+	// Written aside so a bundle cut short is never taken for a whole one
+	out, err := os.Create(bundle + ".tmp")
+	if err != nil {
+		fail("%v", err)
+	}
+	manifest, err := appendfs.WriteBackup(dataFile, metadataFile, coldStore(*coldDir), previous, out)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(bundle + ".tmp", bundle)
+	}
+	if err != nil {
+		os.Remove(bundle + ".tmp")
+		fail("%v", err)
+	}
+	for _, log := range manifest.Logs {
+		if log.From < log.To {
+			fmt.Printf("%v: %d to %d\n", log.ReplicaLog(), log.From, log.To)
+		}
+	}
+}
+
+// restoreCommand rebuilds a volume that isn't mounted from a chain of
+// bundles, oldest first.
+func restoreCommand(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() < 3 {
+		fmt.Println("usage: appendfs restore <datafile> <metadatafile> <bundle>...")
+		os.Exit(2)
+	}
+	err := appendfs.Restore(flags.Arg(0), flags.Arg(1), flags.Args()[2:])
+	if err != nil {
+		fail("%v", err)
+	}
+	fmt.Printf("Restored %d bundles\n", flags.NArg() - 2)
+}
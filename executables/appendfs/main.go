@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
@@ -12,8 +14,39 @@ import (
 
 // this function was borrowed from https://raw.githubusercontent.com/hanwen/go-fuse/master/example/memfs/main.go
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
 	// Scans the arg list and sets up flags
 	debug := flag.Bool("debug", false, "print debugging messages.")
+	syncPolicy := flag.String("sync", "strict", "when to force data to disk: strict, periodic or unsafe.")
+	syncInterval := flag.Duration("sync-interval", 5 * time.Second, "how often to sync with -sync=periodic.")
+	segmentSize := flag.Int("segment-size", 64 << 20, "size in bytes at which a new data segment is started.")
+	compression := flag.String("compression", "none", "how to compress newly written data: none or flate.")
+	dedup := flag.Bool("dedup", false, "store identical chunks of written data only once.")
+	keys := addKeyFlags(flag.CommandLine)
+	defaultPermissions := flag.Bool("default-permissions", false, "let the kernel check permissions instead of appendfs.")
+	capacity := flag.Int64("capacity", 0, "most bytes the volume may take up on disk, 0 for as much as there is room for.")
+	worm := flag.Bool("worm", false, "make files immutable once they are closed after writing.")
+	wormRetention := flag.Duration("worm-retention", 0, "how long -worm keeps files from being deleted.")
+	signingKey := flag.String("signing-key", "", "sign the metadata log with the ed25519 key in this file, creating it if needed.")
+	checkpointInterval := flag.Duration("checkpoint-interval", time.Minute, "how often to sign the metadata log with -signing-key.")
+	checksums := flag.Bool("checksums", false, "store a checksum with newly written data and check it on read.")
+	proofs := flag.Bool("proofs", false, "record digests of newly written data so files can be proven with appendfs prove.")
+	audit := flag.String("audit", "", "record every change to the filesystem, and who made it, in this file.")
+	compact := flag.Bool("compact", false, "delete data segments that are no longer referenced before mounting.")
+	follow := flag.Bool("follow", false, "mount read-only, following the changes another appendfs makes to the volume.")
+	followInterval := flag.Duration("follow-interval", time.Second, "how often -follow looks for changes.")
+	mirrors := flag.String("mirrors", "", "comma-separated directories to keep another copy of the volume in each.")
+	coldDir := flag.String("cold-dir", "", "move data segments that have gone cold to this directory.")
+	coldAfter := flag.Duration("cold-after", 24 * time.Hour, "how long a sealed segment goes unwritten before -cold-dir takes it.")
+	coldCacheSize := flag.Int64("cold-cache-size", 256 << 20, "most bytes read back from -cold-dir to keep on local disk.")
+	replicate := flag.String("replicate", "", "ship the volume's logs to this directory or appendfs replica address.")
+	replicateInterval := flag.Duration("replicate-interval", time.Second, "how often -replicate ships what was appended.")
+	replicateSecretFile := flag.String("replicate-secret-file", "", "file holding the secret shared with the -replicate replica.")
 	flag.Parse()
 	if flag.NArg() < 3 {
 		fmt.Println("usage: appendfs <mountpoint> <datafile> <metadatafile>")
@@ -21,7 +54,64 @@ func main() {
 	}
 
 	mountPoint := flag.Arg(0)
-	fs, err := appendfs.NewAppendFS(flag.Arg(1), flag.Arg(2))
+	fsOptions := appendfs.NewOptions()
+	policy, err := appendfs.ParseSyncPolicy(*syncPolicy)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	fsOptions.SyncPolicy = policy
+	fsOptions.SyncInterval = *syncInterval
+	fsOptions.SegmentSize = *segmentSize
+	fsOptions.Dedup = *dedup
+	fsOptions.DefaultPermissions = *defaultPermissions
+	fsOptions.Capacity = *capacity
+	fsOptions.Worm = *worm
+	fsOptions.WormRetention = *wormRetention
+	fsOptions.CheckpointInterval = *checkpointInterval
+	fsOptions.Checksums = *checksums
+	fsOptions.Proofs = *proofs
+	fsOptions.AuditLog = *audit
+	fsOptions.Follow = *follow
+	if *mirrors != "" {
+		fsOptions.Mirrors = strings.Split(*mirrors, ",")
+	}
+	fsOptions.FollowInterval = *followInterval
+	if *coldDir != "" {
+		fsOptions.ColdStore, err = appendfs.NewDirStore(*coldDir)
+		if err != nil {
+			fmt.Printf("Mount fail: %v\n", err)
+			os.Exit(1)
+		}
+		fsOptions.ColdAfter = *coldAfter
+		fsOptions.ColdCacheSize = *coldCacheSize
+	}
+	if *replicate != "" && *replicateInterval <= 0 {
+		fmt.Println("-replicate-interval must be positive")
+		os.Exit(2)
+	}
+	if *follow && *compact {
+		fmt.Println("-compact can't be used with -follow")
+		os.Exit(2)
+	}
+	if *signingKey != "" {
+		fsOptions.SigningKey, err = appendfs.LoadSigningKey(*signingKey)
+		if err != nil {
+			fmt.Printf("Mount fail: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	fsOptions.Compression, err = appendfs.ParseCodec(*compression)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	fsOptions.EncryptionKey, err = keys.key(flag.Arg(2))
+	if err != nil {
+		fmt.Printf("Mount fail: %v\n", err)
+		os.Exit(1)
+	}
+	fs, err := appendfs.NewAppendFS(flag.Arg(1), flag.Arg(2), fsOptions)
 	if err != nil {
 		fmt.Printf("Mount fail: %v\n", err)
 		os.Exit(1)
@@ -29,20 +119,70 @@ func main() {
 	options := nodefs.NewOptions()
 	options.Owner = nil
 	conn := nodefs.NewFileSystemConnector(fs.Root(), options)
-	server, err := fuse.NewServer(conn.RawFS(), mountPoint, nil)
+	if *compact {
+		removed, err := fs.Compact()
+		if err != nil {
+			fmt.Printf("Compaction fail: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Removed %d data segments\n", len(removed))
+	}
+	mountOptions := &fuse.MountOptions{}
+	if *defaultPermissions {
+		mountOptions.Options = append(mountOptions.Options, "default_permissions")
+	}
+	if *follow {
+		mountOptions.Options = append(mountOptions.Options, "ro")
+	}
+	server, err := fuse.NewServer(conn.RawFS(), mountPoint, mountOptions)
 	if err != nil {
 		fmt.Printf("Mount fail: %v\n", err)
 		os.Exit(1)
 	}
 	server.SetDebug(*debug)
+	if *follow {
+		err = fs.Follow(conn)
+		if err != nil {
+			fmt.Printf("Mount fail: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	var replicator *appendfs.Replicator
+	replicateStop := make(chan struct{})
+	replicated := make(chan struct{})
+	if *replicate != "" {
+		target := replicaTarget(*replicate, flag.Arg(1), flag.Arg(2), *replicateSecretFile)
+		defer target.Close()
+		replicator = appendfs.NewReplicator(flag.Arg(1), flag.Arg(2), fsOptions.ColdStore, target)
+		go func() {
+			if err := replicator.Run(replicateStop, *replicateInterval); err != nil {
+				fmt.Printf("Replication fail: %v\n", err)
+			}
+			close(replicated)
+		}()
+	}
 	fmt.Println("Mounted!")
 	server.Serve()
 	fmt.Println("Closing filesystem")
+	if stats, ok := fs.DedupStats(); ok {
+		fmt.Printf("Dedup: %d bytes written, %d stored, ratio %.2f\n",
+			stats.LogicalBytes, stats.StoredBytes, stats.Ratio())
+	}
 	err = fs.Close()
 	if err != nil {
 		fmt.Printf("Unmount fail: %v\n", err)
 		os.Exit(1)
 	}
+	if replicator != nil {
+		// One last round for whatever was appended on the way out
+		close(replicateStop)
+		<-replicated
+		err = replicator.Replicate()
+		if err != nil {
+			fmt.Printf("Replication fail: %v\n", err)
+			os.Exit(1)
+		}
+	}
 }
 
 
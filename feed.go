@@ -0,0 +1,254 @@
+package appendfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// A change feed turns the metadata log into events as records are
+// appended to it. It only needs the metadata file, so it can follow a
+// volume from another process. Each event carries the offset after its
+// record, from which a later feed picks up; getting there means replaying
+// the log up to it, since paths depend on every record before.
+
+type ChangeKind int
+
+const (
+	ChangeCreated ChangeKind = iota
+	ChangeModified
+	ChangeRenamed
+	ChangeDeleted
+)
+
+var changeKindNames = []string{"created", "modified", "renamed", "deleted"}
+
+func (kind ChangeKind) String() string {
+	if int(kind) < len(changeKindNames) {
+		return changeKindNames[kind]
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(kind))
+}
+
+func (kind ChangeKind) MarshalText() ([]byte, error) {
+	return []byte(kind.String()), nil
+}
+
+type ChangeEvent struct {
+	Kind ChangeKind `json:"kind"`
+	NodeId uint64 `json:"node_id"`
+	Path string `json:"path"`
+	// Where a renamed node was before
+	OldPath string `json:"old_path,omitempty"`
+	// Offset of the record, and of the one after it to resume from
+	Offset int64 `json:"offset"`
+	Next int64 `json:"next"`
+}
+
+func (event ChangeEvent) String() string {
+	if event.Kind == ChangeRenamed {
+		return fmt.Sprintf("%d %s %s -> %s", event.Next, event.Kind, event.OldPath, event.Path)
+	}
+	return fmt.Sprintf("%d %s %s", event.Next, event.Kind, event.Path)
+}
+
+// How often a feed without a volume to wake it looks for new records
+const feedPollInterval = time.Second / 4
+
+type feedNode struct {
+	parent uint64
+	name string
+}
+
+type ChangeFeed struct {
+	file *os.File
+	encryption *encryption
+	reader *metadataReader
+	// Nodes with a name
+	nodes map[uint64]feedNode
+}
+
+// OpenChangeFeed returns a feed of the changes recorded in a metadata file
+// after offset. encryptionKey is needed for encrypted volumes.
+func OpenChangeFeed(metadataFilePath string, encryptionKey []byte, offset int64) (*ChangeFeed, error) {
+	var enc *encryption
+	if encryptionKey != nil {
+		var err error
+		enc, err = newEncryption(encryptionKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return openChangeFeed(metadataFilePath, enc, offset)
+}
+
+func openChangeFeed(metadataFilePath string, enc *encryption, offset int64) (*ChangeFeed, error) {
+	file, err := os.Open(metadataFilePath)
+	if err != nil {
+		return nil, err
+	}
+	feed := &ChangeFeed{file: file, encryption: enc, reader: newMetadataReader(file, 0, enc),
+						nodes: map[uint64]feedNode{rootNodeId: feedNode{}}}
+	for feed.reader.offset < offset {
+		_, err = feed.Next()
+		if err == io.EOF {
+			err = fmt.Errorf("offset %d is past the end of the log", offset)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if feed.reader.offset != offset {
+		file.Close()
+		return nil, fmt.Errorf("offset %d is not the end of a record", offset)
+	}
+	return feed, nil
+}
+
+func (feed *ChangeFeed) path(nodeId uint64) string {
+	names := make([]string, 0)
+	for nodeId != rootNodeId {
+		node, ok := feed.nodes[nodeId]
+		if !ok {
+			names = append([]string{"?"}, names...)
+			break
+		}
+		names = append([]string{node.name}, names...)
+		nodeId = node.parent
+	}
+	return "/" + strings.Join(names, "/")
+}
+
+// Offset is where the feed has got to in the log.
+func (feed *ChangeFeed) Offset() int64 {
+	return feed.reader.offset
+}
+
+// Next returns the next change, or io.EOF if there are no more records
+// yet. Records that change nothing, such as those of the volume itself,
+// are skipped.
+func (feed *ChangeFeed) Next() (ChangeEvent, error) {
+	for {
+		metadata, start, err := feed.reader.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A record may be half written, so read it again next time
+			_, seekErr := feed.file.Seek(start, 0)
+			if seekErr != nil {
+				return ChangeEvent{}, seekErr
+			}
+			feed.reader = newMetadataReader(feed.file, start, feed.encryption)
+			return ChangeEvent{}, io.EOF
+		}
+		if err != nil {
+			return ChangeEvent{}, fmt.Errorf("record at offset %d: %v", start, err)
+		}
+		id := metadata.GetNodeId()
+		if id == volumeRecordId {
+			continue
+		}
+		event := ChangeEvent{NodeId: id, Offset: start, Next: feed.reader.offset}
+		node, known := feed.nodes[id]
+		switch {
+		case metadata.Valid != nil && !metadata.GetValid(), metadata.GetOrphan():
+			if !known {
+				// An orphan being reclaimed was already deleted
+				continue
+			}
+			event.Kind, event.Path = ChangeDeleted, feed.path(id)
+			delete(feed.nodes, id)
+		case !known && metadata.GetValid():
+			feed.nodes[id] = feedNode{metadata.GetParentNodeId(), metadata.GetName()}
+			event.Kind, event.Path = ChangeCreated, feed.path(id)
+		case known && metadata.Name != nil &&
+				(metadata.GetName() != node.name || metadata.GetParentNodeId() != node.parent):
+			event.Kind, event.OldPath = ChangeRenamed, feed.path(id)
+			feed.nodes[id] = feedNode{metadata.GetParentNodeId(), metadata.GetName()}
+			event.Path = feed.path(id)
+		default:
+			event.Kind, event.Path = ChangeModified, feed.path(id)
+		}
+		return event, nil
+	}
+}
+
+func (feed *ChangeFeed) Close() error {
+	return feed.file.Close()
+}
+
+// Follow sends every change from the feed on the returned channel, waiting
+// for more once it has caught up, until stop is closed or reading fails.
+// wake, if set, returns a channel that is closed once there may be more
+// records; otherwise the log is polled. The channel of changes is closed
+// when Follow is done, after any error has been sent on the other one.
+func (feed *ChangeFeed) Follow(stop <-chan struct{}, wake func() <-chan struct{}) (<-chan ChangeEvent, <-chan error) {
+	events := make(chan ChangeEvent)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(events)
+		for {
+			var more <-chan struct{}
+			if wake != nil {
+				// Taken before reading, so no record can slip in between
+				more = wake()
+			}
+			event, err := feed.Next()
+			if err == io.EOF {
+				var poll <-chan time.Time
+				if more == nil {
+					poll = time.After(feedPollInterval)
+				}
+				select {
+				case <-more:
+				case <-poll:
+				case <-stop:
+					return
+				}
+				continue
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case events <- event:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return events, errs
+}
+
+// Watch follows the changes to the volume after offset. It is Follow on a
+// feed of the volume's metadata file, woken whenever a record is
+// appended; the feed is closed once it is done.
+func (fs *AppendFS) Watch(offset int64, stop <-chan struct{}) (<-chan ChangeEvent, <-chan error, error) {
+	feed, err := openChangeFeed(fs.metadataFilePath, fs.encryption, offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	events, errs := feed.Follow(stop, fs.appended)
+	out := make(chan ChangeEvent)
+	go func() {
+		defer close(out)
+		defer feed.Close()
+		for event := range events {
+			select {
+			case out <- event:
+			case <-stop:
+			}
+		}
+	}()
+	return out, errs, nil
+}
+
+// appended returns a channel that is closed once another metadata record
+// has been appended.
+func (fs *AppendFS) appended() <-chan struct{} {
+	fs.metadataMutex.RLock()
+	defer fs.metadataMutex.RUnlock()
+	return fs.appendSignal
+}
@@ -0,0 +1,101 @@
+package appendfs
+
+import (
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readTestFeed returns every change in the metadata file after offset.
+func readTestFeed(t *testing.T, path string, offset int64) []ChangeEvent {
+	feed, err := OpenChangeFeed(path, nil, offset)
+	if err != nil {
+		t.Fatalf("OpenChangeFeed at %d: %v", offset, err)
+	}
+	defer feed.Close()
+	events := make([]ChangeEvent, 0)
+	for {
+		event, err := feed.Next()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		events = append(events, event)
+	}
+}
+
+func changes(events []ChangeEvent) []string {
+	out := make([]string, 0, len(events))
+	for _, event := range events {
+		change := event.Kind.String() + " " + event.Path
+		if event.Kind == ChangeRenamed {
+			change += " from " + event.OldPath
+		}
+		out = append(out, change)
+	}
+	return out
+}
+
+func TestFeedResumes(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestVolume(t, dir, nil)
+	inode, _ := fs.Root().Mkdir("dir", 0755, rootCaller)
+	writeTestFileIn(t, inode.Node().(*AppendFSNode), "a", "contents")
+	inode.Node().(*AppendFSNode).Rename("a", fs.Root(), "b", rootCaller)
+	fs.Root().Unlink("b", rootCaller)
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "metadata")
+	all := readTestFeed(t, path, 0)
+	want := []string{"created /dir", "created /dir/a", "modified /dir/a", "renamed /b from /dir/a", "deleted /b"}
+	if got := changes(all); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Feed holds %v, not %v", got, want)
+	}
+	for i, event := range all {
+		if i > 0 && event.Offset != all[i - 1].Next {
+			t.Fatalf("Event %d starts at %d, not where the one before ended, %d", i, event.Offset, all[i - 1].Next)
+		}
+		// Resuming needs the records before the offset to know the paths
+		resumed := readTestFeed(t, path, event.Next)
+		if !reflect.DeepEqual(resumed, all[i + 1:]) {
+			t.Fatalf("Feed resumed at %d holds %v, not %v", event.Next, changes(resumed), want[i + 1:])
+		}
+	}
+	for _, offset := range []int64{all[1].Next - 1, all[len(all) - 1].Next + 1} {
+		if feed, err := OpenChangeFeed(path, nil, offset); err == nil {
+			feed.Close()
+			t.Errorf("Opened a feed at %d, which is not the end of a record", offset)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	fs.Root().Mkdir("before", 0755, rootCaller)
+	fs.metadataMutex.RLock()
+	offset := fs.metadataFileOffset
+	fs.metadataMutex.RUnlock()
+	stop := make(chan struct{})
+	defer close(stop)
+	events, errs, err := fs.Watch(offset, stop)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	fs.Root().Mkdir("after", 0755, rootCaller)
+	select {
+	case event := <-events:
+		if got := changes([]ChangeEvent{event}); got[0] != "created /after" {
+			t.Fatalf("Watch saw %s first, not the directory made after it started", got[0])
+		}
+	case err := <-errs:
+		t.Fatalf("Watch: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch saw nothing")
+	}
+}
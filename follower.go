@@ -0,0 +1,193 @@
+package appendfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/e-tothe-ipi/appendfs/merkle"
+	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// A follower mounts a volume that another process has mounted, read-only,
+// and keeps up with it: every FollowInterval it replays the records
+// appended to the metadata file since it last looked, applies them to its
+// tree, and tells the kernel to drop whatever it has cached of the nodes
+// they change. Readers so see a change within about one interval of it
+// reaching the metadata file. A record still being written is left for
+// the next look. Nothing is ever written, and every change a follower is
+// asked for fails with EROFS.
+
+var errReadOnly = errors.New("volume is mounted read-only as a follower")
+
+// Follow starts keeping the tree up to date with the volume, until it is
+// closed. conn must be serving the mount, since it is how the kernel is
+// told what changed.
+func (fs *AppendFS) Follow(conn *nodefs.FileSystemConnector) error {
+	if !fs.follower {
+		return errors.New("volume was not opened as a follower")
+	}
+	if fs.followStop != nil {
+		return errors.New("volume is already being followed")
+	}
+	fs.followStop = make(chan struct{})
+	fs.following.Add(1)
+	go fs.followLoop(conn)
+	return nil
+}
+
+func (fs *AppendFS) followLoop(conn *nodefs.FileSystemConnector) {
+	defer fs.following.Done()
+	ticker := time.NewTicker(fs.followInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := fs.catchUp(conn); err != nil {
+				fmt.Printf("Follow fail: %v\n", err)
+			}
+		case <-fs.followStop:
+			return
+		}
+	}
+}
+
+// readAppended returns the records appended to the metadata file since
+// the last call, counting them into the chain and the Merkle tree as
+// LoadMetadata does.
+func (fs *AppendFS) readAppended() ([]*messages.NodeMetadata, error) {
+	fs.metadataMutex.Lock()
+	defer fs.metadataMutex.Unlock()
+	_, err := fs.metadataFile.Seek(fs.metadataFileOffset, 0)
+	if err != nil {
+		return nil, err
+	}
+	reader := newMetadataReader(fs.metadataFile, fs.metadataFileOffset, fs.encryption)
+	reader.hash = fs.chainHash
+	records := make([]*messages.NodeMetadata, 0)
+	for {
+		metadata, start, err := reader.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			err = fmt.Errorf("record at offset %d: %v", start, err)
+			return records, err
+		}
+		fs.metadataFileOffset = reader.offset
+		fs.chainHash = reader.hash
+		fs.records.Append(merkle.LeafHash(reader.record))
+		records = append(records, metadata)
+	}
+	if len(records) > 0 {
+		// Watch works on a follower too
+		close(fs.appendSignal)
+		fs.appendSignal = make(chan struct{})
+	}
+	return records, nil
+}
+
+// A change the kernel has to be told about: a name in dir that was
+// added, or removed if child is set, or else new attributes of node, and
+// new contents if contents is set.
+type notice struct {
+	dir *nodefs.Inode
+	name string
+	child *nodefs.Inode
+	node *nodefs.Inode
+	contents bool
+}
+
+func (n notice) send(conn *nodefs.FileSystemConnector) fuse.Status {
+	switch {
+	case n.child != nil:
+		return conn.DeleteNotify(n.dir, n.child, n.name)
+	case n.dir != nil:
+		return conn.EntryNotify(n.dir, n.name)
+	case n.contents:
+		return conn.FileNotify(n.node, 0, 0)
+	}
+	return conn.FileNotify(n.node, -1, 0)
+}
+
+// catchUp applies the records appended since the last time. The kernel
+// is only told once they all are and no locks are held, since dropping a
+// file's pages waits for reads of it, which may need them.
+func (fs *AppendFS) catchUp(conn *nodefs.FileSystemConnector) error {
+	records, err := fs.readAppended()
+	notices := make([]notice, 0)
+	for _, metadata := range records {
+		notices = fs.applyRecord(metadata, notices)
+	}
+	if len(records) > 0 {
+		fs.recountQuotas()
+	}
+	for _, n := range notices {
+		// ENOENT only means the kernel had nothing cached
+		if code := n.send(conn); code != fuse.OK && code != fuse.ENOENT {
+			fmt.Printf("Notify fail: %v\n", code)
+		}
+	}
+	return err
+}
+
+// applyRecord changes the tree as metadata says, the way LoadMetadata
+// would have built it had the record been there, and adds what the
+// kernel has to be told to notices.
+func (fs *AppendFS) applyRecord(metadata *messages.NodeMetadata, notices []notice) []notice {
+	id := metadata.GetNodeId()
+	if id == volumeRecordId {
+		fs.loadQuotas(metadata.GetQuota())
+		return notices
+	}
+	removed := (metadata.Valid != nil && !metadata.GetValid()) || metadata.GetOrphan()
+	node := fs.Node(id)
+	if node == nil {
+		if removed || !metadata.GetValid() {
+			// Records of nodes that were removed before we saw them
+			return notices
+		}
+		parent := fs.Node(metadata.GetParentNodeId())
+		if parent == nil {
+			fmt.Printf("Follow: node %d is in unknown directory %d\n", id, metadata.GetParentNodeId())
+			return notices
+		}
+		fs.seenNodeId(id)
+		child := FromNodeMetadata(fs, metadata)
+		parent.Inode().NewChild(child.name, child.attr.IsDir(), child)
+		return append(notices, notice{dir: parent.Inode(), name: child.name})
+	}
+	node.metadataMutex.Lock()
+	parentId, name := node.parentNodeId, node.name
+	if !removed {
+		node.applyMetadata(metadata)
+	}
+	newParentId, newName := node.parentNodeId, node.name
+	node.metadataMutex.Unlock()
+	parent := fs.Node(parentId)
+	if removed {
+		fs.forgetNode(node)
+		if parent == nil {
+			return notices
+		}
+		if child := parent.Inode().RmChild(name); child != nil {
+			notices = append(notices, notice{dir: parent.Inode(), name: name, child: child})
+		}
+		return notices
+	}
+	if parent != nil && (newParentId != parentId || newName != name) {
+		newParent := fs.Node(newParentId)
+		child := parent.Inode().RmChild(name)
+		notices = append(notices, notice{dir: parent.Inode(), name: name})
+		if newParent != nil && child != nil {
+			// A node it replaced was removed by an earlier record
+			newParent.Inode().RmChild(newName)
+			newParent.Inode().AddChild(newName, child)
+			notices = append(notices, notice{dir: newParent.Inode(), name: newName})
+		}
+	}
+	return append(notices, notice{node: node.Inode(), contents: metadata.Contents != nil || metadata.Size != nil})
+}
@@ -0,0 +1,108 @@
+package appendfs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// openTestFollower opens the volume in dir as a follower.
+func openTestFollower(t *testing.T, dir string, interval time.Duration) (*AppendFS, *nodefs.FileSystemConnector) {
+	options := NewOptions()
+	options.Follow = true
+	options.FollowInterval = interval
+	fs, err := NewAppendFS(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), options)
+	if err != nil {
+		t.Fatalf("Open follower: %v", err)
+	}
+	return fs, nodefs.NewFileSystemConnector(fs.Root(), nodefs.NewOptions())
+}
+
+func TestFollowerReplays(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestVolume(t, dir, nil)
+	defer fs.Close()
+	inode, _ := fs.Root().Mkdir("dir", 0755, rootCaller)
+	writeTestFileIn(t, inode.Node().(*AppendFSNode), "a", "first")
+	writeTestFile(t, fs, "gone", []byte("removed later"))
+	follower, conn := openTestFollower(t, dir, time.Hour)
+	defer follower.Close()
+	if got := readTestPath(t, follower, "dir/a"); got != "first" {
+		t.Fatalf("Follower read %q, not %q", got, "first")
+	}
+
+	writeTestFile(t, fs, "new", []byte("appended later"))
+	fs.Lookup("dir").Rename("a", fs.Root(), "moved", rootCaller)
+	fs.Root().Unlink("gone", rootCaller)
+	file, _ := fs.Lookup("moved").Open(uint32(os.O_WRONLY), rootCaller)
+	file.Write([]byte("FIRST"), 0)
+	file.Flush()
+	file.Release()
+	fs.Lookup("moved").Chmod(nil, 0600, rootCaller)
+	if err := follower.catchUp(conn); err != nil {
+		t.Fatalf("catchUp: %v", err)
+	}
+	files := map[string]string{"new": "appended later", "moved": "FIRST"}
+	for path, want := range files {
+		if got := readTestPath(t, follower, path); got != want {
+			t.Errorf("Follower read %q from %s, not %q", got, path, want)
+		}
+	}
+	for _, path := range []string{"dir/a", "gone"} {
+		if follower.Lookup(path) != nil {
+			t.Errorf("Follower still has %s", path)
+		}
+	}
+	if mode := testMode(follower.Lookup("moved")); mode != 0600 {
+		t.Errorf("Follower has mode %o for moved, not 600", mode)
+	}
+	if follower.MerkleRoot().String() != fs.MerkleRoot().String() {
+		t.Errorf("Follower is at %v, not %v", follower.MerkleRoot(), fs.MerkleRoot())
+	}
+	// Nothing is written through a follower
+	if _, code := follower.Root().Mkdir("other", 0755, rootCaller); code != fuse.Status(syscall.EROFS) {
+		t.Errorf("Mkdir on a follower: %v, not EROFS", code)
+	}
+	if _, code := follower.Lookup("moved").Open(uint32(os.O_WRONLY), rootCaller); code != fuse.Status(syscall.EROFS) {
+		t.Errorf("Open for writing on a follower: %v, not EROFS", code)
+	}
+}
+
+func TestFollowLoop(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestVolume(t, dir, nil)
+	defer fs.Close()
+	follower, conn := openTestFollower(t, dir, 10 * time.Millisecond)
+	defer follower.Close()
+	if err := follower.Follow(conn); err != nil {
+		t.Fatalf("Follow: %v", err)
+	}
+	id := writeTestFile(t, fs, "file", []byte("followed")).nodeId
+	deadline := time.Now().Add(5 * time.Second)
+	var attr fuse.Attr
+	for {
+		if node := follower.Node(id); node != nil {
+			node.GetAttr(&attr, nil, rootCaller)
+			if attr.Size == 8 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Follower never saw the file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dest := make([]byte, 8)
+	result, code := follower.Node(id).Read(nil, dest, 0, rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Read on the follower: %v", code)
+	}
+	if got, _ := result.Bytes(dest); string(got) != "followed" {
+		t.Fatalf("Follower read %q, not %q", got, "followed")
+	}
+}
@@ -0,0 +1,135 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// Merkle trees as in RFC 6962: leaves and interior nodes are hashed with
+// different prefixes, and a tree of n leaves is split after the largest
+// power of two below n. A Tree only keeps the roots of its complete
+// subtrees, so appending to it never needs the leaves again.
+
+// LeafHash returns the hash of the leaf holding data.
+func LeafHash(data []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{0})
+	hash.Write(data)
+	return hash.Sum(nil)
+}
+
+func nodeHash(left []byte, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{1})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+type Tree struct {
+	// levels[i] is the root of a complete subtree of 2^i leaves if bit i
+	// of size is set
+	levels [][]byte
+	size uint64
+}
+
+// Append adds the leaf with hash leaf to the end of the tree.
+func (tree *Tree) Append(leaf []byte) {
+	hash := leaf
+	level := 0
+	for ; tree.size & (1 << uint(level)) != 0; level++ {
+		hash = nodeHash(tree.levels[level], hash)
+		tree.levels[level] = nil
+	}
+	if level == len(tree.levels) {
+		tree.levels = append(tree.levels, nil)
+	}
+	tree.levels[level] = hash
+	tree.size += 1
+}
+
+func (tree *Tree) Size() uint64 {
+	return tree.size
+}
+
+func (tree *Tree) Root() []byte {
+	var root []byte
+	for _, hash := range tree.levels {
+		if hash == nil {
+			continue
+		}
+		if root == nil {
+			root = hash
+		} else {
+			root = nodeHash(hash, root)
+		}
+	}
+	if root == nil {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+	return root
+}
+
+// split returns the size of the left subtree of a tree of n > 1 leaves.
+func split(n uint64) uint64 {
+	k := uint64(1)
+	for k << 1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// Root returns the root of the tree with the given leaf hashes.
+func Root(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	case 1:
+		return leaves[0]
+	}
+	k := split(uint64(len(leaves)))
+	return nodeHash(Root(leaves[:k]), Root(leaves[k:]))
+}
+
+// Proof returns the audit path of leaf index: the hashes needed to get
+// from it to the root, starting next to the leaf.
+func Proof(leaves [][]byte, index uint64) [][]byte {
+	n := uint64(len(leaves))
+	if n <= 1 {
+		return [][]byte{}
+	}
+	k := split(n)
+	if index < k {
+		return append(Proof(leaves[:k], index), Root(leaves[k:]))
+	}
+	return append(Proof(leaves[k:], index - k), Root(leaves[:k]))
+}
+
+// Verify reports whether proof shows that leaf is leaf index of the tree
+// of size leaves with the given root.
+func Verify(leaf []byte, index uint64, size uint64, proof [][]byte, root []byte) bool {
+	if index >= size {
+		return false
+	}
+	fn, sn := index, size - 1
+	hash := leaf
+	for _, sibling := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn & 1 == 1 || fn == sn {
+			hash = nodeHash(sibling, hash)
+			for fn & 1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = nodeHash(hash, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(hash, root)
+}
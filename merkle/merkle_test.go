@@ -0,0 +1,75 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func leaves(n int) [][]byte {
+	out := make([][]byte, n)
+	for i := range out {
+		out[i] = LeafHash([]byte(fmt.Sprintf("leaf %d", i)))
+	}
+	return out
+}
+
+func TestTreeMatchesRoot(t *testing.T) {
+	tree := &Tree{}
+	if !bytes.Equal(tree.Root(), Root(nil)) {
+		t.Fatalf("Empty tree should have the empty root")
+	}
+	all := leaves(70)
+	for n := 1; n <= len(all); n++ {
+		tree.Append(all[n - 1])
+		if tree.Size() != uint64(n) {
+			t.Fatalf("Tree should have %d leaves", n)
+		}
+		if !bytes.Equal(tree.Root(), Root(all[:n])) {
+			t.Fatalf("Tree of %d leaves has the wrong root", n)
+		}
+	}
+}
+
+func TestRootShape(t *testing.T) {
+	l := leaves(3)
+	want := nodeHash(nodeHash(l[0], l[1]), l[2])
+	if !bytes.Equal(Root(l), want) {
+		t.Fatalf("Three leaves should split after the second")
+	}
+}
+
+func TestProofsVerify(t *testing.T) {
+	all := leaves(33)
+	for n := 1; n <= len(all); n++ {
+		root := Root(all[:n])
+		for i := 0; i < n; i++ {
+			proof := Proof(all[:n], uint64(i))
+			if !Verify(all[i], uint64(i), uint64(n), proof, root) {
+				t.Fatalf("Proof of leaf %d of %d should verify", i, n)
+			}
+		}
+	}
+}
+
+func TestBadProofsFail(t *testing.T) {
+	all := leaves(11)
+	root := Root(all)
+	proof := Proof(all, 5)
+	if Verify(all[4], 5, 11, proof, root) {
+		t.Fatalf("Proof should not verify another leaf")
+	}
+	if Verify(all[5], 6, 11, proof, root) {
+		t.Fatalf("Proof should not verify at another index")
+	}
+	if Verify(all[5], 5, 6, proof, root) {
+		t.Fatalf("Proof should not verify for another size")
+	}
+	if Verify(all[5], 5, 11, proof[:len(proof) - 1], root) {
+		t.Fatalf("Short proof should not verify")
+	}
+	proof[0] = all[0]
+	if Verify(all[5], 5, 11, proof, root) {
+		t.Fatalf("Tampered proof should not verify")
+	}
+}
@@ -12,6 +12,8 @@ It has these top-level messages:
 	NodeMetadata
 	FileMap
 	FileMapEntry
+	Checkpoint
+	QuotaLimit
 */
 package messages
 
@@ -39,6 +41,16 @@ type NodeMetadata struct {
 	Mode             *uint32  `protobuf:"varint,25,opt,name=mode" json:"mode,omitempty"`
 	Symlink          []byte   `protobuf:"bytes,26,opt,name=symlink" json:"symlink,omitempty"`
 	Valid            *bool    `protobuf:"varint,27,opt,name=valid" json:"valid,omitempty"`
+	Rdev             *uint32  `protobuf:"varint,28,opt,name=rdev" json:"rdev,omitempty"`
+	Orphan           *bool    `protobuf:"varint,29,opt,name=orphan" json:"orphan,omitempty"`
+	AclAccess        []byte   `protobuf:"bytes,30,opt,name=acl_access" json:"acl_access,omitempty"`
+	AclDefault       []byte   `protobuf:"bytes,31,opt,name=acl_default" json:"acl_default,omitempty"`
+	Quota            []*QuotaLimit `protobuf:"bytes,32,rep,name=quota" json:"quota,omitempty"`
+	Worm             *bool    `protobuf:"varint,33,opt,name=worm" json:"worm,omitempty"`
+	RetainUntil      *uint64  `protobuf:"varint,34,opt,name=retain_until" json:"retain_until,omitempty"`
+	Flags            *uint32  `protobuf:"varint,35,opt,name=flags" json:"flags,omitempty"`
+	Chain            []byte   `protobuf:"bytes,36,opt,name=chain" json:"chain,omitempty"`
+	Checkpoint       *Checkpoint `protobuf:"bytes,37,opt,name=checkpoint" json:"checkpoint,omitempty"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -144,6 +156,76 @@ func (m *NodeMetadata) GetValid() bool {
 	return false
 }
 
+func (m *NodeMetadata) GetRdev() uint32 {
+	if m != nil && m.Rdev != nil {
+		return *m.Rdev
+	}
+	return 0
+}
+
+func (m *NodeMetadata) GetOrphan() bool {
+	if m != nil && m.Orphan != nil {
+		return *m.Orphan
+	}
+	return false
+}
+
+func (m *NodeMetadata) GetAclAccess() []byte {
+	if m != nil {
+		return m.AclAccess
+	}
+	return nil
+}
+
+func (m *NodeMetadata) GetAclDefault() []byte {
+	if m != nil {
+		return m.AclDefault
+	}
+	return nil
+}
+
+func (m *NodeMetadata) GetQuota() []*QuotaLimit {
+	if m != nil {
+		return m.Quota
+	}
+	return nil
+}
+
+func (m *NodeMetadata) GetWorm() bool {
+	if m != nil && m.Worm != nil {
+		return *m.Worm
+	}
+	return false
+}
+
+func (m *NodeMetadata) GetRetainUntil() uint64 {
+	if m != nil && m.RetainUntil != nil {
+		return *m.RetainUntil
+	}
+	return 0
+}
+
+func (m *NodeMetadata) GetFlags() uint32 {
+	if m != nil && m.Flags != nil {
+		return *m.Flags
+	}
+	return 0
+}
+
+func (m *NodeMetadata) GetChain() []byte {
+	if m != nil {
+		return m.Chain
+	}
+	return nil
+}
+
+func (m *NodeMetadata) GetCheckpoint() *Checkpoint {
+	if m != nil {
+		return m.Checkpoint
+	}
+	return nil
+}
+
 type FileMap struct {
 	Entry            []*FileMapEntry `protobuf:"bytes,1,rep,name=entry" json:"entry,omitempty"`
 	XXX_unrecognized []byte          `json:"-"`
@@ -164,6 +246,13 @@ type FileMapEntry struct {
 	Start            *uint64 `protobuf:"varint,1,req,name=start" json:"start,omitempty"`
 	End              *uint64 `protobuf:"varint,2,req,name=end" json:"end,omitempty"`
 	Base             *uint64 `protobuf:"varint,3,req,name=base" json:"base,omitempty"`
+	Segment          *uint64 `protobuf:"varint,4,opt,name=segment" json:"segment,omitempty"`
+	Codec            *uint32 `protobuf:"varint,5,opt,name=codec" json:"codec,omitempty"`
+	Origin           *uint64 `protobuf:"varint,6,opt,name=origin" json:"origin,omitempty"`
+	Length           *uint64 `protobuf:"varint,7,opt,name=length" json:"length,omitempty"`
+	Checksum         []byte  `protobuf:"bytes,8,opt,name=checksum" json:"checksum,omitempty"`
+	Digest           []byte  `protobuf:"bytes,9,opt,name=digest" json:"digest,omitempty"`
+	Size             *uint64 `protobuf:"varint,10,opt,name=size" json:"size,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -191,3 +280,204 @@ func (m *FileMapEntry) GetBase() uint64 {
 	}
 	return 0
 }
+
+func (m *FileMapEntry) GetSegment() uint64 {
+	if m != nil && m.Segment != nil {
+		return *m.Segment
+	}
+	return 0
+}
+
+func (m *FileMapEntry) GetCodec() uint32 {
+	if m != nil && m.Codec != nil {
+		return *m.Codec
+	}
+	return 0
+}
+
+func (m *FileMapEntry) GetOrigin() uint64 {
+	if m != nil && m.Origin != nil {
+		return *m.Origin
+	}
+	return 0
+}
+
+func (m *FileMapEntry) GetLength() uint64 {
+	if m != nil && m.Length != nil {
+		return *m.Length
+	}
+	return 0
+}
+
+func (m *FileMapEntry) GetChecksum() []byte {
+	if m != nil {
+		return m.Checksum
+	}
+	return nil
+}
+
+func (m *FileMapEntry) GetDigest() []byte {
+	if m != nil {
+		return m.Digest
+	}
+	return nil
+}
+
+func (m *FileMapEntry) GetSize() uint64 {
+	if m != nil && m.Size != nil {
+		return *m.Size
+	}
+	return 0
+}
+
+type Checkpoint struct {
+	Offset           *uint64 `protobuf:"varint,1,req,name=offset" json:"offset,omitempty"`
+	Hash             []byte  `protobuf:"bytes,2,req,name=hash" json:"hash,omitempty"`
+	Time             *uint64 `protobuf:"varint,3,opt,name=time" json:"time,omitempty"`
+	Signature        []byte  `protobuf:"bytes,4,opt,name=signature" json:"signature,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Checkpoint) Reset()         { *m = Checkpoint{} }
+func (m *Checkpoint) String() string { return proto.CompactTextString(m) }
+func (*Checkpoint) ProtoMessage()    {}
+
+func (m *Checkpoint) GetOffset() uint64 {
+	if m != nil && m.Offset != nil {
+		return *m.Offset
+	}
+	return 0
+}
+
+func (m *Checkpoint) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *Checkpoint) GetTime() uint64 {
+	if m != nil && m.Time != nil {
+		return *m.Time
+	}
+	return 0
+}
+
+func (m *Checkpoint) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+type QuotaLimit struct {
+	Kind             *uint32 `protobuf:"varint,1,req,name=kind" json:"kind,omitempty"`
+	Id               *uint64 `protobuf:"varint,2,req,name=id" json:"id,omitempty"`
+	Bytes            *uint64 `protobuf:"varint,3,opt,name=bytes" json:"bytes,omitempty"`
+	Inodes           *uint64 `protobuf:"varint,4,opt,name=inodes" json:"inodes,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *QuotaLimit) Reset()         { *m = QuotaLimit{} }
+func (m *QuotaLimit) String() string { return proto.CompactTextString(m) }
+func (*QuotaLimit) ProtoMessage()    {}
+
+func (m *QuotaLimit) GetKind() uint32 {
+	if m != nil && m.Kind != nil {
+		return *m.Kind
+	}
+	return 0
+}
+
+func (m *QuotaLimit) GetId() uint64 {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return 0
+}
+
+func (m *QuotaLimit) GetBytes() uint64 {
+	if m != nil && m.Bytes != nil {
+		return *m.Bytes
+	}
+	return 0
+}
+
+func (m *QuotaLimit) GetInodes() uint64 {
+	if m != nil && m.Inodes != nil {
+		return *m.Inodes
+	}
+	return 0
+}
+
+type AuditRecord struct {
+	Time             *uint64 `protobuf:"varint,1,req,name=time" json:"time,omitempty"`
+	Op               *string `protobuf:"bytes,2,req,name=op" json:"op,omitempty"`
+	Path             *string `protobuf:"bytes,3,opt,name=path" json:"path,omitempty"`
+	Uid              *uint32 `protobuf:"varint,4,opt,name=uid" json:"uid,omitempty"`
+	Gid              *uint32 `protobuf:"varint,5,opt,name=gid" json:"gid,omitempty"`
+	Pid              *uint32 `protobuf:"varint,6,opt,name=pid" json:"pid,omitempty"`
+	Detail           *string `protobuf:"bytes,7,opt,name=detail" json:"detail,omitempty"`
+	Status           *int32  `protobuf:"varint,8,opt,name=status" json:"status,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *AuditRecord) Reset()         { *m = AuditRecord{} }
+func (m *AuditRecord) String() string { return proto.CompactTextString(m) }
+func (*AuditRecord) ProtoMessage()    {}
+
+func (m *AuditRecord) GetTime() uint64 {
+	if m != nil && m.Time != nil {
+		return *m.Time
+	}
+	return 0
+}
+
+func (m *AuditRecord) GetOp() string {
+	if m != nil && m.Op != nil {
+		return *m.Op
+	}
+	return ""
+}
+
+func (m *AuditRecord) GetPath() string {
+	if m != nil && m.Path != nil {
+		return *m.Path
+	}
+	return ""
+}
+
+func (m *AuditRecord) GetUid() uint32 {
+	if m != nil && m.Uid != nil {
+		return *m.Uid
+	}
+	return 0
+}
+
+func (m *AuditRecord) GetGid() uint32 {
+	if m != nil && m.Gid != nil {
+		return *m.Gid
+	}
+	return 0
+}
+
+func (m *AuditRecord) GetPid() uint32 {
+	if m != nil && m.Pid != nil {
+		return *m.Pid
+	}
+	return 0
+}
+
+func (m *AuditRecord) GetDetail() string {
+	if m != nil && m.Detail != nil {
+		return *m.Detail
+	}
+	return ""
+}
+
+func (m *AuditRecord) GetStatus() int32 {
+	if m != nil && m.Status != nil {
+		return *m.Status
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package appendfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/golang/protobuf/proto"
+)
+
+// metadataReader replays the records of a metadata file in order. Each
+// record is a uvarint length followed by a NodeMetadata message, sealed
+// if the volume is encrypted.
+type metadataReader struct {
+	reader *bufio.Reader
+	encryption *encryption
+	// Offset of the next record in the file
+	offset int64
+	// Chain hash of the file up to offset, if reading started at 0
+	hash []byte
+	// The last record read, decrypted
+	record []byte
+}
+
+func newMetadataReader(r io.Reader, offset int64, encryption *encryption) *metadataReader {
+	return &metadataReader{reader: bufio.NewReader(r), encryption: encryption, offset: offset,
+							hash: chainStart()}
+}
+
+func uvarintSize(x uint64) int {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return binary.PutUvarint(buf, x)
+}
+
+// Next returns the next record and its offset in the file, or io.EOF once
+// there are no more records.
+func (r *metadataReader) Next() (*messages.NodeMetadata, int64, error) {
+	start := r.offset
+	msgLen, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return nil, start, err
+	}
+	msgBuf := make([]byte, msgLen)
+	_, err = io.ReadFull(r.reader, msgBuf)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, start, err
+	}
+	r.offset += int64(uvarintSize(msgLen)) + int64(msgLen)
+	prefix := make([]byte, binary.MaxVarintLen64)
+	prefix = prefix[:binary.PutUvarint(prefix, msgLen)]
+	r.hash = chainNext(r.hash, append(prefix, msgBuf...))
+	if r.encryption != nil {
+		msgBuf, err = r.encryption.open(msgBuf, recordPosition(metadataRecord, 0, start))
+		if err != nil {
+			return nil, start, err
+		}
+	}
+	r.record = msgBuf
+	metadata := &messages.NodeMetadata{}
+	err = proto.Unmarshal(msgBuf, metadata)
+	if err != nil {
+		return nil, start, err
+	}
+	return metadata, start, nil
+}
@@ -0,0 +1,349 @@
+package appendfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// With mirrors, the data segments and the metadata file are written to the
+// volume's own paths and to a copy of each, under the same name, in every
+// mirror directory: RAID1 without another layer. Reads go to the first
+// copy that can be read. An extent whose checksum doesn't match on one copy
+// is read from the next that does, and the bad copies are rewritten from
+// it; every repair is recorded in the repair log next to the metadata file.
+// Without Checksums, a damaged copy is only noticed if it can't be read at
+// all. A copy that fails to be written is dropped, and the volume carries
+// on with the others until it is next opened, when every copy is brought
+// up to the longest, as it is after a crash between writing one copy and
+// the next or when a mirror is new. A metadata record that can't be read
+// when the volume is opened is read from the first copy that can, and the
+// volume's own copy is rewritten from there on. The chunk index,
+// checkpoints and audit log are not mirrored.
+
+// mirroredFile is every copy of a log, appended to together. Reads and
+// seeks go to the first copy.
+type mirroredFile struct {
+	paths []string
+	files []*os.File
+}
+
+// openLog opens the copies at paths of a log and returns them and how
+// long the first is.
+func openLog(paths []string, flags int) (*mirroredFile, int64, error) {
+	log := &mirroredFile{}
+	for _, path := range paths {
+		file, err := os.OpenFile(path, flags, 0666)
+		if err != nil {
+			log.Close()
+			return nil, 0, err
+		}
+		log.paths = append(log.paths, path)
+		log.files = append(log.files, file)
+	}
+	info, err := log.files[0].Stat()
+	if err != nil {
+		log.Close()
+		return nil, 0, err
+	}
+	return log, info.Size(), nil
+}
+
+// Write appends data to every copy. It only fails if no copy took all of
+// it; the copies that fail are dropped.
+func (log *mirroredFile) Write(data []byte) (int, error) {
+	var ret error
+	paths, files := log.paths[:0:0], log.files[:0:0]
+	for i, file := range log.files {
+		n, err := file.Write(data)
+		if err == nil && n < len(data) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			fmt.Printf("Mirror fail: dropping %s: %v\n", log.paths[i], err)
+			file.Close()
+			ret = err
+			continue
+		}
+		paths, files = append(paths, log.paths[i]), append(files, file)
+	}
+	log.paths, log.files = paths, files
+	if len(files) == 0 {
+		return 0, ret
+	}
+	return len(data), nil
+}
+
+func (log *mirroredFile) Read(data []byte) (int, error) {
+	if len(log.files) == 0 {
+		return 0, errors.New("no copy of the log is left")
+	}
+	return log.files[0].Read(data)
+}
+
+func (log *mirroredFile) Seek(offset int64, whence int) (int64, error) {
+	if len(log.files) == 0 {
+		return 0, errors.New("no copy of the log is left")
+	}
+	return log.files[0].Seek(offset, whence)
+}
+
+func (log *mirroredFile) Sync() error {
+	var ret error
+	for _, file := range log.files {
+		if err := file.Sync(); err != nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+func (log *mirroredFile) Close() error {
+	var ret error
+	for _, file := range log.files {
+		if err := file.Close(); err != nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// copies returns where the copies of the log at path are, its own first.
+func (fs *AppendFS) copies(path string) []string {
+	paths := []string{path}
+	for _, mirror := range fs.mirrors {
+		paths = append(paths, filepath.Join(mirror, filepath.Base(path)))
+	}
+	return paths
+}
+
+func (fs *AppendFS) segmentCopies(segment uint64) []string {
+	return fs.copies(fs.segmentPath(segment))
+}
+
+func (fs *AppendFS) checkMirrors() error {
+	for _, mirror := range fs.mirrors {
+		info, err := os.Stat(mirror)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("mirror %s is not a directory", mirror)
+		}
+		for _, path := range []string{fs.dataFilePath, fs.metadataFilePath} {
+			if filepath.Clean(mirror) == filepath.Dir(path) {
+				return fmt.Errorf("mirror %s holds the volume itself", mirror)
+			}
+		}
+	}
+	return nil
+}
+
+// listSegmentCopies returns the segments any copy of the data has, in
+// order.
+func (fs *AppendFS) listSegmentCopies() ([]uint64, error) {
+	seen := make(map[uint64]bool)
+	segments := make([]uint64, 0)
+	for _, path := range fs.copies(fs.dataFilePath) {
+		found, err := listSegmentFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, segment := range found {
+			if !seen[segment] {
+				seen[segment] = true
+				segments = append(segments, segment)
+			}
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// syncMirrors brings every copy of every log up to the longest.
+func (fs *AppendFS) syncMirrors() error {
+	if len(fs.mirrors) == 0 {
+		return nil
+	}
+	segments, err := fs.listSegmentCopies()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := syncCopies(fs.segmentCopies(segment)); err != nil {
+			return err
+		}
+	}
+	return syncCopies(fs.copies(fs.metadataFilePath))
+}
+
+// syncCopies appends to each copy of a log what the longest has beyond it.
+func syncCopies(paths []string) error {
+	sizes := make([]int64, len(paths))
+	longest := -1
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err == nil {
+			sizes[i] = info.Size()
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && (longest < 0 || sizes[i] > sizes[longest]) {
+			longest = i
+		}
+	}
+	if longest < 0 {
+		return nil
+	}
+	source, err := os.Open(paths[longest])
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	for i, path := range paths {
+		if sizes[i] == sizes[longest] {
+			continue
+		}
+		fmt.Printf("Bringing %s up to %s\n", path, paths[longest])
+		file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, io.NewSectionReader(source, sizes[i], sizes[longest] - sizes[i]))
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The repair log is a line of text for every extent rewritten.
+func (fs *AppendFS) repairLogPath() string {
+	return fs.metadataFilePath + ".repairs"
+}
+
+// repair rewrites the blob at pos in segment in each of the copies bad
+// with good, which was read from copy from.
+func (fs *AppendFS) repair(segment uint64, pos int64, good []byte, from int, bad []int) {
+	if fs.follower || len(bad) == 0 {
+		return
+	}
+	paths := fs.segmentCopies(segment)
+	source := "the cold store"
+	if from < len(paths) {
+		source = paths[from]
+	}
+	for _, i := range bad {
+		err := rewrite(paths[i], pos, good)
+		fs.logRepair(fmt.Sprintf("segment %d", segment), pos, len(good), paths[i], source, err)
+	}
+}
+
+// logRepair records the rewriting of length bytes at pos of what in path
+// from source, and whether it failed.
+func (fs *AppendFS) logRepair(what string, pos int64, length int, path string, source string, err error) {
+	result := "repaired"
+	if err != nil {
+		result = fmt.Sprintf("repair failed: %v", err)
+	}
+	line := fmt.Sprintf("%s %s at %d, %d bytes: %s from %s: %s\n",
+						time.Now().Format(time.RFC3339), what, pos, length,
+						path, source, result)
+	fmt.Print(line)
+	fs.repairMutex.Lock()
+	err = appendLine(fs.repairLogPath(), line)
+	fs.repairMutex.Unlock()
+	if err != nil {
+		fmt.Printf("Repair log fail: %v\n", err)
+	}
+}
+
+// repairMetadata rewrites the metadata file from start, where a record
+// can't be read, to the end with the first other copy whose records from
+// there on can all be read and chain on from hash, the chain hash up to
+// start. It returns whether it did.
+func (fs *AppendFS) repairMetadata(start int64, hash []byte) bool {
+	if fs.follower {
+		return false
+	}
+	paths := fs.copies(fs.metadataFilePath)
+	for _, path := range paths[1:] {
+		good, err := readRecordsFrom(path, start, hash, fs.encryption)
+		if err != nil {
+			fmt.Printf("Mirror fail: %s at %d: %v\n", path, start, err)
+			continue
+		}
+		err = rewrite(paths[0], start, good)
+		fs.logRepair("metadata", start, len(good), paths[0], path, err)
+		return err == nil
+	}
+	return false
+}
+
+// readRecordsFrom returns the bytes of the metadata file at path from
+// start, which must all be whole records that can be read and that chain
+// on from hash.
+func readRecordsFrom(path string, start int64, hash []byte, encryption *encryption) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) <= start {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data = data[start:]
+	reader := newMetadataReader(bytes.NewReader(data), start, encryption)
+	reader.hash = hash
+	for {
+		prev := reader.hash
+		metadata, _, err := reader.Next()
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if metadata.Chain != nil && !bytes.Equal(metadata.Chain, prev) {
+			return nil, errBrokenChain
+		}
+	}
+}
+
+func rewrite(path string, pos int64, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(data, pos)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func appendLine(path string, line string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(line)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package appendfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestMetadataRepairedFromMirror(t *testing.T) {
+	dir, mirror := t.TempDir(), t.TempDir()
+	options := NewOptions()
+	// So that any damage fails authentication
+	options.EncryptionKey = testKey(1)
+	options.Mirrors = []string{mirror}
+	fs := openTestVolume(t, dir, options)
+	writeTestFile(t, fs, "file", []byte("on both copies"))
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "metadata")
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := newEncryption(testKey(1))
+	reader := newMetadataReader(bytes.NewReader(stored), 0, e)
+	if _, _, err = reader.Next(); err != nil {
+		t.Fatal(err)
+	}
+	// The last byte of the first record
+	stored[reader.offset - 1] ^= 1
+	if err = os.WriteFile(path, stored, 0666); err != nil {
+		t.Fatal(err)
+	}
+	fs = openTestVolume(t, dir, options)
+	defer fs.Close()
+	if got := string(readTestFile(t, fs, "file", 14)); got != "on both copies" {
+		t.Fatalf("Read %q, not %q", got, "on both copies")
+	}
+	repaired, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := os.ReadFile(filepath.Join(mirror, "metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(repaired, good) {
+		t.Fatalf("The metadata file wasn't rewritten from the mirror")
+	}
+	repairs, err := os.ReadFile(filepath.Join(dir, "metadata.repairs"))
+	if err != nil || !strings.Contains(string(repairs), "metadata at 0") {
+		t.Fatalf("The repair wasn't logged: %q, %v", repairs, err)
+	}
+}
+
+func TestCompactSegmentOnlyOnMirror(t *testing.T) {
+	dir, mirror := t.TempDir(), t.TempDir()
+	options := NewOptions()
+	options.SegmentSize = 1
+	options.Mirrors = []string{mirror}
+	fs := openTestVolume(t, dir, options)
+	defer fs.Close()
+	node := writeTestFile(t, fs, "file", []byte("overwritten"))
+	if code := node.Truncate(nil, 0, &fuse.Context{}); code != fuse.OK {
+		t.Fatalf("Truncate: %v", code)
+	}
+	writeTestFile(t, fs, "last", []byte("seals the rest"))
+	// The volume's own copy of the dead segment is lost
+	if err := os.Remove(fs.segmentPath(0)); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := fs.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != 0 {
+		t.Fatalf("Compact removed segments %v, not 0", removed)
+	}
+	if _, err = os.Stat(filepath.Join(mirror, "data.000000")); !os.IsNotExist(err) {
+		t.Fatalf("The mirror's copy of segment 0 is still there: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package appendfs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestMknod(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestVolume(t, dir, nil)
+	// makedev(1, 3), /dev/null
+	null := uint32(1 << 8 | 3)
+	nodes := []struct {
+		name string
+		mode uint32
+		dev uint32
+		rdev uint32
+	}{
+		{"fifo", syscall.S_IFIFO | 0644, null, 0},
+		{"socket", syscall.S_IFSOCK | 0755, null, 0},
+		{"char", syscall.S_IFCHR | 0666, null, null},
+		{"block", syscall.S_IFBLK | 0660, 8 << 8, 8 << 8},
+	}
+	for _, n := range nodes {
+		if _, code := fs.Root().Mknod(n.name, n.mode, n.dev, rootCaller); code != fuse.OK {
+			t.Fatalf("Mknod %s: %v", n.name, code)
+		}
+	}
+	if _, code := fs.Root().Mknod("user", syscall.S_IFCHR | 0666, null, ownerCaller); code != fuse.EPERM {
+		t.Fatalf("Mknod of a device by a user: %v, not EPERM", code)
+	}
+	if _, code := fs.Root().Mknod("dir", syscall.S_IFDIR | 0755, 0, rootCaller); code != fuse.EINVAL {
+		t.Fatalf("Mknod of a directory: %v, not EINVAL", code)
+	}
+	if _, code := fs.Root().Mknod("fifo", syscall.S_IFIFO | 0644, 0, rootCaller); code != fuse.Status(syscall.EEXIST) {
+		t.Fatalf("Mknod over an existing name: %v, not EEXIST", code)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs = openTestVolume(t, dir, nil)
+	defer fs.Close()
+	for _, n := range nodes {
+		node := fs.Lookup(n.name)
+		if node == nil {
+			t.Fatalf("%s is gone after remounting", n.name)
+		}
+		var attr fuse.Attr
+		node.GetAttr(&attr, nil, rootCaller)
+		if attr.Mode != n.mode || attr.Rdev != n.rdev {
+			t.Errorf("%s has mode %o and rdev %d after remounting, not %o and %d", n.name,
+				attr.Mode, attr.Rdev, n.mode, n.rdev)
+		}
+	}
+}
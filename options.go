@@ -0,0 +1,124 @@
+package appendfs
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"time"
+)
+
+type SyncPolicy int
+
+const (
+	// fsync and fdatasync force the data file and then the metadata file
+	// to stable storage before returning.
+	SyncStrict SyncPolicy = iota
+	// fsync only records the FileMap; both files are forced to stable
+	// storage every SyncInterval.
+	SyncPeriodic
+	// Nothing is ever explicitly forced to stable storage, except the
+	// data file when the volume is closed, if it has dedup enabled, so the
+	// chunk index can be written.
+	SyncUnsafe
+)
+
+func (policy SyncPolicy) String() string {
+	switch policy {
+	case SyncStrict:
+		return "strict"
+	case SyncPeriodic:
+		return "periodic"
+	case SyncUnsafe:
+		return "unsafe"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(policy))
+}
+
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "strict":
+		return SyncStrict, nil
+	case "periodic":
+		return SyncPeriodic, nil
+	case "unsafe":
+		return SyncUnsafe, nil
+	}
+	return SyncStrict, fmt.Errorf("unknown sync policy %q", name)
+}
+
+type Options struct {
+	SyncPolicy SyncPolicy
+	// Only used with SyncPeriodic
+	SyncInterval time.Duration
+	// Size at which the data log moves on to a new segment file
+	SegmentSize int
+	// How newly written extents are compressed
+	Compression Codec
+	// If set, every record in both logs is encrypted with this 32 byte key
+	EncryptionKey []byte
+	// Store each distinct chunk of written data only once
+	Dedup bool
+	// The kernel checks permissions, because the volume is mounted with
+	// the default_permissions option
+	DefaultPermissions bool
+	// If set, the most bytes the volume may take up on disk
+	Capacity int64
+	// Commit files to WORM storage when they are closed after writing,
+	// retaining them for WormRetention
+	Worm bool
+	WormRetention time.Duration
+	// If set, the metadata file is signed with this key every
+	// CheckpointInterval and on close
+	SigningKey ed25519.PrivateKey
+	CheckpointInterval time.Duration
+	// Store a checksum with every extent and check it on read
+	Checksums bool
+	// Record a digest of every extent, so files can be proven, see proof.go
+	Proofs bool
+	// If set, every change to the filesystem is recorded in this file, see
+	// audit.go
+	AuditLog string
+	// Mount the volume read-only and keep up with the process writing it,
+	// looking for new records every FollowInterval, see follower.go
+	Follow bool
+	FollowInterval time.Duration
+	// Directories that each hold another copy of the data segments and
+	// the metadata file, see mirror.go
+	Mirrors []string
+	// If set, sealed data segments not written to for ColdAfter are moved
+	// to ColdStore, looking every TierInterval, and up to ColdCacheSize
+	// bytes of what is read back from it are cached, see tiering.go
+	ColdStore ObjectStore
+	ColdAfter time.Duration
+	TierInterval time.Duration
+	ColdCacheSize int64
+}
+
+func NewOptions() *Options {
+	return &Options{SyncPolicy: SyncStrict, SyncInterval: 5 * time.Second,
+					SegmentSize: 64 << 20, CheckpointInterval: time.Minute,
+					FollowInterval: time.Second, ColdAfter: 24 * time.Hour,
+					TierInterval: time.Minute, ColdCacheSize: 256 << 20}
+}
+
+// check returns an error if the segment size, or an interval that
+// something is done every interval of, isn't positive.
+func (options *Options) check() error {
+	if options.SegmentSize <= 0 {
+		return fmt.Errorf("segment size must be positive, not %d", options.SegmentSize)
+	}
+	intervals := []struct {
+		name string
+		used bool
+		interval time.Duration
+	}{
+		{"sync", options.SyncPolicy == SyncPeriodic, options.SyncInterval},
+		{"follow", options.Follow, options.FollowInterval},
+		{"tier", options.ColdStore != nil && !options.Follow, options.TierInterval},
+	}
+	for _, i := range intervals {
+		if i.used && i.interval <= 0 {
+			return fmt.Errorf("%s interval must be positive, not %v", i.name, i.interval)
+		}
+	}
+	return nil
+}
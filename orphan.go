@@ -0,0 +1,76 @@
+package appendfs
+
+import (
+	"fmt"
+
+	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/golang/protobuf/proto"
+)
+
+// A file that is unlinked while it is still open becomes an orphan: it is
+// gone from its directory, but open handles keep reading and writing it
+// until the last one is released. The metadata file records the orphan so
+// that one left behind by a crash is reclaimed on the next mount.
+
+func (node *AppendFSNode) opened() {
+	node.metadataMutex.Lock()
+	node.openCount += 1
+	node.metadataMutex.Unlock()
+}
+
+func (node *AppendFSNode) released() {
+	node.metadataMutex.Lock()
+	node.openCount -= 1
+	reclaim := node.orphan && node.openCount == 0
+	node.metadataMutex.Unlock()
+	if reclaim {
+		err := node.fs.reclaimNode(node.nodeId)
+		if err != nil {
+			fmt.Println(err)
+		}
+		node.fs.forgetOrphan(node)
+	}
+}
+
+// removeNode is called once node has no names left. It becomes an orphan
+// if it is still open and is reclaimed otherwise.
+func (fs *AppendFS) removeNode(node *AppendFSNode) error {
+	node.metadataMutex.Lock()
+	node.chargeNode(-int64(node.attr.Size), -1)
+	node.orphan = node.openCount > 0
+	orphan := node.orphan
+	node.metadataMutex.Unlock()
+	if !orphan {
+		fs.forgetNode(node)
+		return fs.reclaimNode(node.nodeId)
+	}
+	fs.nodesMutex.Lock()
+	fs.orphans[node.nodeId] = node
+	fs.nodesMutex.Unlock()
+	metadata := &messages.NodeMetadata{NodeId:&node.nodeId, Orphan:proto.Bool(true),
+										Nlink:proto.Uint32(0)}
+	return fs.AppendMetadata(metadata)
+}
+
+func (fs *AppendFS) forgetOrphan(node *AppendFSNode) {
+	fs.nodesMutex.Lock()
+	delete(fs.orphans, node.nodeId)
+	delete(fs.nodes, node.nodeId)
+	fs.nodesMutex.Unlock()
+}
+
+func (fs *AppendFS) reclaimNode(nodeId uint64) error {
+	metadata := &messages.NodeMetadata{NodeId:&nodeId, Valid:proto.Bool(false)}
+	return fs.AppendMetadata(metadata)
+}
+
+// Orphans returns the files that are unlinked but still open.
+func (fs *AppendFS) Orphans() []*AppendFSNode {
+	fs.nodesMutex.RLock()
+	out := make([]*AppendFSNode, 0, len(fs.orphans))
+	for _, node := range fs.orphans {
+		out = append(out, node)
+	}
+	fs.nodesMutex.RUnlock()
+	return out
+}
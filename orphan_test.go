@@ -0,0 +1,108 @@
+package appendfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// openOrphan writes name, opens it and unlinks it, returning the handle.
+func openOrphan(t *testing.T, fs *AppendFS, name string, data []byte) (*AppendFSNode, nodefs.File) {
+	node := writeTestFile(t, fs, name, data)
+	file, code := node.Open(uint32(os.O_RDWR), rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Open %s: %v", name, code)
+	}
+	if code = fs.Root().Unlink(name, rootCaller); code != fuse.OK {
+		t.Fatalf("Unlink %s: %v", name, code)
+	}
+	if fs.Root().Inode().GetChild(name) != nil {
+		t.Fatalf("%s is still in its directory", name)
+	}
+	return node, file
+}
+
+func metadataSize(t *testing.T, dir string) int64 {
+	info, err := os.Stat(filepath.Join(dir, "metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestOrphanUsableUntilReleased(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestVolume(t, dir, nil)
+	node, file := openOrphan(t, fs, "file", []byte("unlinked"))
+	if _, code := file.Write([]byte(" but open"), 8); code != fuse.OK {
+		t.Fatalf("Write to an orphan: %v", code)
+	}
+	dest := make([]byte, 17)
+	result, code := file.Read(dest, 0)
+	if code != fuse.OK {
+		t.Fatalf("Read an orphan: %v", code)
+	}
+	if got, _ := result.Bytes(dest); string(got) != "unlinked but open" {
+		t.Fatalf("Read %q from an orphan, not %q", got, "unlinked but open")
+	}
+	if orphans := fs.Orphans(); len(orphans) != 1 || orphans[0] != node {
+		t.Fatalf("Orphans %v, not the unlinked file", orphans)
+	}
+	file.Flush()
+	file.Release()
+	if len(fs.Orphans()) != 0 || fs.Node(node.nodeId) != nil {
+		t.Fatal("Orphan is still there after the last Release")
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	size := metadataSize(t, dir)
+	fs = openTestVolume(t, dir, nil)
+	defer fs.Close()
+	if fs.Node(node.nodeId) != nil {
+		t.Fatal("Reclaimed orphan is back after remounting")
+	}
+	if metadataSize(t, dir) != size {
+		t.Fatal("Remounting reclaimed an orphan that was already reclaimed")
+	}
+}
+
+func TestOrphanReclaimedAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestVolume(t, dir, nil)
+	node, _ := openOrphan(t, fs, "file", []byte("unlinked"))
+	// Crash with the handle still open
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	size := metadataSize(t, dir)
+	// A follower leaves it for the volume's own mount
+	options := NewOptions()
+	options.Follow = true
+	follower := openTestVolume(t, dir, options)
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if metadataSize(t, dir) != size {
+		t.Fatal("A follower reclaimed the orphan")
+	}
+	fs = openTestVolume(t, dir, nil)
+	if fs.Node(node.nodeId) != nil || len(fs.Orphans()) != 0 {
+		t.Fatal("Orphan is still there after remounting")
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if metadataSize(t, dir) == size {
+		t.Fatal("Remounting didn't record reclaiming the orphan")
+	}
+	size = metadataSize(t, dir)
+	fs = openTestVolume(t, dir, nil)
+	defer fs.Close()
+	if metadataSize(t, dir) != size {
+		t.Fatal("The orphan was reclaimed twice")
+	}
+}
@@ -0,0 +1,190 @@
+package appendfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Permission checks follow POSIX: the owner bits apply to the owner, the
+// group bits to members of the file's group (supplementary groups
+// included), and the other bits to everyone else. Root may read and write
+// anything, and execute anything with at least one execute bit set. A
+// node with an access ACL is checked against the ACL instead, see
+// posixacl.go.
+//
+// A nil context means the call came from inside appendfs and is always
+// allowed. When the volume is mounted with DefaultPermissions the kernel
+// does all of this itself and these checks are skipped.
+
+// callerGroups returns the supplementary groups of the calling process.
+func callerGroups(context *fuse.Context) []uint32 {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", context.Pid))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		groups := make([]uint32, 0)
+		for _, field := range strings.Fields(line[len("Groups:"):]) {
+			gid, err := strconv.ParseUint(field, 10, 32)
+			if err == nil {
+				groups = append(groups, uint32(gid))
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+func inGroup(context *fuse.Context, gid uint32) bool {
+	if context.Gid == gid {
+		return true
+	}
+	for _, group := range callerGroups(context) {
+		if group == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// permits reports whether the caller has all of mode, a combination of
+// R_OK, W_OK and X_OK, on node. The caller must hold metadataMutex.
+func (node *AppendFSNode) permits(mode uint32, context *fuse.Context) bool {
+	attrMode := node.attr.Mode
+	if context.Uid == 0 {
+		permitted := uint32(fuse.R_OK | fuse.W_OK)
+		if node.attr.IsDir() || attrMode & (syscall.S_IXUSR | syscall.S_IXGRP | syscall.S_IXOTH) != 0 {
+			permitted |= fuse.X_OK
+		}
+		return mode & permitted == mode
+	}
+	if node.aclAccess != nil {
+		var groups []uint32
+		member := func(gid uint32) bool {
+			if context.Gid == gid {
+				return true
+			}
+			if groups == nil {
+				groups = callerGroups(context)
+			}
+			for _, group := range groups {
+				if group == gid {
+					return true
+				}
+			}
+			return false
+		}
+		return node.aclAccess.Allows(mode, context.Uid, member, node.attr.Uid, node.attr.Gid)
+	}
+	var permitted uint32
+	if context.Uid == node.attr.Uid {
+		permitted = (attrMode >> 6) & 7
+	} else if inGroup(context, node.attr.Gid) {
+		permitted = (attrMode >> 3) & 7
+	} else {
+		permitted = attrMode & 7
+	}
+	return mode & permitted == mode
+}
+
+// checkAccess returns EACCES unless the caller has all of mode on node.
+func (node *AppendFSNode) checkAccess(mode uint32, context *fuse.Context) fuse.Status {
+	if context == nil || !node.fs.checkPermissions {
+		return fuse.OK
+	}
+	node.metadataMutex.RLock()
+	permitted := node.permits(mode, context)
+	node.metadataMutex.RUnlock()
+	if !permitted {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// checkOwner returns EPERM unless the caller owns node or is root.
+func (node *AppendFSNode) checkOwner(context *fuse.Context) fuse.Status {
+	if context == nil || !node.fs.checkPermissions || context.Uid == 0 {
+		return fuse.OK
+	}
+	node.metadataMutex.RLock()
+	owner := node.attr.Uid
+	node.metadataMutex.RUnlock()
+	if context.Uid != owner {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// checkRemove checks that the caller may remove child from the directory
+// parent, including the sticky bit rule that only the owner of the file
+// or of the directory may remove entries from a sticky directory, and that
+// neither is append-only or immutable.
+func (parent *AppendFSNode) checkRemove(child *AppendFSNode, context *fuse.Context) fuse.Status {
+	if code := parent.checkFlags(flagImmutable | flagAppend); code != fuse.OK {
+		return code
+	}
+	if code := child.checkFlags(flagImmutable | flagAppend); code != fuse.OK {
+		return code
+	}
+	code := parent.checkAccess(fuse.W_OK | fuse.X_OK, context)
+	if code != fuse.OK || context == nil || !parent.fs.checkPermissions || context.Uid == 0 {
+		return code
+	}
+	parent.metadataMutex.RLock()
+	sticky, parentOwner := parent.attr.Mode & syscall.S_ISVTX != 0, parent.attr.Uid
+	parent.metadataMutex.RUnlock()
+	if !sticky || context.Uid == parentOwner {
+		return fuse.OK
+	}
+	child.metadataMutex.RLock()
+	childOwner := child.attr.Uid
+	child.metadataMutex.RUnlock()
+	if context.Uid != childOwner {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// openModes translates open(2) flags into the access they need.
+func openModes(flags uint32) uint32 {
+	var mode uint32
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mode = fuse.R_OK
+	case syscall.O_WRONLY:
+		mode = fuse.W_OK
+	default:
+		mode = fuse.R_OK | fuse.W_OK
+	}
+	if flags & syscall.O_TRUNC != 0 {
+		mode |= fuse.W_OK
+	}
+	return mode
+}
+
+// killPrivileges clears setuid, and setgid if the group may execute, as
+// Linux does when a file is written or changes owner. The caller must
+// hold metadataMutex. It reports whether the mode changed.
+func (node *AppendFSNode) killPrivileges() bool {
+	mode := node.attr.Mode
+	if !node.attr.IsRegular() {
+		return false
+	}
+	node.attr.Mode &^= syscall.S_ISUID
+	if node.attr.Mode & syscall.S_IXGRP != 0 {
+		node.attr.Mode &^= syscall.S_ISGID
+	}
+	return node.attr.Mode != mode
+}
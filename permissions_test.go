@@ -0,0 +1,224 @@
+package appendfs
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+var (
+	rootCaller = &fuse.Context{}
+	ownerCaller = &fuse.Context{Owner: fuse.Owner{Uid: 1000, Gid: 100}}
+	groupCaller = &fuse.Context{Owner: fuse.Owner{Uid: 2000, Gid: 100}}
+	otherCaller = &fuse.Context{Owner: fuse.Owner{Uid: 3000, Gid: 300}}
+)
+
+// ownedTestFile writes name and hands it to ownerCaller with mode.
+func ownedTestFile(t *testing.T, fs *AppendFS, name string, mode uint32) *AppendFSNode {
+	node := writeTestFile(t, fs, name, []byte("contents"))
+	if code := node.Chown(nil, ownerCaller.Uid, ownerCaller.Gid, rootCaller); code != fuse.OK {
+		t.Fatalf("Chown %s: %v", name, code)
+	}
+	if code := node.Chmod(nil, mode, rootCaller); code != fuse.OK {
+		t.Fatalf("Chmod %s: %v", name, code)
+	}
+	return node
+}
+
+func testMode(node *AppendFSNode) uint32 {
+	node.metadataMutex.RLock()
+	defer node.metadataMutex.RUnlock()
+	return node.attr.Mode &^ syscall.S_IFMT
+}
+
+func TestOpenPermissions(t *testing.T) {
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	node := ownedTestFile(t, fs, "file", 0640)
+	cases := []struct {
+		name string
+		context *fuse.Context
+		flags int
+		code fuse.Status
+	}{
+		{"owner", ownerCaller, os.O_RDWR, fuse.OK},
+		{"group member", groupCaller, os.O_RDONLY, fuse.OK},
+		{"group member", groupCaller, os.O_WRONLY, fuse.EACCES},
+		{"other", otherCaller, os.O_RDONLY, fuse.EACCES},
+		{"root", rootCaller, os.O_RDWR, fuse.OK},
+		{"group member", groupCaller, os.O_RDONLY | os.O_TRUNC, fuse.EACCES},
+	}
+	for _, c := range cases {
+		file, code := node.Open(uint32(c.flags), c.context)
+		if code != c.code {
+			t.Errorf("Open(%o) as %s: %v, not %v", c.flags, c.name, code, c.code)
+		}
+		if file != nil {
+			file.Release()
+		}
+	}
+	// Root may only execute what someone may execute
+	if code := node.Access(fuse.X_OK, rootCaller); code != fuse.EACCES {
+		t.Errorf("Root executing a file with no execute bits: %v, not EACCES", code)
+	}
+	node.Chmod(nil, 0641, rootCaller)
+	if code := node.Access(fuse.X_OK, rootCaller); code != fuse.OK {
+		t.Errorf("Root executing a file others may execute: %v", code)
+	}
+}
+
+func TestSupplementaryGroups(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to start a process in other groups")
+	}
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	node := ownedTestFile(t, fs, "file", 0640)
+	// The groups are read from the caller's process
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{
+		Uid: otherCaller.Uid, Gid: otherCaller.Gid, Groups: []uint32{ownerCaller.Gid}}}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Start a process in group %d: %v", ownerCaller.Gid, err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	context := &fuse.Context{Owner: otherCaller.Owner, Pid: uint32(cmd.Process.Pid)}
+	file, code := node.Open(uint32(os.O_RDONLY), context)
+	if code != fuse.OK {
+		t.Fatalf("Open as a supplementary member of the group: %v", code)
+	}
+	file.Release()
+	if _, code = node.Open(uint32(os.O_WRONLY), context); code != fuse.EACCES {
+		t.Fatalf("Open for writing as a supplementary member of the group: %v, not EACCES", code)
+	}
+}
+
+func TestCreatePermissions(t *testing.T) {
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	inode, code := fs.Root().Mkdir("dir", 0755, rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	dir := inode.Node().(*AppendFSNode)
+	dir.Chown(nil, ownerCaller.Uid, ownerCaller.Gid, rootCaller)
+	if _, _, code = dir.Create("other", uint32(os.O_WRONLY), fuse.S_IFREG | 0644, otherCaller); code != fuse.EACCES {
+		t.Fatalf("Create in someone else's directory: %v, not EACCES", code)
+	}
+	file, inode, code := dir.Create("owner", uint32(os.O_WRONLY), fuse.S_IFREG | 0644, ownerCaller)
+	if code != fuse.OK {
+		t.Fatalf("Create in own directory: %v", code)
+	}
+	file.Release()
+	if uid := inode.Node().(*AppendFSNode).attr.Uid; uid != ownerCaller.Uid {
+		t.Fatalf("Created file is owned by %d, not %d", uid, ownerCaller.Uid)
+	}
+	file, _, code = dir.Create("root", uint32(os.O_WRONLY), fuse.S_IFREG | 0644, rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Create as root: %v", code)
+	}
+	file.Release()
+}
+
+func TestStickyDirectory(t *testing.T) {
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	inode, code := fs.Root().Mkdir("tmp", 01777, rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	dir := inode.Node().(*AppendFSNode)
+	for _, name := range []string{"a", "b", "c"} {
+		file, _, code := dir.Create(name, uint32(os.O_WRONLY), fuse.S_IFREG | 0644, ownerCaller)
+		if code != fuse.OK {
+			t.Fatalf("Create %s: %v", name, code)
+		}
+		file.Release()
+	}
+	if code = dir.Unlink("a", otherCaller); code != fuse.EPERM {
+		t.Fatalf("Unlink someone else's file from a sticky directory: %v, not EPERM", code)
+	}
+	if code = dir.Rename("a", dir, "d", otherCaller); code != fuse.EPERM {
+		t.Fatalf("Rename someone else's file in a sticky directory: %v, not EPERM", code)
+	}
+	if code = dir.Unlink("a", ownerCaller); code != fuse.OK {
+		t.Fatalf("Unlink own file from a sticky directory: %v", code)
+	}
+	if code = dir.Rename("b", dir, "d", ownerCaller); code != fuse.OK {
+		t.Fatalf("Rename own file in a sticky directory: %v", code)
+	}
+	if code = dir.Unlink("c", rootCaller); code != fuse.OK {
+		t.Fatalf("Unlink from a sticky directory as root: %v", code)
+	}
+	// Without the sticky bit anyone who may write the directory may
+	// remove from it
+	dir.Chmod(nil, 0777, rootCaller)
+	if code = dir.Unlink("d", otherCaller); code != fuse.OK {
+		t.Fatalf("Unlink from a directory that isn't sticky: %v", code)
+	}
+}
+
+func TestWriteClearsPrivileges(t *testing.T) {
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	node := ownedTestFile(t, fs, "file", 06755)
+	// Root's writes leave them alone
+	file, code := node.Open(uint32(os.O_WRONLY), rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Open as root: %v", code)
+	}
+	file.Write([]byte("root"), 0)
+	file.Release()
+	if mode := testMode(node); mode != 06755 {
+		t.Fatalf("Mode %o after root wrote, not 6755", mode)
+	}
+	file, code = node.Open(uint32(os.O_WRONLY), ownerCaller)
+	if code != fuse.OK {
+		t.Fatalf("Open as owner: %v", code)
+	}
+	file.Write([]byte("owner"), 0)
+	file.Release()
+	if mode := testMode(node); mode != 0755 {
+		t.Fatalf("Mode %o after the owner wrote, not 755", mode)
+	}
+	// setgid without group execute marks mandatory locking and stays
+	node.Chmod(nil, 06745, rootCaller)
+	file, _ = node.Open(uint32(os.O_WRONLY), ownerCaller)
+	file.Write([]byte("again"), 0)
+	file.Release()
+	if mode := testMode(node); mode != 02745 {
+		t.Fatalf("Mode %o after the owner wrote, not 2745", mode)
+	}
+}
+
+func TestChownClearsPrivileges(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestVolume(t, dir, nil)
+	node := ownedTestFile(t, fs, "file", 06755)
+	if code := node.Chown(nil, otherCaller.Uid, unchangedId, ownerCaller); code != fuse.EPERM {
+		t.Fatalf("Chown to someone else as owner: %v, not EPERM", code)
+	}
+	if code := node.Chown(nil, otherCaller.Uid, otherCaller.Gid, rootCaller); code != fuse.OK {
+		t.Fatalf("Chown as root: %v", code)
+	}
+	if mode := testMode(node); mode != 0755 {
+		t.Fatalf("Mode %o after chown, not 755", mode)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs = openTestVolume(t, dir, nil)
+	defer fs.Close()
+	node = fs.Root().Inode().GetChild("file").Node().(*AppendFSNode)
+	if mode := testMode(node); mode != 0755 {
+		t.Fatalf("Mode %o after remounting, not 755", mode)
+	}
+	if node.attr.Uid != otherCaller.Uid || node.attr.Gid != otherCaller.Gid {
+		t.Fatalf("Owned by %d:%d after remounting, not %d:%d", node.attr.Uid, node.attr.Gid,
+			otherCaller.Uid, otherCaller.Gid)
+	}
+}
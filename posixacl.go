@@ -0,0 +1,131 @@
+package appendfs
+
+import (
+	"fmt"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/e-tothe-ipi/appendfs/acl"
+	"github.com/e-tothe-ipi/appendfs/messages"
+)
+
+// POSIX ACLs are set and read through the same xattrs as on Linux, so
+// setfacl and getfacl work on a mounted volume. They are kept parsed on
+// the node and persisted with its metadata. As on Linux, an access ACL
+// with only the owner, group and other entries is just a mode, and is
+// stored as one.
+
+const (
+	aclAccessXAttr = "system.posix_acl_access"
+	aclDefaultXAttr = "system.posix_acl_default"
+)
+
+func isACLXAttr(attr string) bool {
+	return attr == aclAccessXAttr || attr == aclDefaultXAttr
+}
+
+// aclBytes encodes an ACL for NodeMetadata, where an empty value records
+// that the ACL was removed.
+func aclBytes(a acl.ACL) []byte {
+	if a == nil {
+		return []byte{}
+	}
+	return a.Marshal()
+}
+
+func parseStoredACL(data []byte) acl.ACL {
+	if len(data) == 0 {
+		return nil
+	}
+	a, err := acl.Parse(data)
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	return a
+}
+
+func (node *AppendFSNode) getACLXAttr(attr string) ([]byte, fuse.Status) {
+	node.metadataMutex.RLock()
+	a := node.aclAccess
+	if attr == aclDefaultXAttr {
+		a = node.aclDefault
+	}
+	node.metadataMutex.RUnlock()
+	if a == nil {
+		return nil, fuse.ENODATA
+	}
+	return a.Marshal(), fuse.OK
+}
+
+// setACLXAttr sets or, if data is nil, removes one of the node's ACLs.
+// Only the owner may change them.
+func (node *AppendFSNode) setACLXAttr(attr string, data []byte, context *fuse.Context) fuse.Status {
+	if code := node.checkOwner(context); code != fuse.OK {
+		return code
+	}
+	if code := node.checkFlags(flagImmutable); code != fuse.OK {
+		return code
+	}
+	var a acl.ACL
+	if data != nil {
+		var err error
+		a, err = acl.Parse(data)
+		if err != nil {
+			return fuse.EINVAL
+		}
+	}
+	node.metadataMutex.Lock()
+	if attr == aclDefaultXAttr {
+		if !node.attr.IsDir() {
+			node.metadataMutex.Unlock()
+			return fuse.EACCES
+		}
+		if a == nil && node.aclDefault == nil {
+			node.metadataMutex.Unlock()
+			return fuse.ENODATA
+		}
+		node.aclDefault = a
+	} else {
+		if a == nil && node.aclAccess == nil {
+			node.metadataMutex.Unlock()
+			return fuse.ENODATA
+		}
+		if a != nil {
+			node.attr.Mode = node.attr.Mode &^ 0777 | a.Mode()
+			if len(a) == 3 {
+				a = nil
+			}
+		}
+		node.aclAccess = a
+	}
+	metadata := &messages.NodeMetadata{NodeId:&node.nodeId, Mode:&node.attr.Mode,
+									AclAccess:aclBytes(node.aclAccess),
+									AclDefault:aclBytes(node.aclDefault)}
+	err := node.fs.AppendMetadata(metadata)
+	node.metadataMutex.Unlock()
+	if err != nil {
+		fmt.Println(err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// inheritACL applies the default ACL of parent to a node being created,
+// whose mode must already be set. Directories also inherit the default
+// ACL itself. Symlinks take no ACL, their mode is always 0777.
+func (node *AppendFSNode) inheritACL(parent *AppendFSNode) {
+	parent.metadataMutex.RLock()
+	inherited := parent.aclDefault
+	parent.metadataMutex.RUnlock()
+	if inherited == nil || node.attr.IsSymlink() {
+		return
+	}
+	access := inherited.Inherit(node.attr.Mode)
+	node.attr.Mode = node.attr.Mode &^ 0777 | access.Mode()
+	if len(access) > 3 {
+		node.aclAccess = access
+	}
+	if node.attr.IsDir() {
+		node.aclDefault = inherited
+	}
+}
@@ -0,0 +1,294 @@
+package appendfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/e-tothe-ipi/appendfs/merkle"
+	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/golang/protobuf/proto"
+)
+
+// The metadata log is the list of leaves of a Merkle tree, one per record
+// as it is before encryption, so the root at any offset commits to every
+// FileMap recorded up to there. With proofs enabled every FileMap entry
+// also carries a digest of the extent it maps, which ties the records to
+// the data. A proof that a file had some contents at an offset is then
+// the record of its FileMap and the records naming it and its parents,
+// each with its audit path, plus whatever bytes of its extents the file
+// doesn't cover.
+//
+// Inclusion is all a proof shows: that the file had those contents at some
+// point at or before the offset. A later record may have changed them, or
+// renamed or removed the file, and the proof would still verify.
+
+// The root is the first node NewAppendFS creates
+const rootNodeId = 1
+
+func extentDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return string(sum[:])
+}
+
+// The metadata log was Offset bytes long and held Records records when its
+// tree had root Root
+type MerkleRoot struct {
+	Offset int64
+	Records uint64
+	Root []byte
+}
+
+func (fs *AppendFS) MerkleRoot() MerkleRoot {
+	fs.metadataMutex.RLock()
+	defer fs.metadataMutex.RUnlock()
+	return MerkleRoot{fs.metadataFileOffset, fs.records.Size(), fs.records.Root()}
+}
+
+func (root MerkleRoot) String() string {
+	return fmt.Sprintf("offset: %d\nrecords: %d\nroot: %x\n", root.Offset, root.Records, root.Root)
+}
+
+// ProofRecord is a metadata record and its audit path.
+type ProofRecord struct {
+	Index uint64 `json:"index"`
+	Record []byte `json:"record"`
+	Path [][]byte `json:"path"`
+}
+
+// The bytes of an extent before and after the part a file uses
+type ExtentEdges struct {
+	Prefix []byte `json:"prefix"`
+	Suffix []byte `json:"suffix"`
+}
+
+type FileProof struct {
+	Path string `json:"path"`
+	NodeId uint64 `json:"node_id"`
+	// The metadata log up to Offset holds Records records, whose tree has
+	// root Root
+	Offset int64 `json:"offset"`
+	Records uint64 `json:"records"`
+	Root []byte `json:"root"`
+	Contents ProofRecord `json:"contents"`
+	// The records naming the node and each of its parents below the root
+	Names []ProofRecord `json:"names"`
+	// One for each entry of the FileMap in Contents
+	Edges []ExtentEdges `json:"edges"`
+}
+
+type provenRecord struct {
+	index uint64
+	record []byte
+}
+
+// Prove returns a proof of the contents of the file at path as the
+// metadata log had them at offset, which must be the end of a record, or
+// of the whole log if it is 0. Only files written with proofs enabled can
+// be proven.
+func (fs *AppendFS) Prove(path string, offset int64) (*FileProof, error) {
+	file, err := os.Open(fs.metadataFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := newMetadataReader(file, 0, fs.encryption)
+	leaves := make([][]byte, 0)
+	names := make(map[uint64]provenRecord)
+	contents := make(map[uint64]provenRecord)
+	nodes := make(map[uint64]*messages.NodeMetadata)
+	for offset == 0 || reader.offset < offset {
+		metadata, start, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("record at offset %d: %v", start, err)
+		}
+		leaves = append(leaves, merkle.LeafHash(reader.record))
+		at := provenRecord{uint64(len(leaves) - 1), reader.record}
+		id := metadata.GetNodeId()
+		if metadata.Name != nil {
+			names[id] = at
+		}
+		if metadata.Contents != nil {
+			contents[id] = at
+			metadata.Contents = nil
+		}
+		if current, ok := nodes[id]; ok {
+			proto.Merge(current, metadata)
+		} else {
+			nodes[id] = metadata
+		}
+	}
+	if offset != 0 && reader.offset != offset {
+		return nil, fmt.Errorf("offset %d is not the end of a record", offset)
+	}
+	proof := &FileProof{NodeId: rootNodeId, Offset: reader.offset,
+						Records: uint64(len(leaves)), Root: merkle.Root(leaves)}
+	children := make(map[uint64]map[string]uint64)
+	for id, node := range nodes {
+		if id == volumeRecordId || !node.GetValid() || node.GetOrphan() {
+			continue
+		}
+		if children[node.GetParentNodeId()] == nil {
+			children[node.GetParentNodeId()] = make(map[string]uint64)
+		}
+		children[node.GetParentNodeId()][node.GetName()] = id
+	}
+	components := make([]string, 0)
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		child, ok := children[proof.NodeId][name]
+		if !ok {
+			return nil, fmt.Errorf("%s: no such file at offset %d", path, proof.Offset)
+		}
+		proof.NodeId = child
+		components = append(components, name)
+	}
+	proof.Path = strings.Join(components, "/")
+	for id := proof.NodeId; id != rootNodeId; id = nodes[id].GetParentNodeId() {
+		at, ok := names[id]
+		if !ok {
+			return nil, fmt.Errorf("node %d has no recorded name", id)
+		}
+		proof.Names = append(proof.Names, ProofRecord{at.index, at.record, merkle.Proof(leaves, at.index)})
+	}
+	at, ok := contents[proof.NodeId]
+	if !ok {
+		return nil, fmt.Errorf("%s has no recorded contents at offset %d", path, proof.Offset)
+	}
+	proof.Contents = ProofRecord{at.index, at.record, merkle.Proof(leaves, at.index)}
+	return proof, fs.proveEdges(proof)
+}
+
+// proveEdges reads the parts of the file's extents it doesn't use.
+func (fs *AppendFS) proveEdges(proof *FileProof) error {
+	metadata := &messages.NodeMetadata{}
+	err := proto.Unmarshal(proof.Contents.Record, metadata)
+	if err != nil {
+		return err
+	}
+	segments := fs.newSegmentReader()
+	defer segments.Close()
+	for _, entry := range metadata.GetContents().GetEntry() {
+		fse := segmentEntry(entry)
+		if fse.digest == "" {
+			return fmt.Errorf("%s has data written before proofs were enabled", proof.Path)
+		}
+		var data []byte
+		if fse.length > 0 {
+			data, err = fs.readBlob(segments, fse, fse.size)
+		} else {
+			data = make([]byte, fse.size)
+			_, err = segments.ReadAt(fse.segment, data, int64(fse.base + fse.origin))
+		}
+		if err != nil {
+			return err
+		}
+		lo, hi := usedRange(entry, metadata.GetSize())
+		proof.Edges = append(proof.Edges, ExtentEdges{Prefix: data[:lo], Suffix: data[hi:]})
+	}
+	return nil
+}
+
+// usedRange returns which bytes of the extent entry maps a file of size
+// bytes uses, relative to the extent's origin.
+func usedRange(entry *messages.FileMapEntry, size uint64) (int, int) {
+	lo := int(entry.GetStart() - entry.GetOrigin())
+	end := entry.GetEnd() + 1
+	if end > size {
+		end = size
+	}
+	hi := lo
+	if end > entry.GetStart() {
+		hi += int(end - entry.GetStart())
+	}
+	return lo, hi
+}
+
+func checkRecord(proof *FileProof, record ProofRecord) (*messages.NodeMetadata, error) {
+	if !merkle.Verify(merkle.LeafHash(record.Record), record.Index, proof.Records, record.Path, proof.Root) {
+		return nil, fmt.Errorf("record %d is not in the log", record.Index)
+	}
+	metadata := &messages.NodeMetadata{}
+	return metadata, proto.Unmarshal(record.Record, metadata)
+}
+
+// VerifyProof checks that proof shows the file at proof.Path had exactly
+// content at some point of the metadata log whose tree has the given root.
+// It doesn't show that the file still had it at the end of that log.
+func VerifyProof(proof *FileProof, content []byte, root []byte) error {
+	if !bytes.Equal(proof.Root, root) {
+		return fmt.Errorf("proof is for root %x", proof.Root)
+	}
+	id := proof.NodeId
+	names := make([]string, 0)
+	for _, record := range proof.Names {
+		metadata, err := checkRecord(proof, record)
+		if err != nil {
+			return err
+		}
+		if metadata.GetNodeId() != id {
+			return errors.New("names do not lead from the file to the root")
+		}
+		names = append([]string{metadata.GetName()}, names...)
+		id = metadata.GetParentNodeId()
+	}
+	if id != rootNodeId {
+		return errors.New("names do not lead from the file to the root")
+	}
+	if strings.Join(names, "/") != strings.Trim(proof.Path, "/") {
+		return fmt.Errorf("names lead to %s", strings.Join(names, "/"))
+	}
+	metadata, err := checkRecord(proof, proof.Contents)
+	if err != nil {
+		return err
+	}
+	if metadata.GetNodeId() != proof.NodeId {
+		return errors.New("contents are of another node")
+	}
+	if metadata.GetSize() != uint64(len(content)) {
+		return fmt.Errorf("file was %d bytes long", metadata.GetSize())
+	}
+	entries := metadata.GetContents().GetEntry()
+	if len(entries) != len(proof.Edges) {
+		return errors.New("proof does not cover every extent")
+	}
+	// Bytes no extent maps must be zeros
+	hole := bytes.Repeat([]byte{0}, len(content))
+	for i, entry := range entries {
+		if entry.GetStart() < entry.GetOrigin() || entry.GetEnd() < entry.GetStart() {
+			return fmt.Errorf("extent %d is malformed", i)
+		}
+		lo, hi := usedRange(entry, metadata.GetSize())
+		if len(proof.Edges[i].Prefix) != lo {
+			return fmt.Errorf("extent %d has the wrong prefix", i)
+		}
+		var used []byte
+		if hi > lo {
+			used = content[entry.GetStart():int(entry.GetStart()) + hi - lo]
+			copy(hole[entry.GetStart():], used)
+		}
+		data := bytes.Join([][]byte{proof.Edges[i].Prefix, used, proof.Edges[i].Suffix}, nil)
+		if uint64(len(data)) != entry.GetSize() || extentDigest(data) != string(entry.GetDigest()) {
+			return fmt.Errorf("content at offset %d does not match the log", entry.GetStart())
+		}
+	}
+	if !bytes.Equal(hole, content) {
+		return errors.New("content is not zero where the file has holes")
+	}
+	return nil
+}
+
+// ParseRoot reads a root hash as MerkleRoot's reports print it.
+func ParseRoot(root string) ([]byte, error) {
+	return hex.DecodeString(strings.TrimSpace(root))
+}
@@ -0,0 +1,365 @@
+package appendfs
+
+import (
+	"fmt"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/golang/protobuf/proto"
+)
+
+// Quotas limit the bytes and inodes charged to a uid, a gid or the tree
+// below a directory. A node is charged to its owner, its group and every
+// ancestor directory with a quota, for its size and one inode. Limits are
+// kept in volume records, metadata records with node id 0, while usage is
+// counted from the nodes when the volume is loaded and kept up to date as
+// they change. Files unlinked while open stop counting straight away.
+
+type QuotaKind byte
+
+const (
+	QuotaUser QuotaKind = 'u'
+	QuotaGroup QuotaKind = 'g'
+	QuotaDir QuotaKind = 'd'
+)
+
+// Node id of the records that describe the volume rather than a node
+const volumeRecordId = 0
+
+func (kind QuotaKind) String() string {
+	switch kind {
+	case QuotaUser:
+		return "user"
+	case QuotaGroup:
+		return "group"
+	case QuotaDir:
+		return "dir"
+	}
+	return fmt.Sprintf("QuotaKind(%d)", byte(kind))
+}
+
+func ParseQuotaKind(s string) (QuotaKind, error) {
+	for _, kind := range []QuotaKind{QuotaUser, QuotaGroup, QuotaDir} {
+		if kind.String() == s {
+			return kind, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown quota kind %q", s)
+}
+
+// A Quota is the limits and usage of one uid, gid or directory. Id is the
+// node id for a directory, and a limit of 0 means there is none.
+type Quota struct {
+	Kind QuotaKind
+	Id uint64
+	Bytes uint64
+	Inodes uint64
+	UsedBytes uint64
+	UsedInodes uint64
+}
+
+type quotaKey struct {
+	kind QuotaKind
+	id uint64
+}
+
+type quotaUsage struct {
+	bytes uint64
+	inodes uint64
+}
+
+// quotaKeys returns what a node owned by uid and gid in the directory
+// parentId is charged to. Usage is tracked for every uid and gid but only
+// for directories with a quota. The caller must hold quotaMutex.
+func (fs *AppendFS) quotaKeys(uid uint32, gid uint32, parentId uint64) []quotaKey {
+	keys := []quotaKey{{QuotaUser, uint64(uid)}, {QuotaGroup, uint64(gid)}}
+	for id := parentId; id != volumeRecordId; {
+		if _, ok := fs.quotas[quotaKey{QuotaDir, id}]; ok {
+			keys = append(keys, quotaKey{QuotaDir, id})
+		}
+		parent := fs.Node(id)
+		if parent == nil {
+			break
+		}
+		id = parent.parentNodeId
+	}
+	return keys
+}
+
+// charge adds bytes and inodes, which may be negative, to the usage of
+// keys. The caller must hold quotaMutex.
+func (fs *AppendFS) charge(keys []quotaKey, bytes int64, inodes int64) {
+	for _, key := range keys {
+		usage := fs.usage[key]
+		if usage == nil {
+			usage = &quotaUsage{}
+			fs.usage[key] = usage
+		}
+		usage.bytes = addClamped(usage.bytes, bytes)
+		usage.inodes = addClamped(usage.inodes, inodes)
+	}
+}
+
+func addClamped(x uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > x {
+		return 0
+	}
+	return x + uint64(delta)
+}
+
+// chargeNode updates the usage for a change to node. The caller must hold
+// the node's metadataMutex.
+func (node *AppendFSNode) chargeNode(bytes int64, inodes int64) {
+	if node.orphan || node.fs == nil {
+		return
+	}
+	fs := node.fs
+	fs.quotaMutex.Lock()
+	fs.charge(fs.quotaKeys(node.attr.Uid, node.attr.Gid, node.parentNodeId), bytes, inodes)
+	fs.quotaMutex.Unlock()
+}
+
+// checkQuota returns EDQUOT if charging bytes and inodes more to a node
+// owned by uid and gid in the directory parentId would exceed a limit.
+func (fs *AppendFS) checkQuota(uid uint32, gid uint32, parentId uint64, bytes uint64, inodes uint64) fuse.Status {
+	fs.quotaMutex.Lock()
+	defer fs.quotaMutex.Unlock()
+	return fs.checkKeys(fs.quotaKeys(uid, gid, parentId), bytes, inodes)
+}
+
+// checkKeys is checkQuota for the given keys. The caller must hold
+// quotaMutex.
+func (fs *AppendFS) checkKeys(keys []quotaKey, bytes uint64, inodes uint64) fuse.Status {
+	for _, key := range keys {
+		limit, ok := fs.quotas[key]
+		if !ok {
+			continue
+		}
+		usage := fs.usage[key]
+		if usage == nil {
+			usage = &quotaUsage{}
+		}
+		if (limit.Bytes != 0 && usage.bytes + bytes > limit.Bytes) ||
+			(limit.Inodes != 0 && usage.inodes + inodes > limit.Inodes) {
+			return fuse.Status(syscall.EDQUOT)
+		}
+	}
+	return fuse.OK
+}
+
+// chown moves the usage of node to a new owner and group, failing with
+// EDQUOT if they don't have room for it. The caller must hold the node's
+// metadataMutex.
+func (node *AppendFSNode) chown(uid uint32, gid uint32) fuse.Status {
+	fs := node.fs
+	fs.quotaMutex.Lock()
+	defer fs.quotaMutex.Unlock()
+	added := make([]quotaKey, 0, 2)
+	if uid != node.attr.Uid {
+		added = append(added, quotaKey{QuotaUser, uint64(uid)})
+	}
+	if gid != node.attr.Gid {
+		added = append(added, quotaKey{QuotaGroup, uint64(gid)})
+	}
+	if !node.orphan {
+		if code := fs.checkKeys(added, node.attr.Size, 1); code != fuse.OK {
+			return code
+		}
+		size := int64(node.attr.Size)
+		fs.charge(fs.quotaKeys(node.attr.Uid, node.attr.Gid, node.parentNodeId), -size, -1)
+		fs.charge(fs.quotaKeys(uid, gid, node.parentNodeId), size, 1)
+	}
+	node.attr.Uid = uid
+	node.attr.Gid = gid
+	return fuse.OK
+}
+
+// checkCreate checks that the caller may create a node in parent.
+func (parent *AppendFSNode) checkCreate(context *fuse.Context) fuse.Status {
+	if code := parent.checkFlags(flagImmutable); code != fuse.OK {
+		return code
+	}
+	var uid, gid uint32
+	if context != nil {
+		uid, gid = context.Uid, context.Gid
+	}
+	return parent.fs.checkQuota(uid, gid, parent.nodeId, 0, 1)
+}
+
+// checkGrowth checks that node may grow to size.
+func (node *AppendFSNode) checkGrowth(size uint64) fuse.Status {
+	node.metadataMutex.RLock()
+	uid, gid, parentId, current, orphan := node.attr.Uid, node.attr.Gid, node.parentNodeId,
+		node.attr.Size, node.orphan
+	node.metadataMutex.RUnlock()
+	if size <= current || orphan {
+		return fuse.OK
+	}
+	return node.fs.checkQuota(uid, gid, parentId, size - current, 0)
+}
+
+// sameQuotaDirs reports whether nodes in the two directories are charged
+// to the same directory quotas.
+func (fs *AppendFS) sameQuotaDirs(dir1 uint64, dir2 uint64) bool {
+	fs.quotaMutex.Lock()
+	defer fs.quotaMutex.Unlock()
+	keys1, keys2 := fs.quotaKeys(0, 0, dir1), fs.quotaKeys(0, 0, dir2)
+	if len(keys1) != len(keys2) {
+		return false
+	}
+	for i := range keys1 {
+		if keys1[i] != keys2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// recountQuotas rebuilds the usage from the nodes.
+func (fs *AppendFS) recountQuotas() {
+	fs.nodesMutex.RLock()
+	nodes := make([]*AppendFSNode, 0, len(fs.nodes))
+	for _, node := range fs.nodes {
+		nodes = append(nodes, node)
+	}
+	fs.nodesMutex.RUnlock()
+	type charged struct {
+		uid, gid uint32
+		parentId uint64
+		size uint64
+	}
+	counted := make([]charged, 0, len(nodes))
+	for _, node := range nodes {
+		node.metadataMutex.RLock()
+		if !node.orphan {
+			counted = append(counted, charged{node.attr.Uid, node.attr.Gid, node.parentNodeId, node.attr.Size})
+		}
+		node.metadataMutex.RUnlock()
+	}
+	fs.quotaMutex.Lock()
+	fs.usage = make(map[quotaKey]*quotaUsage)
+	for _, node := range counted {
+		fs.charge(fs.quotaKeys(node.uid, node.gid, node.parentId), int64(node.size), 1)
+	}
+	fs.quotaMutex.Unlock()
+}
+
+// loadQuotas applies the limits from the volume records, later ones
+// replacing earlier ones.
+func (fs *AppendFS) loadQuotas(limits []*messages.QuotaLimit) {
+	fs.quotaMutex.Lock()
+	for _, limit := range limits {
+		fs.setLimit(Quota{Kind: QuotaKind(limit.GetKind()), Id: limit.GetId(),
+							Bytes: limit.GetBytes(), Inodes: limit.GetInodes()})
+	}
+	fs.quotaMutex.Unlock()
+}
+
+// setLimit installs a limit, or removes it if both limits are 0. The
+// caller must hold quotaMutex.
+func (fs *AppendFS) setLimit(quota Quota) {
+	key := quotaKey{quota.Kind, quota.Id}
+	if quota.Bytes == 0 && quota.Inodes == 0 {
+		delete(fs.quotas, key)
+	} else {
+		fs.quotas[key] = Quota{Kind: quota.Kind, Id: quota.Id, Bytes: quota.Bytes, Inodes: quota.Inodes}
+	}
+}
+
+// SetQuota sets the limits for a uid, gid or directory and records them in
+// the metadata file. Setting both limits to 0 removes the quota.
+func (fs *AppendFS) SetQuota(quota Quota) error {
+	switch quota.Kind {
+	case QuotaUser, QuotaGroup:
+	case QuotaDir:
+		dir := fs.Node(quota.Id)
+		isDir := false
+		if dir != nil {
+			dir.metadataMutex.RLock()
+			isDir = dir.attr.IsDir()
+			dir.metadataMutex.RUnlock()
+		}
+		if !isDir {
+			return fmt.Errorf("node %d is not a directory", quota.Id)
+		}
+	default:
+		return fmt.Errorf("unknown quota kind %v", quota.Kind)
+	}
+	limit := &messages.QuotaLimit{Kind: proto.Uint32(uint32(quota.Kind)), Id: &quota.Id,
+								Bytes: &quota.Bytes, Inodes: &quota.Inodes}
+	err := fs.AppendMetadata(&messages.NodeMetadata{NodeId: proto.Uint64(volumeRecordId),
+								Quota: []*messages.QuotaLimit{limit}})
+	if err != nil {
+		return err
+	}
+	fs.quotaMutex.Lock()
+	_, tracked := fs.quotas[quotaKey{quota.Kind, quota.Id}]
+	fs.setLimit(quota)
+	fs.quotaMutex.Unlock()
+	if quota.Kind == QuotaDir && !tracked {
+		// Usage isn't tracked for directories without a quota
+		fs.recountQuotas()
+	}
+	return nil
+}
+
+func (quota Quota) String() string {
+	return fmt.Sprintf("%s %d: %d/%d bytes, %d/%d inodes", quota.Kind, quota.Id,
+		quota.UsedBytes, quota.Bytes, quota.UsedInodes, quota.Inodes)
+}
+
+// Quotas returns every quota with its current usage.
+func (fs *AppendFS) Quotas() []Quota {
+	fs.quotaMutex.Lock()
+	out := make([]Quota, 0, len(fs.quotas))
+	for key, quota := range fs.quotas {
+		if usage := fs.usage[key]; usage != nil {
+			quota.UsedBytes, quota.UsedInodes = usage.bytes, usage.inodes
+		}
+		out = append(out, quota)
+	}
+	fs.quotaMutex.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Kind != out[j].Kind {
+			return out[i].Kind > out[j].Kind
+		}
+		return out[i].Id < out[j].Id
+	})
+	return out
+}
+
+// quotaStatFs reports the nearest directory quota above node, so df on a
+// directory with a quota shows its limits. It returns nil if there is none.
+func (node *AppendFSNode) quotaStatFs() *fuse.StatfsOut {
+	fs := node.fs
+	fs.quotaMutex.Lock()
+	defer fs.quotaMutex.Unlock()
+	for id := node.nodeId; id != volumeRecordId; {
+		key := quotaKey{QuotaDir, id}
+		if limit, ok := fs.quotas[key]; ok {
+			usage := fs.usage[key]
+			if usage == nil {
+				usage = &quotaUsage{}
+			}
+			out := &fuse.StatfsOut{Bsize: fs.blockSize, Frsize: fs.blockSize, NameLen: 255}
+			if limit.Bytes != 0 {
+				out.Blocks = limit.Bytes / uint64(fs.blockSize)
+				out.Bfree = addClamped(limit.Bytes, -int64(usage.bytes)) / uint64(fs.blockSize)
+				out.Bavail = out.Bfree
+			}
+			if limit.Inodes != 0 {
+				out.Files = limit.Inodes
+				out.Ffree = addClamped(limit.Inodes, -int64(usage.inodes))
+			}
+			return out
+		}
+		dir := fs.Node(id)
+		if dir == nil {
+			break
+		}
+		id = dir.parentNodeId
+	}
+	return nil
+}
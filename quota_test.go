@@ -0,0 +1,156 @@
+package appendfs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// quotaTestDir makes a directory anyone may create files in.
+func quotaTestDir(t *testing.T, fs *AppendFS, name string) *AppendFSNode {
+	inode, code := fs.Root().Mkdir(name, 0777, rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Mkdir %s: %v", name, code)
+	}
+	return inode.Node().(*AppendFSNode)
+}
+
+func setTestQuota(t *testing.T, fs *AppendFS, quota Quota) {
+	if err := fs.SetQuota(quota); err != nil {
+		t.Fatalf("SetQuota: %v", err)
+	}
+}
+
+func testUsage(t *testing.T, fs *AppendFS, kind QuotaKind, id uint64) (uint64, uint64) {
+	for _, quota := range fs.Quotas() {
+		if quota.Kind == kind && quota.Id == id {
+			return quota.UsedBytes, quota.UsedInodes
+		}
+	}
+	t.Fatalf("No %s quota for %d", kind, id)
+	return 0, 0
+}
+
+func TestQuotaLimits(t *testing.T) {
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	dir := quotaTestDir(t, fs, "dir")
+	setTestQuota(t, fs, Quota{Kind: QuotaUser, Id: uint64(ownerCaller.Uid), Bytes: 10, Inodes: 2})
+	file, _, code := dir.Create("file", uint32(os.O_WRONLY), fuse.S_IFREG | 0644, ownerCaller)
+	if code != fuse.OK {
+		t.Fatalf("Create: %v", code)
+	}
+	if _, code = file.Write([]byte("12345678"), 0); code != fuse.OK {
+		t.Fatalf("Write within the quota: %v", code)
+	}
+	if _, code = file.Write([]byte("9abc"), 8); code != fuse.Status(syscall.EDQUOT) {
+		t.Fatalf("Write past the quota: %v, not EDQUOT", code)
+	}
+	// Overwriting doesn't grow the file
+	if _, code = file.Write([]byte("abcd"), 0); code != fuse.OK {
+		t.Fatalf("Overwrite within the quota: %v", code)
+	}
+	file.Flush()
+	file.Release()
+	if _, code = dir.Mkdir("sub", 0755, ownerCaller); code != fuse.OK {
+		t.Fatalf("Mkdir within the quota: %v", code)
+	}
+	if _, _, code = dir.Create("other", uint32(os.O_WRONLY), fuse.S_IFREG | 0644, ownerCaller); code != fuse.Status(syscall.EDQUOT) {
+		t.Fatalf("Create past the quota: %v, not EDQUOT", code)
+	}
+	if _, code = dir.Mkdir("other", 0755, ownerCaller); code != fuse.Status(syscall.EDQUOT) {
+		t.Fatalf("Mkdir past the quota: %v, not EDQUOT", code)
+	}
+	// Nobody else is limited
+	if _, code = dir.Mkdir("other", 0755, groupCaller); code != fuse.OK {
+		t.Fatalf("Mkdir by someone without a quota: %v", code)
+	}
+	if bytes, inodes := testUsage(t, fs, QuotaUser, uint64(ownerCaller.Uid)); bytes != 8 || inodes != 2 {
+		t.Fatalf("Used %d bytes and %d inodes, not 8 and 2", bytes, inodes)
+	}
+}
+
+func TestChownMovesUsage(t *testing.T) {
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	node := ownedTestFile(t, fs, "file", 0644)
+	setTestQuota(t, fs, Quota{Kind: QuotaUser, Id: uint64(ownerCaller.Uid), Bytes: 100})
+	setTestQuota(t, fs, Quota{Kind: QuotaUser, Id: uint64(groupCaller.Uid), Bytes: 4})
+	setTestQuota(t, fs, Quota{Kind: QuotaUser, Id: uint64(otherCaller.Uid), Bytes: 100})
+	if code := node.Chown(nil, groupCaller.Uid, unchangedId, rootCaller); code != fuse.Status(syscall.EDQUOT) {
+		t.Fatalf("Chown to a user without room: %v, not EDQUOT", code)
+	}
+	if code := node.Chown(nil, otherCaller.Uid, unchangedId, rootCaller); code != fuse.OK {
+		t.Fatalf("Chown: %v", code)
+	}
+	if bytes, inodes := testUsage(t, fs, QuotaUser, uint64(ownerCaller.Uid)); bytes != 0 || inodes != 0 {
+		t.Fatalf("Old owner still uses %d bytes and %d inodes", bytes, inodes)
+	}
+	if bytes, inodes := testUsage(t, fs, QuotaUser, uint64(otherCaller.Uid)); bytes != 8 || inodes != 1 {
+		t.Fatalf("New owner uses %d bytes and %d inodes, not 8 and 1", bytes, inodes)
+	}
+}
+
+func TestQuotaUsageRecounted(t *testing.T) {
+	dir := t.TempDir()
+	fs := openTestVolume(t, dir, nil)
+	quotaDir := quotaTestDir(t, fs, "dir")
+	setTestQuota(t, fs, Quota{Kind: QuotaDir, Id: quotaDir.nodeId, Bytes: 1 << 20, Inodes: 10})
+	setTestQuota(t, fs, Quota{Kind: QuotaUser, Id: uint64(ownerCaller.Uid), Bytes: 1 << 20})
+	for _, name := range []string{"a", "b", "c"} {
+		file, _, code := quotaDir.Create(name, uint32(os.O_WRONLY), fuse.S_IFREG | 0644, ownerCaller)
+		if code != fuse.OK {
+			t.Fatalf("Create %s: %v", name, code)
+		}
+		file.Write([]byte("contents"), 0)
+		file.Flush()
+		file.Release()
+	}
+	if code := quotaDir.Unlink("c", ownerCaller); code != fuse.OK {
+		t.Fatalf("Unlink: %v", code)
+	}
+	// Files outside the directory don't count towards its quota
+	writeTestFile(t, fs, "outside", []byte("contents"))
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs = openTestVolume(t, dir, nil)
+	defer fs.Close()
+	quotaDir = fs.Root().Inode().GetChild("dir").Node().(*AppendFSNode)
+	if bytes, inodes := testUsage(t, fs, QuotaDir, quotaDir.nodeId); bytes != 16 || inodes != 2 {
+		t.Fatalf("Directory uses %d bytes and %d inodes after remounting, not 16 and 2", bytes, inodes)
+	}
+	if bytes, inodes := testUsage(t, fs, QuotaUser, uint64(ownerCaller.Uid)); bytes != 16 || inodes != 2 {
+		t.Fatalf("User uses %d bytes and %d inodes after remounting, not 16 and 2", bytes, inodes)
+	}
+}
+
+func TestQuotaStatFs(t *testing.T) {
+	fs := openTestVolume(t, t.TempDir(), nil)
+	defer fs.Close()
+	quotaDir := quotaTestDir(t, fs, "dir")
+	inode, _ := quotaDir.Mkdir("sub", 0777, rootCaller)
+	sub := inode.Node().(*AppendFSNode)
+	if out := sub.quotaStatFs(); out != nil {
+		t.Fatalf("StatFs without a quota: %+v", out)
+	}
+	setTestQuota(t, fs, Quota{Kind: QuotaDir, Id: quotaDir.nodeId, Bytes: 64 * uint64(fs.blockSize), Inodes: 10})
+	file, _, code := sub.Create("file", uint32(os.O_WRONLY), fuse.S_IFREG | 0644, ownerCaller)
+	if code != fuse.OK {
+		t.Fatalf("Create: %v", code)
+	}
+	file.Write(make([]byte, 2 * fs.blockSize), 0)
+	file.Flush()
+	file.Release()
+	// df below the directory shows its quota
+	out := sub.StatFs()
+	if out.Blocks != 64 || out.Bfree != 62 || out.Bavail != 62 {
+		t.Fatalf("StatFs blocks %d/%d/%d, not 64/62/62", out.Blocks, out.Bfree, out.Bavail)
+	}
+	// sub and the file
+	if out.Files != 10 || out.Ffree != 8 {
+		t.Fatalf("StatFs files %d/%d, not 10/8", out.Files, out.Ffree)
+	}
+}
@@ -0,0 +1,92 @@
+package appendfs
+
+import (
+	"fmt"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/e-tothe-ipi/appendfs/rangelist"
+)
+
+// cp --reflink can't be made to share extents from here. It asks for
+// FICLONE first, an ioctl FUSE doesn't pass on for regular files, and then
+// tries copy_file_range, which the kernel only sends to filesystems that
+// answer FUSE_COPY_FILE_RANGE. The fuse package of go-fuse v1, which
+// appendfs is built on, has no handler for that opcode, so the kernel gets
+// ENOSYS and cp copies the bytes. go-fuse v2 has one, RawFileSystem's
+// CopyFileRange, and CloneRange takes what it is given, so moving to v2 is
+// all it would take. Until then the user.appendfs.reflink control
+// attribute, which appendfs reflink sets, is the way in.
+
+// shifted returns the entry that maps the same stored bytes delta bytes
+// further into a file.
+func (fData fileSegmentEntry) shifted(delta int) fileSegmentEntry {
+	fData.base -= delta
+	if fData.length > 0 || fData.digest != "" {
+		fData.origin += delta
+	}
+	return fData
+}
+
+// CloneRange makes length bytes of node starting at dstOff share the
+// extents of src starting at srcOff, without copying any data. Ranges past
+// the end of src are not cloned. The resulting FileMap is recorded right
+// away.
+func (node *AppendFSNode) CloneRange(src *AppendFSNode, srcOff uint64, dstOff uint64, length uint64) (uint64, fuse.Status) {
+	if !node.attr.IsRegular() || !src.attr.IsRegular() {
+		return 0, fuse.EINVAL
+	}
+	if code := node.checkModify(); code != fuse.OK {
+		return 0, code
+	}
+	if code := node.checkFlags(flagImmutable | flagAppend); code != fuse.OK {
+		return 0, code
+	}
+	// Like Write, keep Compact from deleting the extents in flight
+	node.fs.compactMutex.RLock()
+	defer node.fs.compactMutex.RUnlock()
+	src.metadataMutex.RLock()
+	if srcOff >= src.attr.Size {
+		length = 0
+	} else if srcOff + length > src.attr.Size {
+		length = src.attr.Size - srcOff
+	}
+	if length == 0 {
+		src.metadataMutex.RUnlock()
+		return 0, fuse.OK
+	}
+	start, end := int(srcOff), int(srcOff + length) - 1
+	delta := int(dstOff) - int(srcOff)
+	if node == src && start + delta <= end && end + delta >= start {
+		src.metadataMutex.RUnlock()
+		return 0, fuse.EINVAL
+	}
+	clones := make([]*rangelist.RangeListEntry, 0)
+	for _, entry := range src.contentRanges.InRange(start, end) {
+		if fData, ok := entry.Data.(fileSegmentEntry); ok {
+			clones = append(clones, &rangelist.RangeListEntry{Min:max(entry.Min, start) + delta,
+					Max:min(entry.Max, end) + delta, Data:fData.shifted(delta)})
+		}
+	}
+	src.metadataMutex.RUnlock()
+	if code := node.checkGrowth(uint64(end + delta + 1)); code != fuse.OK {
+		return 0, code
+	}
+
+	node.metadataMutex.Lock()
+	// Whatever was in the destination range goes, so holes in the source
+	// stay holes
+	node.contentRanges.Overwrite(&rangelist.RangeListEntry{Min:start + delta, Max:end + delta})
+	for _, clone := range clones {
+		node.contentRanges.Overwrite(clone)
+	}
+	node.setSize(uint64(max(int(node.attr.Size), end + delta + 1)))
+	metadata := node.AsNodeMetadata()
+	metadata.Contents = node.fileMap()
+	err := node.fs.AppendMetadata(metadata)
+	node.metadataMutex.Unlock()
+	if err != nil {
+		fmt.Println(err)
+		return 0, fuse.EIO
+	}
+	return length, fuse.OK
+}
@@ -0,0 +1,870 @@
+package appendfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Replication ships the bytes appended to a volume's logs, the data
+// segments and the metadata file, to a replica that appends the same bytes
+// to its own, so that the replica's logs are always a prefix of the
+// primary's. Bytes are shipped as they are stored, so replicating an
+// encrypted volume needs no key. The replica acknowledges every append
+// once it is on stable storage, and how much of each log it has
+// acknowledged is simply how long its copy is, so a Replicator that
+// reconnects, or is restarted, carries on from there.
+//
+// Each round first finds the end of the last whole record in the metadata
+// file, then ships the data segments as they are, then the metadata up to
+// that record. Data always reaches the segments before a record refers to
+// it, so a replica never has a record whose data it is missing. Segments
+// that the primary compacts away are kept by the replica, and those it has
+// moved to its cold store are read from there. The salt of a volume
+// encrypted with a passphrase is shipped first, as without it the replica
+// could never be opened.
+
+// ReplicaLog is one of a volume's logs: the metadata file, or a data
+// segment.
+type ReplicaLog struct {
+	Metadata bool
+	Segment uint64
+}
+
+func (log ReplicaLog) String() string {
+	if log.Metadata {
+		return "metadata"
+	}
+	return fmt.Sprintf("segment %d", log.Segment)
+}
+
+// Positions says how many bytes of each log there are.
+type Positions map[ReplicaLog]int64
+
+// The most bytes shipped in one append
+const replicaChunkSize = 1 << 20
+
+// ReplicaTarget is where a Replicator ships a volume's logs to.
+type ReplicaTarget interface {
+	// Positions returns how much of each log the replica has.
+	Positions() (Positions, error)
+	// Append adds data to log, which must be offset bytes long, and
+	// returns its new length once the data is on stable storage.
+	Append(log ReplicaLog, offset int64, data []byte) (int64, error)
+	// Digest returns the sha256 of the first length bytes of log.
+	Digest(log ReplicaLog, length int64) ([]byte, error)
+	// KeepSalt stores the salt of the volume's passphrase, failing if the
+	// replica already has another.
+	KeepSalt(salt []byte) error
+	Close() error
+}
+
+// LocalReplica keeps a replica in files of its own.
+type LocalReplica struct {
+	dataFilePath string
+	metadataFilePath string
+	mutex sync.Mutex
+	files map[ReplicaLog]*os.File
+}
+
+func NewLocalReplica(dataFilePath string, metadataFilePath string) *LocalReplica {
+	return &LocalReplica{dataFilePath: dataFilePath, metadataFilePath: metadataFilePath,
+						files: make(map[ReplicaLog]*os.File)}
+}
+
+func (replica *LocalReplica) path(log ReplicaLog) string {
+	if log.Metadata {
+		return replica.metadataFilePath
+	}
+	return segmentFile(replica.dataFilePath, log.Segment)
+}
+
+func logPositions(dataFilePath string, metadataFilePath string) (Positions, error) {
+	positions := make(Positions)
+	segments, err := listSegmentFiles(dataFilePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		info, err := os.Stat(segmentFile(dataFilePath, segment))
+		if err != nil {
+			return nil, err
+		}
+		positions[ReplicaLog{Segment: segment}] = info.Size()
+	}
+	info, err := os.Stat(metadataFilePath)
+	if err == nil {
+		positions[ReplicaLog{Metadata: true}] = info.Size()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// volumeLogs reads the logs of a volume for replication and backups,
+// whether its segments are on local disk or in its cold store.
+type volumeLogs struct {
+	dataFilePath string
+	metadataFilePath string
+	// nil without a cold store
+	cold *coldTier
+}
+
+// openVolumeLogs fails if segments of the volume have been moved to a cold
+// store, which store, if set, is.
+func openVolumeLogs(dataFilePath string, metadataFilePath string, store ObjectStore) (*volumeLogs, error) {
+	err := checkTiered(dataFilePath, store)
+	if err != nil {
+		return nil, err
+	}
+	logs := &volumeLogs{dataFilePath: dataFilePath, metadataFilePath: metadataFilePath}
+	if store != nil {
+		logs.cold = &coldTier{store: store, prefix: filepath.Base(dataFilePath)}
+	}
+	return logs, nil
+}
+
+func (logs *volumeLogs) positions() (Positions, error) {
+	positions, err := logPositions(logs.dataFilePath, logs.metadataFilePath)
+	if err != nil || logs.cold == nil {
+		return positions, err
+	}
+	segments, err := logs.cold.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		log := ReplicaLog{Segment: segment}
+		if _, ok := positions[log]; ok {
+			// Still being moved
+			continue
+		}
+		positions[log], err = logs.cold.store.Size(logs.cold.name(segment))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return positions, nil
+}
+
+// coldSegment reads a segment in the cold store.
+type coldSegment struct {
+	tier *coldTier
+	segment uint64
+}
+
+func (cold coldSegment) ReadAt(dest []byte, pos int64) (int, error) {
+	return cold.tier.ReadAt(cold.segment, dest, pos)
+}
+
+func (cold coldSegment) Close() error {
+	return nil
+}
+
+type logReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// open returns a reader of log, from local disk if it is there and else
+// from the cold store.
+func (logs *volumeLogs) open(log ReplicaLog) (logReader, error) {
+	path := logs.metadataFilePath
+	if !log.Metadata {
+		path = segmentFile(logs.dataFilePath, log.Segment)
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) && !log.Metadata && logs.cold != nil {
+		return coldSegment{logs.cold, log.Segment}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// digest returns the sha256 of the bytes of log from from to to.
+func (logs *volumeLogs) digest(log ReplicaLog, from int64, to int64) ([]byte, error) {
+	hash := sha256.New()
+	if to > from {
+		r, err := logs.open(log)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		n, err := io.Copy(hash, io.NewSectionReader(r, from, to - from))
+		if err != nil {
+			return nil, err
+		}
+		if n < to - from {
+			return nil, fmt.Errorf("%v is shorter than %d bytes", log, to)
+		}
+	}
+	return hash.Sum(nil), nil
+}
+
+func (replica *LocalReplica) Positions() (Positions, error) {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	return logPositions(replica.dataFilePath, replica.metadataFilePath)
+}
+
+func (replica *LocalReplica) Append(log ReplicaLog, offset int64, data []byte) (int64, error) {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	file, ok := replica.files[log]
+	if !ok {
+		var err error
+		file, err = os.OpenFile(replica.path(log), os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0666)
+		if err != nil {
+			return 0, err
+		}
+		replica.files[log] = file
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != offset {
+		return info.Size(), fmt.Errorf("replica has %d bytes of %v, not %d", info.Size(), log, offset)
+	}
+	n, err := file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	return offset + int64(n), err
+}
+
+// digestFile returns the sha256 of the first length bytes of path.
+func digestFile(path string, length int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.CopyN(hash, file, length)
+	if err == io.EOF {
+		return nil, fmt.Errorf("%s is shorter than %d bytes", path, length)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func (replica *LocalReplica) Digest(log ReplicaLog, length int64) ([]byte, error) {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	return digestFile(replica.path(log), length)
+}
+
+func (replica *LocalReplica) KeepSalt(salt []byte) error {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	return keepSalt(SaltPath(replica.metadataFilePath), salt)
+}
+
+func (replica *LocalReplica) Close() error {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	var ret error
+	for log, file := range replica.files {
+		if err := file.Close(); err != nil {
+			ret = err
+		}
+		delete(replica.files, log)
+	}
+	return ret
+}
+
+// Over TCP, the Replicator sends requests, each an op byte and its
+// arguments, and the replica answers each in turn with a status byte,
+// followed by the result or, if the status is not replicaOk, an error
+// message. Numbers are uvarints and byte strings are preceded by their
+// length; a log is a byte saying which kind it is and its segment.
+//
+// Before any request, each side proves it knows the secret they share,
+// which is empty if none was given: the replica sends a random challenge,
+// the Replicator answers with its HMAC and a challenge of its own, and the
+// replica answers that with a status byte and, if it is replicaOk, the
+// HMAC of the Replicator's challenge.
+const (
+	// Answered with the number of logs and then each log and its length
+	replicaPositions byte = 'p'
+	// Takes a log, an offset and the data, answered with the new length
+	replicaAppend byte = 'a'
+	// Takes a log and a length, answered with the digest
+	replicaDigest byte = 'h'
+	// Takes the salt, answered with nothing
+	replicaSalt byte = 's'
+
+	replicaOk byte = 0
+	replicaError byte = 1
+
+	replicaMetadataLog byte = 'm'
+	replicaSegmentLog byte = 'd'
+
+	replicaChallengeSize = 32
+)
+
+var errWrongSecret = errors.New("wrong replication secret")
+
+// challengeResponse is the HMAC, keyed with secret, of challenge as sent
+// to side.
+func challengeResponse(secret []byte, side string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(side))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+func newChallenge() ([]byte, error) {
+	challenge := make([]byte, replicaChallengeSize)
+	_, err := io.ReadFull(rand.Reader, challenge)
+	return challenge, err
+}
+
+func writeUvarint(w *bufio.Writer, x uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	w.Write(buf[:binary.PutUvarint(buf, x)])
+}
+
+func writeBytes(w *bufio.Writer, data []byte) {
+	writeUvarint(w, uint64(len(data)))
+	w.Write(data)
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > replicaChunkSize {
+		return nil, fmt.Errorf("%d bytes is too long for a replication message", length)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+func writeLog(w *bufio.Writer, log ReplicaLog) {
+	if log.Metadata {
+		w.WriteByte(replicaMetadataLog)
+	} else {
+		w.WriteByte(replicaSegmentLog)
+	}
+	writeUvarint(w, log.Segment)
+}
+
+func readLog(r *bufio.Reader) (ReplicaLog, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return ReplicaLog{}, err
+	}
+	if kind != replicaMetadataLog && kind != replicaSegmentLog {
+		return ReplicaLog{}, fmt.Errorf("unknown log kind %q", kind)
+	}
+	segment, err := binary.ReadUvarint(r)
+	return ReplicaLog{Metadata: kind == replicaMetadataLog, Segment: segment}, err
+}
+
+// ServeReplica answers Replicators that connect to listener with secret,
+// keeping the replica in replica. It returns once listener fails.
+func ServeReplica(listener net.Listener, replica *LocalReplica, secret []byte) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := replica.serve(conn, secret)
+			if err != nil && err != io.EOF {
+				fmt.Printf("Replica fail: %s: %v\n", conn.RemoteAddr(), err)
+			}
+			conn.Close()
+		}()
+	}
+}
+
+// authenticate checks that the Replicator on the other end of r and w
+// knows secret, and proves to it that the replica does too.
+func authenticate(r *bufio.Reader, w *bufio.Writer, secret []byte) error {
+	challenge, err := newChallenge()
+	if err != nil {
+		return err
+	}
+	writeBytes(w, challenge)
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	response, err := readBytes(r)
+	if err != nil {
+		return err
+	}
+	theirs, err := readBytes(r)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(response, challengeResponse(secret, "replicator", challenge)) {
+		w.WriteByte(replicaError)
+		writeBytes(w, []byte(errWrongSecret.Error()))
+		w.Flush()
+		return errWrongSecret
+	}
+	w.WriteByte(replicaOk)
+	writeBytes(w, challengeResponse(secret, "replica", theirs))
+	return w.Flush()
+}
+
+func (replica *LocalReplica) serve(conn net.Conn, secret []byte) error {
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	// Nobody gets to hold a connection open without the secret
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := authenticate(r, w, secret); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		var result bytes.Buffer
+		out := bufio.NewWriter(&result)
+		switch op {
+		case replicaPositions:
+			var positions Positions
+			positions, err = replica.Positions()
+			writeUvarint(out, uint64(len(positions)))
+			for log, length := range positions {
+				writeLog(out, log)
+				writeUvarint(out, uint64(length))
+			}
+		case replicaAppend:
+			var log ReplicaLog
+			var offset uint64
+			var data []byte
+			if log, err = readLog(r); err != nil {
+				return err
+			}
+			if offset, err = binary.ReadUvarint(r); err != nil {
+				return err
+			}
+			if data, err = readBytes(r); err != nil {
+				return err
+			}
+			var length int64
+			length, err = replica.Append(log, int64(offset), data)
+			writeUvarint(out, uint64(length))
+		case replicaDigest:
+			var log ReplicaLog
+			var length uint64
+			if log, err = readLog(r); err != nil {
+				return err
+			}
+			if length, err = binary.ReadUvarint(r); err != nil {
+				return err
+			}
+			var digest []byte
+			digest, err = replica.Digest(log, int64(length))
+			writeBytes(out, digest)
+		case replicaSalt:
+			var salt []byte
+			if salt, err = readBytes(r); err != nil {
+				return err
+			}
+			err = replica.KeepSalt(salt)
+		default:
+			return fmt.Errorf("unknown request %q", op)
+		}
+		if err != nil {
+			w.WriteByte(replicaError)
+			writeBytes(w, []byte(err.Error()))
+		} else {
+			out.Flush()
+			w.WriteByte(replicaOk)
+			w.Write(result.Bytes())
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// tcpReplica is a replica served by ServeReplica. It connects when it
+// is first used, and again after anything goes wrong.
+type tcpReplica struct {
+	address string
+	secret []byte
+	mutex sync.Mutex
+	conn net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// DialReplica returns a target for the replica served at address with
+// secret.
+func DialReplica(address string, secret []byte) ReplicaTarget {
+	return &tcpReplica{address: address, secret: secret}
+}
+
+// call sends a request written by request and reads the answer with
+// answer.
+func (replica *tcpReplica) call(request func(w *bufio.Writer), answer func(r *bufio.Reader) error) error {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	if replica.conn == nil {
+		conn, err := net.DialTimeout("tcp", replica.address, 10 * time.Second)
+		if err != nil {
+			return err
+		}
+		replica.conn = conn
+		replica.reader, replica.writer = bufio.NewReader(conn), bufio.NewWriter(conn)
+		err = replica.authenticate()
+		if err != nil {
+			replica.conn.Close()
+			replica.conn = nil
+			return err
+		}
+	}
+	err := replica.exchange(request, answer)
+	var refused replicaRefusal
+	if err != nil && !errors.As(err, &refused) {
+		// The connection is out of step, so start again
+		replica.conn.Close()
+		replica.conn = nil
+	}
+	return err
+}
+
+// An error reported by the replica
+type replicaRefusal string
+
+func (refusal replicaRefusal) Error() string {
+	return "replica: " + string(refusal)
+}
+
+// authenticate answers the replica's challenge and checks that it knows
+// the secret too.
+func (replica *tcpReplica) authenticate() error {
+	replica.conn.SetDeadline(time.Now().Add(time.Minute))
+	challenge, err := readBytes(replica.reader)
+	if err != nil {
+		return err
+	}
+	ours, err := newChallenge()
+	if err != nil {
+		return err
+	}
+	writeBytes(replica.writer, challengeResponse(replica.secret, "replicator", challenge))
+	writeBytes(replica.writer, ours)
+	if err = replica.writer.Flush(); err != nil {
+		return err
+	}
+	status, err := replica.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	message, err := readBytes(replica.reader)
+	if err != nil {
+		return err
+	}
+	if status != replicaOk {
+		return replicaRefusal(message)
+	}
+	if !hmac.Equal(message, challengeResponse(replica.secret, "replica", ours)) {
+		return fmt.Errorf("%s: %v", replica.address, errWrongSecret)
+	}
+	return nil
+}
+
+func (replica *tcpReplica) exchange(request func(w *bufio.Writer), answer func(r *bufio.Reader) error) error {
+	replica.conn.SetDeadline(time.Now().Add(time.Minute))
+	request(replica.writer)
+	if err := replica.writer.Flush(); err != nil {
+		return err
+	}
+	status, err := replica.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if status != replicaOk {
+		message, err := readBytes(replica.reader)
+		if err != nil {
+			return err
+		}
+		return replicaRefusal(message)
+	}
+	return answer(replica.reader)
+}
+
+func (replica *tcpReplica) Positions() (Positions, error) {
+	positions := make(Positions)
+	err := replica.call(func(w *bufio.Writer) {
+		w.WriteByte(replicaPositions)
+	}, func(r *bufio.Reader) error {
+		count, err := binary.ReadUvarint(r)
+		for i := uint64(0); err == nil && i < count; i++ {
+			var log ReplicaLog
+			var length uint64
+			if log, err = readLog(r); err == nil {
+				length, err = binary.ReadUvarint(r)
+				positions[log] = int64(length)
+			}
+		}
+		return err
+	})
+	return positions, err
+}
+
+func (replica *tcpReplica) Append(log ReplicaLog, offset int64, data []byte) (int64, error) {
+	var length uint64
+	err := replica.call(func(w *bufio.Writer) {
+		w.WriteByte(replicaAppend)
+		writeLog(w, log)
+		writeUvarint(w, uint64(offset))
+		writeBytes(w, data)
+	}, func(r *bufio.Reader) error {
+		var err error
+		length, err = binary.ReadUvarint(r)
+		return err
+	})
+	return int64(length), err
+}
+
+func (replica *tcpReplica) Digest(log ReplicaLog, length int64) ([]byte, error) {
+	var digest []byte
+	err := replica.call(func(w *bufio.Writer) {
+		w.WriteByte(replicaDigest)
+		writeLog(w, log)
+		writeUvarint(w, uint64(length))
+	}, func(r *bufio.Reader) error {
+		var err error
+		digest, err = readBytes(r)
+		return err
+	})
+	return digest, err
+}
+
+func (replica *tcpReplica) KeepSalt(salt []byte) error {
+	return replica.call(func(w *bufio.Writer) {
+		w.WriteByte(replicaSalt)
+		writeBytes(w, salt)
+	}, func(r *bufio.Reader) error {
+		return nil
+	})
+}
+
+func (replica *tcpReplica) Close() error {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	if replica.conn == nil {
+		return nil
+	}
+	err := replica.conn.Close()
+	replica.conn = nil
+	return err
+}
+
+// Replicator ships a volume's logs to a target.
+type Replicator struct {
+	dataFilePath string
+	metadataFilePath string
+	cold ObjectStore
+	target ReplicaTarget
+	mutex sync.Mutex
+	acked Positions
+	saltShipped bool
+}
+
+// NewReplicator returns a Replicator of the volume to target. cold is the
+// volume's cold store, if it has one.
+func NewReplicator(dataFilePath string, metadataFilePath string, cold ObjectStore, target ReplicaTarget) *Replicator {
+	return &Replicator{dataFilePath: dataFilePath, metadataFilePath: metadataFilePath,
+						cold: cold, target: target, acked: make(Positions)}
+}
+
+// recordsEnd returns where the last whole record in the metadata file
+// ends, looking from offset, which must be the start of a record.
+func recordsEnd(metadataFilePath string, offset int64) (int64, error) {
+	file, err := os.Open(metadataFilePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	_, err = file.Seek(offset, 0)
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		recordLen, err := binary.ReadUvarint(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		_, err = reader.Discard(int(recordLen))
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(uvarintSize(recordLen)) + int64(recordLen)
+	}
+}
+
+// Replicate ships everything the target doesn't have yet.
+func (r *Replicator) Replicate() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	logs, err := openVolumeLogs(r.dataFilePath, r.metadataFilePath, r.cold)
+	if err != nil {
+		return err
+	}
+	err = r.shipSalt()
+	if err != nil {
+		return err
+	}
+	have, err := r.target.Positions()
+	if err != nil {
+		return err
+	}
+	metadata := ReplicaLog{Metadata: true}
+	metadataEnd, err := recordsEnd(r.metadataFilePath, have[metadata])
+	if err != nil {
+		return err
+	}
+	// Only taken once the records to ship are known, so all the data
+	// they refer to is there
+	positions, err := logs.positions()
+	if err != nil {
+		return err
+	}
+	for log, length := range positions {
+		if !log.Metadata {
+			err = r.ship(logs, log, have[log], length)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return r.ship(logs, metadata, have[metadata], metadataEnd)
+}
+
+// shipSalt sends the salt, once the volume has one, to the target.
+func (r *Replicator) shipSalt() error {
+	if r.saltShipped {
+		return nil
+	}
+	salt, err := os.ReadFile(SaltPath(r.metadataFilePath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = r.target.KeepSalt(salt)
+	r.saltShipped = err == nil
+	return err
+}
+
+// ship sends bytes from to end of log to the target.
+func (r *Replicator) ship(logs *volumeLogs, log ReplicaLog, from int64, end int64) error {
+	r.acked[log] = from
+	if from > end {
+		return fmt.Errorf("replica has %d bytes of %v, more than the %d there are", from, log, end)
+	}
+	if from == end {
+		return nil
+	}
+	file, err := logs.open(log)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buf := make([]byte, replicaChunkSize)
+	for from < end {
+		n, err := file.ReadAt(buf[:min(replicaChunkSize, int(end - from))], from)
+		if err != nil && !(err == io.EOF && n > 0) {
+			return err
+		}
+		from, err = r.target.Append(log, from, buf[:n])
+		if err != nil {
+			return err
+		}
+		r.acked[log] = from
+	}
+	return nil
+}
+
+// Acked returns how much of each log the target has acknowledged.
+func (r *Replicator) Acked() Positions {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	acked := make(Positions)
+	for log, length := range r.acked {
+		acked[log] = length
+	}
+	return acked
+}
+
+// Run replicates every interval until stop is closed, carrying on after
+// failures, such as the replica going away, in the next round. It only
+// returns an error if interval isn't positive.
+func (r *Replicator) Run(stop <-chan struct{}, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("replication interval must be positive, not %v", interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Replicate(); err != nil {
+			fmt.Printf("Replication fail: %v\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// Verify checks that each of the target's logs is byte for byte the same
+// as the start of the primary's, up to where the target has acknowledged
+// it, and returns those positions.
+func (r *Replicator) Verify() (Positions, error) {
+	acked := r.Acked()
+	logs, err := openVolumeLogs(r.dataFilePath, r.metadataFilePath, r.cold)
+	if err != nil {
+		return nil, err
+	}
+	for log, length := range acked {
+		ours, err := logs.digest(log, 0, length)
+		if err != nil {
+			return nil, err
+		}
+		theirs, err := r.target.Digest(log, length)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(ours, theirs) {
+			return nil, fmt.Errorf("replica's %v differs in its first %d bytes", log, length)
+		}
+	}
+	return acked, nil
+}
@@ -0,0 +1,82 @@
+package appendfs
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// serveTestReplica serves a replica in dir on the loopback interface and
+// returns its address.
+func serveTestReplica(t *testing.T, dir string, secret []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica := NewLocalReplica(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"))
+	go ServeReplica(listener, replica, secret)
+	t.Cleanup(func() {
+		listener.Close()
+		replica.Close()
+	})
+	return listener.Addr().String()
+}
+
+func TestReplicaSecret(t *testing.T) {
+	address := serveTestReplica(t, t.TempDir(), []byte("shared"))
+	tests := []struct {
+		name string
+		secret []byte
+		refused bool
+	}{
+		{"right secret", []byte("shared"), false},
+		{"wrong secret", []byte("guessed"), true},
+		{"no secret", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := DialReplica(address, test.secret)
+			defer target.Close()
+			_, err := target.Positions()
+			var refused replicaRefusal
+			if test.refused && !errors.As(err, &refused) {
+				t.Fatalf("Positions returned %v, not a refusal", err)
+			}
+			if !test.refused && err != nil {
+				t.Fatalf("Positions: %v", err)
+			}
+		})
+	}
+}
+
+func TestReplicateSalt(t *testing.T) {
+	dir, replicaDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "metadata"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("the salt of the passphrase")
+	if err := os.WriteFile(SaltPath(filepath.Join(dir, "metadata")), salt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	target := DialReplica(serveTestReplica(t, replicaDir, nil), nil)
+	defer target.Close()
+	replicator := NewReplicator(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), nil, target)
+	if err := replicator.Replicate(); err != nil {
+		t.Fatal(err)
+	}
+	shipped, err := os.ReadFile(SaltPath(filepath.Join(replicaDir, "metadata")))
+	if err != nil || !bytes.Equal(shipped, salt) {
+		t.Fatalf("Replica has salt %q (%v), not %q", shipped, err, salt)
+	}
+	// The replica can't be taken over by a volume with another salt
+	if err := os.WriteFile(SaltPath(filepath.Join(dir, "metadata")), []byte("another salt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	replicator = NewReplicator(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), nil, target)
+	if err := replicator.Replicate(); err == nil {
+		t.Fatalf("Replicating a volume with another salt worked")
+	}
+}
@@ -0,0 +1,345 @@
+package appendfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/e-tothe-ipi/appendfs/messages"
+)
+
+// The data log is split into numbered segment files next to dataFilePath.
+// A segment is sealed once it has grown past segmentSize; since a single
+// append is never split, a sealed segment may overshoot by one write.
+
+func (fs *AppendFS) segmentPath(segment uint64) string {
+	return segmentFile(fs.dataFilePath, segment)
+}
+
+func segmentFile(dataFilePath string, segment uint64) string {
+	return fmt.Sprintf("%s.%06d", dataFilePath, segment)
+}
+
+// listSegments returns the numbers of all segment files on disk, in order.
+func (fs *AppendFS) listSegments() ([]uint64, error) {
+	return listSegmentFiles(fs.dataFilePath)
+}
+
+func listSegmentFiles(dataFilePath string) ([]uint64, error) {
+	matches, err := filepath.Glob(dataFilePath + ".*")
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]uint64, 0, len(matches))
+	for _, match := range matches {
+		if segment, ok := segmentNumber(dataFilePath, match); ok {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// segmentNumber returns the number of the segment of dataFilePath at path,
+// if it is one.
+func segmentNumber(dataFilePath string, path string) (uint64, bool) {
+	if !strings.HasPrefix(path, dataFilePath + ".") {
+		return 0, false
+	}
+	segment, err := strconv.ParseUint(strings.TrimPrefix(path, dataFilePath + "."), 10, 64)
+	return segment, err == nil
+}
+
+// adoptLegacyDataFile makes the data file of a volume from before the data
+// log was split into segments its segment 0, which is the segment the
+// FileMaps it wrote, having none, refer to.
+func (fs *AppendFS) adoptLegacyDataFile() error {
+	info, err := os.Stat(fs.dataFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", fs.dataFilePath)
+	}
+	_, err = os.Stat(fs.segmentPath(0))
+	if err == nil {
+		return fmt.Errorf("both %s and %s exist", fs.dataFilePath, fs.segmentPath(0))
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if fs.follower {
+		return fmt.Errorf("%s has to be mounted without -follow once to be upgraded", fs.dataFilePath)
+	}
+	fmt.Printf("Adopting %s as segment 0\n", fs.dataFilePath)
+	return os.Rename(fs.dataFilePath, fs.segmentPath(0))
+}
+
+// openSegment makes segment the one AppendData writes to. The caller must
+// hold dataMutex, or be the constructor.
+func (fs *AppendFS) openSegment(segment uint64) error {
+	dataFile, size, err := openLog(fs.segmentCopies(segment), os.O_RDWR | os.O_CREATE | os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	fs.dataFile = dataFile
+	fs.dataSegment = segment
+	fs.dataFileOffset = int(size)
+	return nil
+}
+
+// rotateSegment seals the current segment and starts the next one. The
+// caller must hold dataMutex.
+func (fs *AppendFS) rotateSegment() error {
+	if fs.syncPolicy != SyncUnsafe {
+		// SyncData only ever looks at the current segment
+		err := syncFile(fs.dataFile)
+		if err != nil {
+			return err
+		}
+	}
+	if closer, ok := fs.dataFile.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return fs.openSegment(fs.dataSegment + 1)
+}
+
+// segmentReader hands out read-only handles to data segments, opening
+// each copy of one at most once.
+type segmentReader struct {
+	fs *AppendFS
+	files map[segmentCopy]*os.File
+}
+
+type segmentCopy struct {
+	segment uint64
+	copy int
+}
+
+func (fs *AppendFS) newSegmentReader() *segmentReader {
+	return &segmentReader{fs: fs, files: make(map[segmentCopy]*os.File)}
+}
+
+// copies returns how many copies of each segment there are, the cold tier
+// being the last if there is one.
+func (r *segmentReader) copies() int {
+	if r.fs.cold != nil {
+		return len(r.fs.mirrors) + 2
+	}
+	return len(r.fs.mirrors) + 1
+}
+
+// ReadAt reads from the first copy of segment that has the bytes asked for.
+func (r *segmentReader) ReadAt(segment uint64, dest []byte, pos int64) (n int, err error) {
+	for copy := 0; copy < r.copies(); copy++ {
+		n, err = r.readCopy(copy, segment, dest, pos)
+		if err == nil {
+			return n, nil
+		}
+	}
+	return n, err
+}
+
+func (r *segmentReader) readCopy(copy int, segment uint64, dest []byte, pos int64) (int, error) {
+	if copy > len(r.fs.mirrors) {
+		return r.fs.cold.ReadAt(segment, dest, pos)
+	}
+	key := segmentCopy{segment, copy}
+	file, ok := r.files[key]
+	if !ok {
+		var err error
+		file, err = os.Open(r.fs.segmentCopies(segment)[copy])
+		if err != nil {
+			return 0, err
+		}
+		r.files[key] = file
+	}
+	return file.ReadAt(dest, pos)
+}
+
+func (r *segmentReader) Close() error {
+	var ret error
+	for _, file := range r.files {
+		err := file.Close()
+		if err != nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// walkNodes calls fn for every node reachable from the root, and for
+// every orphan.
+func (fs *AppendFS) walkNodes(fn func(node *AppendFSNode)) {
+	var walk func(node *AppendFSNode)
+	walk = func(node *AppendFSNode) {
+		fn(node)
+		for _, child := range node.Inode().FsChildren() {
+			if appendfsChild, ok := child.Node().(*AppendFSNode); ok {
+				walk(appendfsChild)
+			}
+		}
+	}
+	walk(fs.root)
+	for _, orphan := range fs.Orphans() {
+		fn(orphan)
+	}
+}
+
+// Compact deletes sealed segments that no file refers to any more, from
+// the cold store too, and returns their numbers. Files committed to WORM
+// storage are never unlinked while retained, so their segments are always
+// kept. Files whose last recorded FileMap still refers to a segment about
+// to be deleted get a new one, synced first, so that replaying the
+// metadata file can never lead to a segment that has been deleted.
+func (fs *AppendFS) Compact() ([]uint64, error) {
+	fs.compactMutex.Lock()
+	defer fs.compactMutex.Unlock()
+	live := make(map[uint64]bool)
+	files := make([]*AppendFSNode, 0)
+	fs.walkNodes(func(node *AppendFSNode) {
+		node.metadataMutex.RLock()
+		if node.attr.IsRegular() {
+			for _, entry := range node.contentRanges.InRange(0, int(node.attr.Size)) {
+				if fData, ok := entry.Data.(fileSegmentEntry); ok {
+					live[fData.segment] = true
+				}
+			}
+			files = append(files, node)
+		}
+		node.metadataMutex.RUnlock()
+	})
+	fs.dataMutex.RLock()
+	current := fs.dataSegment
+	fs.dataMutex.RUnlock()
+	dead, err := fs.deadSegments(live, current)
+	if err != nil {
+		return nil, err
+	}
+	// Only the files that need it, so compacting a nearly full volume
+	// doesn't use up the metadata reserve it is meant to run in
+	stale := false
+	for _, node := range files {
+		fs.metadataMutex.RLock()
+		recorded := fs.recordedSegments[node.nodeId]
+		fs.metadataMutex.RUnlock()
+		if !refersTo(recorded, dead) {
+			continue
+		}
+		node.metadataMutex.RLock()
+		metadata := &messages.NodeMetadata{NodeId:&node.nodeId,
+										Size:&node.attr.Size,
+										Contents:node.fileMap()}
+		err = fs.AppendMetadata(metadata)
+		node.metadataMutex.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		stale = true
+	}
+	if stale {
+		err = fs.Sync()
+		if err != nil {
+			return nil, err
+		}
+	}
+	segments, err := fs.listSegmentCopies()
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]uint64, 0)
+	for _, segment := range segments {
+		if !dead[segment] {
+			continue
+		}
+		// Only the volume's own copy counts towards dataBytes, and it may
+		// be gone with a mirror still holding the segment
+		var size int64
+		var info os.FileInfo
+		info, err = os.Stat(fs.segmentPath(segment))
+		if err == nil {
+			size = info.Size()
+		}
+		for _, path := range fs.segmentCopies(segment) {
+			if err == nil {
+				err = os.Remove(path)
+			}
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			break
+		}
+		fs.dataMutex.Lock()
+		fs.dataBytes -= size
+		fs.dataMutex.Unlock()
+		removed = append(removed, segment)
+	}
+	if err == nil && fs.cold != nil {
+		var cold []uint64
+		cold, err = fs.compactCold(dead)
+		removed = append(removed, cold...)
+	}
+	if fs.chunks != nil {
+		fs.chunks.mutex.Lock()
+		fs.forgetSegments(removed)
+		fs.chunks.mutex.Unlock()
+	}
+	return removed, err
+}
+
+// deadSegments returns the sealed segments, local or cold, that aren't
+// live.
+func (fs *AppendFS) deadSegments(live map[uint64]bool, current uint64) (map[uint64]bool, error) {
+	segments, err := fs.listSegmentCopies()
+	if err != nil {
+		return nil, err
+	}
+	if fs.cold != nil {
+		cold, err := fs.cold.segments()
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, cold...)
+	}
+	dead := make(map[uint64]bool)
+	for _, segment := range segments {
+		if segment < current && !live[segment] {
+			dead[segment] = true
+		}
+	}
+	return dead, nil
+}
+
+// fileMapSegments returns the segments fileMap refers to.
+func fileMapSegments(fileMap *messages.FileMap) []uint64 {
+	segments := make([]uint64, 0)
+	seen := make(map[uint64]bool)
+	for _, entry := range fileMap.GetEntry() {
+		if !seen[entry.GetSegment()] {
+			seen[entry.GetSegment()] = true
+			segments = append(segments, entry.GetSegment())
+		}
+	}
+	return segments
+}
+
+func refersTo(segments []uint64, dead map[uint64]bool) bool {
+	for _, segment := range segments {
+		if dead[segment] {
+			return true
+		}
+	}
+	return false
+}
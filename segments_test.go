@@ -0,0 +1,184 @@
+package appendfs
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/golang/protobuf/proto"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// openTestVolume opens the volume in dir and replays its metadata.
+func openTestVolume(t *testing.T, dir string, options *Options) *AppendFS {
+	fs, err := NewAppendFS(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), options)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	nodefs.NewFileSystemConnector(fs.Root(), nodefs.NewOptions())
+	return fs
+}
+
+func readTestFile(t *testing.T, fs *AppendFS, name string, size int) []byte {
+	child := fs.Root().Inode().GetChild(name)
+	if child == nil {
+		t.Fatalf("%s is missing", name)
+	}
+	dest := make([]byte, size)
+	_, code := child.Node().(*AppendFSNode).Read(nil, dest, 0, &fuse.Context{})
+	if code != fuse.OK {
+		t.Fatalf("Read %s: %v", name, code)
+	}
+	return dest
+}
+
+// writeRecords writes a metadata file as volumes did before encryption and
+// the chain.
+func writeRecords(t *testing.T, path string, records ...*messages.NodeMetadata) {
+	out := make([]byte, 0)
+	for _, record := range records {
+		data, err := proto.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := make([]byte, binary.MaxVarintLen64)
+		out = append(out, prefix[:binary.PutUvarint(prefix, uint64(len(data)))]...)
+		out = append(out, data...)
+	}
+	if err := os.WriteFile(path, out, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenUnsegmentedVolume(t *testing.T) {
+	dir := t.TempDir()
+	contents := "written before segments"
+	err := os.WriteFile(filepath.Join(dir, "data"), []byte("garbage " + contents), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := uint64(len(contents))
+	writeRecords(t, filepath.Join(dir, "metadata"), &messages.NodeMetadata{
+		NodeId: proto.Uint64(2), ParentNodeId: proto.Uint64(rootNodeId), Name: proto.String("file"),
+		Mode: proto.Uint32(fuse.S_IFREG | 0644), Nlink: proto.Uint32(1), Size: &size,
+		Valid: proto.Bool(true),
+		Contents: &messages.FileMap{Entry: []*messages.FileMapEntry{&messages.FileMapEntry{
+			Start: proto.Uint64(0), End: proto.Uint64(size - 1), Base: proto.Uint64(8)}}},
+	})
+	fs := openTestVolume(t, dir, nil)
+	if got := string(readTestFile(t, fs, "file", len(contents))); got != contents {
+		t.Fatalf("Read %q, not %q", got, contents)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.000000")); err != nil {
+		t.Fatalf("The data file should be segment 0: %v", err)
+	}
+	// And it stays readable once upgraded
+	fs = openTestVolume(t, dir, nil)
+	defer fs.Close()
+	if got := string(readTestFile(t, fs, "file", len(contents))); got != contents {
+		t.Fatalf("Read %q after upgrading, not %q", got, contents)
+	}
+}
+
+func writeTestFile(t *testing.T, fs *AppendFS, name string, data []byte) *AppendFSNode {
+	context := &fuse.Context{}
+	var node *AppendFSNode
+	if child := fs.Root().Inode().GetChild(name); child != nil {
+		node = child.Node().(*AppendFSNode)
+	} else {
+		created, inode, code := fs.Root().Create(name, uint32(os.O_WRONLY), fuse.S_IFREG | 0644, context)
+		if code != fuse.OK {
+			t.Fatalf("Create %s: %v", name, code)
+		}
+		created.Release()
+		node = inode.Node().(*AppendFSNode)
+	}
+	file, code := node.Open(uint32(os.O_WRONLY), context)
+	if code != fuse.OK {
+		t.Fatalf("Open %s: %v", name, code)
+	}
+	if _, code = file.Write(data, 0); code != fuse.OK {
+		t.Fatalf("Write %s: %v", name, code)
+	}
+	if code = file.Flush(); code != fuse.OK {
+		t.Fatalf("Flush %s: %v", name, code)
+	}
+	file.Release()
+	return node
+}
+
+func TestCompactRecordsOnlyStaleFileMaps(t *testing.T) {
+	dir := t.TempDir()
+	options := NewOptions()
+	// Every write seals the segment before it
+	options.SegmentSize = 1
+	fs := openTestVolume(t, dir, options)
+	kept := writeTestFile(t, fs, "kept", []byte("kept as it is"))
+	truncated := writeTestFile(t, fs, "truncated", []byte("cut off"))
+	// Recorded with nothing, so only the FileMap of the first write says
+	// which segment it is in
+	if code := truncated.Truncate(nil, 0, &fuse.Context{}); code != fuse.OK {
+		t.Fatalf("Truncate: %v", code)
+	}
+	writeTestFile(t, fs, "last", []byte("seals the rest"))
+	offset := fs.metadataFileOffset
+	removed, err := fs.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 {
+		t.Fatalf("Compact removed segments %v, not just the truncated one", removed)
+	}
+	file, err := os.Open(filepath.Join(dir, "metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, 0); err != nil {
+		t.Fatal(err)
+	}
+	reader := newMetadataReader(file, offset, nil)
+	records := 0
+	for {
+		metadata, _, err := reader.Next()
+		if err != nil {
+			break
+		}
+		if metadata.GetNodeId() == kept.nodeId {
+			t.Fatalf("Compact recorded the FileMap of a file it didn't affect")
+		}
+		records++
+	}
+	if records != 1 {
+		t.Fatalf("Compact recorded %d FileMaps, not 1", records)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs = openTestVolume(t, dir, options)
+	defer fs.Close()
+	if got := string(readTestFile(t, fs, "kept", 13)); got != "kept as it is" {
+		t.Fatalf("Read %q after compacting, not %q", got, "kept as it is")
+	}
+	if size := fs.Root().Inode().GetChild("truncated").Node().(*AppendFSNode).attr.Size; size != 0 {
+		t.Fatalf("The truncated file is %d bytes long after compacting", size)
+	}
+}
+
+func TestSegmentSizeMustBePositive(t *testing.T) {
+	dir := t.TempDir()
+	for _, size := range []int{0, -1} {
+		options := NewOptions()
+		options.SegmentSize = size
+		_, err := NewAppendFS(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), options)
+		if err == nil {
+			t.Fatalf("A segment size of %d was accepted", size)
+		}
+	}
+}
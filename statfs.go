@@ -0,0 +1,160 @@
+package appendfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// The size of a volume is everything appendfs has on disk for it: the data
+// segments, the metadata file and the chunk index. Its capacity is that
+// plus the free space of the filesystem holding the data, or the capacity
+// option if that is smaller.
+
+type VolumeStats struct {
+	// Bytes in the data segments on local disk, and in the cold store
+	DataBytes uint64
+	ColdBytes uint64
+	// Bytes in the metadata file and the chunk index
+	MetadataBytes uint64
+	// Data bytes some file refers to, and the rest
+	LiveBytes uint64
+	GarbageBytes uint64
+	Nodes uint64
+	Capacity uint64
+	FreeBytes uint64
+}
+
+// countSegments sets dataBytes from the segments on disk. It is only
+// called by the constructor.
+func (fs *AppendFS) countSegments(segments []uint64) error {
+	fs.dataBytes = 0
+	for _, segment := range segments {
+		info, err := os.Stat(fs.segmentPath(segment))
+		if err != nil {
+			return err
+		}
+		fs.dataBytes += info.Size()
+	}
+	return nil
+}
+
+// volumeBytes returns the size of the data and of the metadata.
+func (fs *AppendFS) volumeBytes() (int64, int64) {
+	fs.dataMutex.RLock()
+	data := fs.dataBytes
+	fs.dataMutex.RUnlock()
+	fs.metadataMutex.RLock()
+	metadata := fs.metadataFileOffset
+	fs.metadataMutex.RUnlock()
+	if fs.chunks != nil {
+		fs.chunks.mutex.Lock()
+		metadata += fs.chunks.offset
+		fs.chunks.mutex.Unlock()
+	}
+	return data, metadata
+}
+
+// capacity returns the size the volume may grow to and how much of it is
+// left.
+func (fs *AppendFS) capacity() (uint64, uint64) {
+	data, metadata := fs.volumeBytes()
+	used := uint64(data + metadata)
+	total := used
+	var host syscall.Statfs_t
+	if syscall.Statfs(filepath.Dir(fs.dataFilePath), &host) == nil {
+		total += host.Bavail * uint64(host.Bsize)
+	}
+	if fs.capacityLimit > 0 && uint64(fs.capacityLimit) < total {
+		total = uint64(fs.capacityLimit)
+	}
+	if used > total {
+		return total, 0
+	}
+	return total, total - used
+}
+
+// liveBytes adds up the data file bytes that some node refers to, counting
+// bytes shared by clones or dedup only once.
+func (fs *AppendFS) liveBytes() uint64 {
+	type span struct {
+		start, end int
+	}
+	spans := make(map[uint64][]span)
+	fs.walkNodes(func(node *AppendFSNode) {
+		node.metadataMutex.RLock()
+		for _, entry := range node.contentRanges.InRange(0, int(node.attr.Size)) {
+			fData, ok := entry.Data.(fileSegmentEntry)
+			if !ok {
+				continue
+			}
+			s := span{fData.base + entry.Min, fData.base + entry.Max}
+			if fData.length > 0 {
+				s = span{fData.base + fData.origin, fData.base + fData.origin + fData.length - 1}
+			}
+			spans[fData.segment] = append(spans[fData.segment], s)
+		}
+		node.metadataMutex.RUnlock()
+	})
+	var live uint64
+	for _, segmentSpans := range spans {
+		sort.Slice(segmentSpans, func(i, j int) bool { return segmentSpans[i].start < segmentSpans[j].start })
+		end := -1
+		for _, s := range segmentSpans {
+			if s.start > end {
+				live += uint64(s.end - s.start + 1)
+			} else if s.end > end {
+				live += uint64(s.end - end)
+			}
+			end = max(end, s.end)
+		}
+	}
+	return live
+}
+
+// Stats reports how the volume uses its space. Working out the live bytes
+// walks every file, so it is not done for StatFs.
+func (fs *AppendFS) Stats() VolumeStats {
+	data, metadata := fs.volumeBytes()
+	stats := VolumeStats{DataBytes: uint64(data), MetadataBytes: uint64(metadata),
+						LiveBytes: fs.liveBytes()}
+	if fs.cold != nil {
+		cold, err := fs.coldBytes()
+		if err != nil {
+			fmt.Printf("Cold store fail: %v\n", err)
+		}
+		stats.ColdBytes = uint64(cold)
+	}
+	if stats.LiveBytes < stats.DataBytes + stats.ColdBytes {
+		stats.GarbageBytes = stats.DataBytes + stats.ColdBytes - stats.LiveBytes
+	}
+	fs.nodesMutex.RLock()
+	stats.Nodes = uint64(len(fs.nodes))
+	fs.nodesMutex.RUnlock()
+	stats.Capacity, stats.FreeBytes = fs.capacity()
+	return stats
+}
+
+func (stats VolumeStats) String() string {
+	return fmt.Sprintf("data: %d bytes, %d cold, %d live, %d garbage\nmetadata: %d bytes\nnodes: %d\ncapacity: %d bytes, %d free\n",
+		stats.DataBytes, stats.ColdBytes, stats.LiveBytes, stats.GarbageBytes, stats.MetadataBytes,
+		stats.Nodes, stats.Capacity, stats.FreeBytes)
+}
+
+func (fs *AppendFS) statFs() *fuse.StatfsOut {
+	total, free := fs.capacity()
+	blockSize := uint64(fs.blockSize)
+	fs.nodesMutex.RLock()
+	nodes := uint64(len(fs.nodes))
+	fs.nodesMutex.RUnlock()
+	// There is no inode table to run out of, only space for metadata
+	inodesFree := free / blockSize
+	return &fuse.StatfsOut{Blocks: total / blockSize, Bfree: free / blockSize,
+							Bavail: free / blockSize, Files: nodes + inodesFree,
+							Ffree: inodesFree, Bsize: fs.blockSize, Frsize: fs.blockSize,
+							NameLen: 255}
+}
@@ -0,0 +1,180 @@
+package appendfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+// syncEvents is what was written to and synced of a volume's files, in
+// order.
+type syncEvents struct {
+	mutex sync.Mutex
+	events []string
+}
+
+func (events *syncEvents) add(event string) {
+	events.mutex.Lock()
+	// Only the order matters, not how many writes a record took
+	if n := len(events.events); n == 0 || events.events[n - 1] != event {
+		events.events = append(events.events, event)
+	}
+	events.mutex.Unlock()
+}
+
+func (events *syncEvents) take() []string {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	out := events.events
+	events.events = nil
+	return out
+}
+
+// recordedFile passes everything on to the file it wraps, noting writes
+// and syncs in events. Syncs fail with syncErr if it is set.
+type recordedFile struct {
+	io.ReadWriter
+	name string
+	events *syncEvents
+	syncErr error
+}
+
+func (f *recordedFile) Write(data []byte) (int, error) {
+	f.events.add("write " + f.name)
+	return f.ReadWriter.Write(data)
+}
+
+func (f *recordedFile) Seek(offset int64, whence int) (int64, error) {
+	return f.ReadWriter.(io.Seeker).Seek(offset, whence)
+}
+
+func (f *recordedFile) Sync() error {
+	f.events.add("sync " + f.name)
+	if f.syncErr != nil {
+		return f.syncErr
+	}
+	return syncFile(f.ReadWriter)
+}
+
+func (f *recordedFile) Close() error {
+	if closer, ok := f.ReadWriter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// recordSyncs opens a volume with policy and a file on it that has been
+// written to, and starts recording what happens to the volume's files.
+func recordSyncs(t *testing.T, dir string, policy SyncPolicy, interval time.Duration) (*AppendFS, nodefs.File, *syncEvents, *recordedFile) {
+	options := NewOptions()
+	options.SyncPolicy = policy
+	options.SyncInterval = interval
+	fs := openTestVolume(t, dir, options)
+	file, _, code := fs.Root().Create("file", uint32(os.O_WRONLY), fuse.S_IFREG | 0644, rootCaller)
+	if code != fuse.OK {
+		t.Fatalf("Create: %v", code)
+	}
+	if _, code = file.Write([]byte("durable"), 0); code != fuse.OK {
+		t.Fatalf("Write: %v", code)
+	}
+	events := &syncEvents{}
+	data := &recordedFile{ReadWriter: fs.dataFile, name: "data", events: events}
+	fs.dataMutex.Lock()
+	fs.dataFile = data
+	fs.dataMutex.Unlock()
+	fs.metadataMutex.Lock()
+	fs.metadataFile = &recordedFile{ReadWriter: fs.metadataFile, name: "metadata", events: events}
+	fs.metadataMutex.Unlock()
+	return fs, file, events, data
+}
+
+func TestFsyncOrdering(t *testing.T) {
+	cases := []struct {
+		policy SyncPolicy
+		events []string
+	}{
+		{SyncStrict, []string{"sync data", "write metadata", "sync metadata"}},
+		{SyncPeriodic, []string{"write metadata"}},
+		{SyncUnsafe, []string{"write metadata"}},
+	}
+	for _, c := range cases {
+		fs, file, events, _ := recordSyncs(t, t.TempDir(), c.policy, time.Hour)
+		if code := file.Fsync(0); code != fuse.OK {
+			t.Fatalf("Fsync with %v: %v", c.policy, code)
+		}
+		if got := events.take(); !reflect.DeepEqual(got, c.events) {
+			t.Errorf("Fsync with %v did %v, not %v", c.policy, got, c.events)
+		}
+		file.Release()
+		fs.Close()
+	}
+}
+
+func TestFsyncDataFailure(t *testing.T) {
+	fs, file, events, data := recordSyncs(t, t.TempDir(), SyncStrict, time.Hour)
+	defer fs.Close()
+	defer file.Release()
+	data.syncErr = errors.New("sync failed")
+	if code := file.Fsync(0); code != fuse.EIO {
+		t.Fatalf("Fsync with the data sync failing: %v, not EIO", code)
+	}
+	// The FileMap mustn't reach the disk before the data does
+	if got := events.take(); !reflect.DeepEqual(got, []string{"sync data"}) {
+		t.Fatalf("Fsync with the data sync failing did %v", got)
+	}
+	data.syncErr = nil
+	if code := file.Fsync(0); code != fuse.OK {
+		t.Fatalf("Fsync again: %v", code)
+	}
+	if got := events.take(); !reflect.DeepEqual(got, []string{"sync data", "write metadata", "sync metadata"}) {
+		t.Fatalf("Fsync again did %v", got)
+	}
+}
+
+func TestPeriodicSync(t *testing.T) {
+	fs, file, events, _ := recordSyncs(t, t.TempDir(), SyncPeriodic, 10 * time.Millisecond)
+	defer fs.Close()
+	defer file.Release()
+	events.take()
+	if code := file.Fsync(0); code != fuse.OK {
+		t.Fatalf("Fsync: %v", code)
+	}
+	// The loop syncs what Fsync recorded, data first
+	deadline := time.Now().Add(5 * time.Second)
+	want := []string{"write metadata", "sync data", "sync metadata"}
+	got := make([]string, 0)
+	for time.Now().Before(deadline) {
+		got = append(got, events.take()...)
+		for i := range got {
+			if len(got) - i >= len(want) && reflect.DeepEqual(got[i:i + len(want)], want) {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Periodic sync did %v, not %v", got, want)
+}
+
+func TestFsyncSurvivesCrash(t *testing.T) {
+	dir := t.TempDir()
+	fs, file, _, _ := recordSyncs(t, dir, SyncStrict, time.Hour)
+	if code := file.Fsync(0); code != fuse.OK {
+		t.Fatalf("Fsync: %v", code)
+	}
+	// Crash without closing the file
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs = openTestVolume(t, dir, nil)
+	defer fs.Close()
+	if got := string(readTestFile(t, fs, "file", 7)); got != "durable" {
+		t.Fatalf("Read %q after the crash, not %q", got, "durable")
+	}
+}
@@ -0,0 +1,522 @@
+package appendfs
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sealed segments that haven't been written to for ColdAfter are cold, and
+// are moved to a slower tier, an ObjectStore: DirStore keeps them in a
+// directory, say on another disk. Moving a segment uploads it under its
+// file name, checks that all of it arrived and only then deletes the local
+// file and its mirror copies. A segment that isn't on local disk is read
+// from the store, as the last of its copies, a block of coldBlockSize at a
+// time. Up to ColdCacheSize bytes of those blocks are kept in a cache
+// directory next to the data file, the least recently used going first.
+// Compact deletes the cold segments no file refers to from the store too.
+//
+// Only what is on local disk counts towards the capacity and df. Once a
+// segment has been moved, a file next to the data file says so, and the
+// volume can't be opened, replicated or backed up without its store:
+// replication and backups read cold segments from the store like any
+// other.
+
+// ObjectStore holds objects that are written once, whole, and then read a
+// piece at a time.
+type ObjectStore interface {
+	// Put stores size bytes read from r as name, replacing any object
+	// there was.
+	Put(name string, r io.Reader, size int64) error
+	// ReadAt reads len(dest) bytes of name from pos, as io.ReaderAt does.
+	ReadAt(name string, dest []byte, pos int64) (int, error)
+	// Size returns how long name is, or an error os.IsNotExist is true of.
+	Size(name string) (int64, error)
+	// List returns the names of all the objects.
+	List() ([]string, error)
+	Delete(name string) error
+}
+
+// DirStore is an ObjectStore keeping each object in a file of its own in a
+// directory.
+type DirStore struct {
+	dir string
+}
+
+func NewDirStore(dir string) (*DirStore, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+func (store *DirStore) path(name string) string {
+	return filepath.Join(store.dir, name)
+}
+
+func (store *DirStore) Put(name string, r io.Reader, size int64) error {
+	// Written aside, so an object is never there half written
+	temp := store.path(name) + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(file, r, size)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, store.path(name))
+	}
+	if err != nil {
+		os.Remove(temp)
+	}
+	return err
+}
+
+func (store *DirStore) ReadAt(name string, dest []byte, pos int64) (int, error) {
+	file, err := os.Open(store.path(name))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.ReadAt(dest, pos)
+}
+
+func (store *DirStore) Size(name string) (int64, error) {
+	info, err := os.Stat(store.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (store *DirStore) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.Mode().IsRegular() && !strings.HasSuffix(info.Name(), ".tmp") {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+func (store *DirStore) Delete(name string) error {
+	return os.Remove(store.path(name))
+}
+
+// How much of a cold segment is fetched, and cached, at once
+const coldBlockSize = 1 << 20
+
+type coldTier struct {
+	store ObjectStore
+	// What the data file is called, which the segments are named after
+	prefix string
+	after time.Duration
+	// nil if nothing is cached
+	cache *coldCache
+	// Held while segments are being moved
+	mutex sync.Mutex
+	stop chan struct{}
+	running sync.WaitGroup
+}
+
+func (tier *coldTier) name(segment uint64) string {
+	return fmt.Sprintf("%s.%06d", tier.prefix, segment)
+}
+
+// segments returns the numbers of the segments in the store, in order.
+func (tier *coldTier) segments() ([]uint64, error) {
+	names, err := tier.store.List()
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]uint64, 0, len(names))
+	for _, name := range names {
+		if segment, ok := segmentNumber(tier.prefix, name); ok {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// upload stores the first size bytes of the file at path as segment, and
+// checks they all got there.
+func (tier *coldTier) upload(path string, segment uint64, size int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = tier.store.Put(tier.name(segment), io.NewSectionReader(file, 0, size), size)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	stored, err := tier.store.Size(tier.name(segment))
+	if err == nil && stored != size {
+		err = fmt.Errorf("store has %d bytes of segment %d, not %d", stored, segment, size)
+	}
+	return err
+}
+
+func (tier *coldTier) ReadAt(segment uint64, dest []byte, pos int64) (int, error) {
+	if tier.cache == nil {
+		return tier.store.ReadAt(tier.name(segment), dest, pos)
+	}
+	n := 0
+	for n < len(dest) {
+		block := (pos + int64(n)) / coldBlockSize
+		data, err := tier.block(segment, block)
+		if err != nil {
+			return n, err
+		}
+		off := pos + int64(n) - block * coldBlockSize
+		if off >= int64(len(data)) {
+			return n, io.EOF
+		}
+		n += copy(dest[n:], data[off:])
+	}
+	return n, nil
+}
+
+// block returns block of segment from the cache, or else the store,
+// caching it. The last block of a segment is short.
+func (tier *coldTier) block(segment uint64, block int64) ([]byte, error) {
+	key := coldBlock{segment, block}
+	if data, ok := tier.cache.get(key); ok {
+		return data, nil
+	}
+	data := make([]byte, coldBlockSize)
+	n, err := tier.store.ReadAt(tier.name(segment), data, block * coldBlockSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// Sealed segments never grow, so a short block stays right
+	data = data[:n]
+	tier.cache.put(key, data)
+	return data, nil
+}
+
+type coldBlock struct {
+	segment uint64
+	block int64
+}
+
+type cachedBlock struct {
+	coldBlock
+	size int64
+}
+
+// coldCache keeps blocks of cold segments in a directory, one file each.
+type coldCache struct {
+	dir string
+	limit int64
+	mutex sync.Mutex
+	size int64
+	// cachedBlocks, the most recently used first
+	blocks *list.List
+	index map[coldBlock]*list.Element
+}
+
+// openColdCache picks up the blocks already cached in dir, creating it if
+// needed.
+func openColdCache(dir string, limit int64) (*coldCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	cache := &coldCache{dir: dir, limit: limit, blocks: list.New(),
+						index: make(map[coldBlock]*list.Element)}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().After(infos[j].ModTime()) })
+	for _, info := range infos {
+		var key coldBlock
+		_, err := fmt.Sscanf(info.Name(), "%d.%d", &key.segment, &key.block)
+		if err != nil || info.Name() != cache.fileName(key) {
+			// Left over from a crash while caching
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		cache.index[key] = cache.blocks.PushBack(cachedBlock{key, info.Size()})
+		cache.size += info.Size()
+	}
+	cache.mutex.Lock()
+	cache.evict()
+	cache.mutex.Unlock()
+	return cache, nil
+}
+
+func (cache *coldCache) fileName(key coldBlock) string {
+	return fmt.Sprintf("%06d.%06d", key.segment, key.block)
+}
+
+func (cache *coldCache) path(key coldBlock) string {
+	return filepath.Join(cache.dir, cache.fileName(key))
+}
+
+func (cache *coldCache) get(key coldBlock) ([]byte, bool) {
+	cache.mutex.Lock()
+	element, ok := cache.index[key]
+	if ok {
+		cache.blocks.MoveToFront(element)
+	}
+	cache.mutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(cache.path(key))
+	if err != nil {
+		cache.mutex.Lock()
+		cache.remove(key)
+		cache.mutex.Unlock()
+		return nil, false
+	}
+	return data, true
+}
+
+func (cache *coldCache) put(key coldBlock, data []byte) {
+	temp := cache.path(key) + ".tmp"
+	err := ioutil.WriteFile(temp, data, 0600)
+	if err == nil {
+		err = os.Rename(temp, cache.path(key))
+	}
+	if err != nil {
+		fmt.Printf("Cold cache fail: %v\n", err)
+		os.Remove(temp)
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if _, ok := cache.index[key]; ok {
+		return
+	}
+	cache.index[key] = cache.blocks.PushFront(cachedBlock{key, int64(len(data))})
+	cache.size += int64(len(data))
+	cache.evict()
+}
+
+// evict drops the least recently used blocks until the cache fits its
+// limit. The caller must hold mutex.
+func (cache *coldCache) evict() {
+	for cache.size > cache.limit && cache.blocks.Len() > 0 {
+		cache.remove(cache.blocks.Back().Value.(cachedBlock).coldBlock)
+	}
+}
+
+// remove drops key from the cache. The caller must hold mutex.
+func (cache *coldCache) remove(key coldBlock) {
+	element, ok := cache.index[key]
+	if !ok {
+		return
+	}
+	cache.blocks.Remove(element)
+	delete(cache.index, key)
+	cache.size -= element.Value.(cachedBlock).size
+	os.Remove(cache.path(key))
+}
+
+// forget drops every block of segment from the cache.
+func (cache *coldCache) forget(segment uint64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for key := range cache.index {
+		if key.segment == segment {
+			cache.remove(key)
+		}
+	}
+}
+
+// tieredPath is where Tier notes that segments of the volume whose data
+// file is dataFilePath have been moved to a cold store.
+func tieredPath(dataFilePath string) string {
+	return dataFilePath + ".tiered"
+}
+
+func markTiered(dataFilePath string) error {
+	file, err := os.OpenFile(tieredPath(dataFilePath), os.O_WRONLY | os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// checkTiered fails if segments of the volume have been moved to a cold
+// store, which store, if set, is.
+func checkTiered(dataFilePath string, store ObjectStore) error {
+	if store != nil {
+		return nil
+	}
+	_, err := os.Stat(tieredPath(dataFilePath))
+	if err == nil {
+		return fmt.Errorf("segments of %s have been moved to a cold store, which is needed to read them", dataFilePath)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fs *AppendFS) coldCachePath() string {
+	return fs.dataFilePath + ".cache"
+}
+
+// openColdTier sets up reading from and moving segments to store.
+func (fs *AppendFS) openColdTier(store ObjectStore, options *Options) error {
+	tier := &coldTier{store: store, prefix: filepath.Base(fs.dataFilePath),
+					after: options.ColdAfter}
+	if options.ColdCacheSize > 0 {
+		cache, err := openColdCache(fs.coldCachePath(), options.ColdCacheSize)
+		if err != nil {
+			return err
+		}
+		tier.cache = cache
+	}
+	fs.cold = tier
+	if fs.follower {
+		return nil
+	}
+	// A volume tiered before Tier left the file saying so
+	segments, err := tier.segments()
+	if err == nil && len(segments) > 0 {
+		err = markTiered(fs.dataFilePath)
+	}
+	return err
+}
+
+// Tier moves the sealed segments that have gone cold to the cold store,
+// and returns their numbers.
+func (fs *AppendFS) Tier() ([]uint64, error) {
+	if fs.cold == nil {
+		return nil, errors.New("volume has no cold store")
+	}
+	if fs.follower {
+		return nil, errReadOnly
+	}
+	fs.cold.mutex.Lock()
+	defer fs.cold.mutex.Unlock()
+	// Compact waits, so it can't delete a segment while it is moved
+	fs.compactMutex.RLock()
+	defer fs.compactMutex.RUnlock()
+	fs.dataMutex.RLock()
+	current := fs.dataSegment
+	fs.dataMutex.RUnlock()
+	segments, err := fs.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	moved := make([]uint64, 0)
+	for _, segment := range segments {
+		if segment >= current {
+			break
+		}
+		info, err := os.Stat(fs.segmentPath(segment))
+		if err != nil {
+			return moved, err
+		}
+		if time.Since(info.ModTime()) < fs.cold.after {
+			continue
+		}
+		err = markTiered(fs.dataFilePath)
+		if err == nil {
+			err = fs.cold.upload(fs.segmentPath(segment), segment, info.Size())
+		}
+		if err != nil {
+			return moved, err
+		}
+		for _, path := range fs.segmentCopies(segment) {
+			err = os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				return moved, err
+			}
+		}
+		fs.dataMutex.Lock()
+		fs.dataBytes -= info.Size()
+		fs.dataMutex.Unlock()
+		moved = append(moved, segment)
+	}
+	return moved, nil
+}
+
+func (fs *AppendFS) tierLoop(interval time.Duration) {
+	defer fs.cold.running.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			moved, err := fs.Tier()
+			if len(moved) > 0 {
+				fmt.Printf("Moved segments %v to the cold store\n", moved)
+			}
+			if err != nil {
+				fmt.Printf("Tier fail: %v\n", err)
+			}
+		case <-fs.cold.stop:
+			return
+		}
+	}
+}
+
+// coldBytes returns the size of the segments in the cold store.
+func (fs *AppendFS) coldBytes() (int64, error) {
+	segments, err := fs.cold.segments()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, segment := range segments {
+		size, err := fs.cold.store.Size(fs.cold.name(segment))
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// compactCold deletes the dead segments that are in the cold store, and
+// returns their numbers.
+func (fs *AppendFS) compactCold(dead map[uint64]bool) ([]uint64, error) {
+	segments, err := fs.cold.segments()
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]uint64, 0)
+	for _, segment := range segments {
+		if !dead[segment] {
+			continue
+		}
+		err = fs.cold.store.Delete(fs.cold.name(segment))
+		if err != nil {
+			return removed, err
+		}
+		if fs.cold.cache != nil {
+			fs.cold.cache.forget(segment)
+		}
+		removed = append(removed, segment)
+	}
+	return removed, nil
+}
@@ -0,0 +1,97 @@
+package appendfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tieredTestVolume writes files to a volume in dir, and moves every
+// sealed segment to a cold store in cold.
+func tieredTestVolume(t *testing.T, dir string, cold string, files map[string]string) ObjectStore {
+	store, err := NewDirStore(cold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := NewOptions()
+	options.SegmentSize = 1
+	options.ColdStore = store
+	options.ColdAfter = 0
+	fs := openTestVolume(t, dir, options)
+	for name, contents := range files {
+		writeTestFile(t, fs, name, []byte(contents))
+	}
+	moved, err := fs.Tier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != len(files) - 1 {
+		t.Fatalf("Tier moved segments %v", moved)
+	}
+	if err = fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func checkTestFiles(t *testing.T, dir string, files map[string]string) {
+	fs := openTestVolume(t, dir, nil)
+	defer fs.Close()
+	for name, contents := range files {
+		if got := string(readTestFile(t, fs, name, len(contents))); got != contents {
+			t.Fatalf("Read %q from %s, not %q", got, name, contents)
+		}
+	}
+}
+
+func TestReplicateColdSegments(t *testing.T) {
+	dir, replicaDir := t.TempDir(), t.TempDir()
+	files := map[string]string{"first": "moved to the store", "second": "also moved", "third": "still local"}
+	store := tieredTestVolume(t, dir, t.TempDir(), files)
+	if _, err := NewAppendFS(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), nil); err == nil {
+		t.Fatalf("Opening the volume without its cold store worked")
+	}
+	target := NewLocalReplica(filepath.Join(replicaDir, "data"), filepath.Join(replicaDir, "metadata"))
+	defer target.Close()
+	err := NewReplicator(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), nil, target).Replicate()
+	if err == nil || !strings.Contains(err.Error(), "cold store") {
+		t.Fatalf("Replicating without the cold store returned %v", err)
+	}
+	replicator := NewReplicator(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), store, target)
+	if err = replicator.Replicate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = replicator.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFiles(t, replicaDir, files)
+}
+
+func TestBackUpColdSegments(t *testing.T) {
+	dir, restored := t.TempDir(), t.TempDir()
+	files := map[string]string{"first": "moved to the store", "second": "also moved", "third": "still local"}
+	store := tieredTestVolume(t, dir, t.TempDir(), files)
+	bundle := filepath.Join(t.TempDir(), "bundle")
+	out, err := os.Create(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	_, err = WriteBackup(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), nil, nil, out)
+	if err == nil || !strings.Contains(err.Error(), "cold store") {
+		t.Fatalf("Backing up without the cold store returned %v", err)
+	}
+	if _, err = out.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, err = WriteBackup(filepath.Join(dir, "data"), filepath.Join(dir, "metadata"), store, nil, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Restore(filepath.Join(restored, "data"), filepath.Join(restored, "metadata"), []string{bundle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFiles(t, restored, files)
+}
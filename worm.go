@@ -0,0 +1,109 @@
+package appendfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/e-tothe-ipi/appendfs/messages"
+	"github.com/golang/protobuf/proto"
+)
+
+// A file committed to WORM (write once, read many) storage can never be
+// written to or truncated again, and while it is retained it can't be
+// unlinked or renamed either. In WORM mode a file is committed when a
+// handle that was written through is closed; any file is committed when its
+// retention is set through xattrRetention. Retention can be extended but
+// never shortened. Compaction keeps every segment a file refers to, so the
+// data of committed files always survives it.
+
+func (node *AppendFSNode) retained() bool {
+	return node.retainUntil > uint64(time.Now().Unix())
+}
+
+// checkModify returns EPERM if the contents of node may not change.
+func (node *AppendFSNode) checkModify() fuse.Status {
+	node.metadataMutex.RLock()
+	worm := node.worm
+	node.metadataMutex.RUnlock()
+	if worm {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// checkRetained returns EPERM if node may not be removed or renamed yet.
+func (node *AppendFSNode) checkRetained() fuse.Status {
+	node.metadataMutex.RLock()
+	retained := node.retained()
+	node.metadataMutex.RUnlock()
+	if retained {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// commit makes node immutable and retains it until at least retainUntil.
+func (node *AppendFSNode) commit(retainUntil uint64) error {
+	node.metadataMutex.Lock()
+	defer node.metadataMutex.Unlock()
+	if node.worm && node.retainUntil >= retainUntil {
+		return nil
+	}
+	node.worm = true
+	if retainUntil > node.retainUntil {
+		node.retainUntil = retainUntil
+	}
+	metadata := &messages.NodeMetadata{NodeId:&node.nodeId, Worm:proto.Bool(true),
+									RetainUntil:&node.retainUntil}
+	return node.fs.AppendMetadata(metadata)
+}
+
+// committed is called when a handle that was written through is closed.
+func (node *AppendFSNode) committed() {
+	if !node.fs.worm {
+		return
+	}
+	retainUntil := uint64(time.Now().Add(node.fs.wormRetention).Unix())
+	err := node.commit(retainUntil)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (node *AppendFSNode) getRetention() ([]byte, fuse.Status) {
+	node.metadataMutex.RLock()
+	worm, retainUntil := node.worm, node.retainUntil
+	node.metadataMutex.RUnlock()
+	if !worm {
+		return nil, fuse.ENODATA
+	}
+	return []byte(fmt.Sprintf("%d", retainUntil)), fuse.OK
+}
+
+// retentionControl sets the unix time until which a file is retained,
+// committing it if it wasn't already.
+func (node *AppendFSNode) retentionControl(arg string, context *fuse.Context) fuse.Status {
+	if code := node.checkOwner(context); code != fuse.OK {
+		return code
+	}
+	var retainUntil uint64
+	if n, _ := fmt.Sscan(arg, &retainUntil); n != 1 {
+		return fuse.EINVAL
+	}
+	node.metadataMutex.RLock()
+	regular, current := node.attr.IsRegular(), node.retainUntil
+	node.metadataMutex.RUnlock()
+	if !regular {
+		return fuse.EINVAL
+	}
+	if retainUntil < current {
+		return fuse.EPERM
+	}
+	err := node.commit(retainUntil)
+	if err != nil {
+		fmt.Println(err)
+		return errorStatus(err)
+	}
+	return fuse.OK
+}
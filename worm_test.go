@@ -0,0 +1,170 @@
+package appendfs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func wormTestVolume(t *testing.T, dir string) *AppendFS {
+	options := NewOptions()
+	options.Worm = true
+	options.WormRetention = time.Hour
+	return openTestVolume(t, dir, options)
+}
+
+func retention(t *testing.T, node *AppendFSNode) uint64 {
+	data, code := node.GetXAttr(xattrRetention, &fuse.Context{})
+	if code != fuse.OK {
+		t.Fatalf("GetXAttr retention: %v", code)
+	}
+	var retainUntil uint64
+	if n, _ := fmt.Sscan(string(data), &retainUntil); n != 1 {
+		t.Fatalf("Retention %q isn't a time", data)
+	}
+	return retainUntil
+}
+
+func TestWormCommitsOnRelease(t *testing.T) {
+	fs := wormTestVolume(t, t.TempDir())
+	defer fs.Close()
+	context := &fuse.Context{}
+	_, inode, code := fs.Root().Create("file", uint32(os.O_WRONLY), fuse.S_IFREG | 0644, context)
+	if code != fuse.OK {
+		t.Fatalf("Create: %v", code)
+	}
+	node := inode.Node().(*AppendFSNode)
+	first, code := node.Open(uint32(os.O_WRONLY), context)
+	if code != fuse.OK {
+		t.Fatalf("Open: %v", code)
+	}
+	second, code := node.Open(uint32(os.O_WRONLY), context)
+	if code != fuse.OK {
+		t.Fatalf("Open: %v", code)
+	}
+	defer second.Release()
+	if _, code = first.Write([]byte("kept"), 0); code != fuse.OK {
+		t.Fatalf("Write: %v", code)
+	}
+	// Still open, so not committed yet
+	if _, code = node.GetXAttr(xattrRetention, context); code != fuse.ENODATA {
+		t.Fatalf("Retained before Release: %v", code)
+	}
+	first.Flush()
+	first.Release()
+	if retainUntil := retention(t, node); retainUntil < uint64(time.Now().Add(59 * time.Minute).Unix()) {
+		t.Fatalf("Retained until %d, not for an hour", retainUntil)
+	}
+	// A handle opened before the commit can't write either
+	if _, code = second.Write([]byte("more"), 4); code != fuse.EPERM {
+		t.Fatalf("Write to a committed file: %v, not EPERM", code)
+	}
+}
+
+func TestWormRejectsChanges(t *testing.T) {
+	fs := wormTestVolume(t, t.TempDir())
+	defer fs.Close()
+	context := &fuse.Context{}
+	node := writeTestFile(t, fs, "file", []byte("kept"))
+	if _, code := node.Open(uint32(os.O_WRONLY), context); code != fuse.EPERM {
+		t.Fatalf("Open for writing: %v, not EPERM", code)
+	}
+	if code := node.Truncate(nil, 0, context); code != fuse.EPERM {
+		t.Fatalf("Truncate: %v, not EPERM", code)
+	}
+	if code := fs.Root().Unlink("file", context); code != fuse.EPERM {
+		t.Fatalf("Unlink: %v, not EPERM", code)
+	}
+	if code := fs.Root().Rename("file", fs.Root(), "renamed", context); code != fuse.EPERM {
+		t.Fatalf("Rename: %v, not EPERM", code)
+	}
+	writeTestFile(t, fs, "other", []byte("also kept"))
+	if code := fs.Root().Rename("other", fs.Root(), "file", context); code != fuse.EPERM {
+		t.Fatalf("Rename over a retained file: %v, not EPERM", code)
+	}
+	if got := string(readTestFile(t, fs, "file", 4)); got != "kept" {
+		t.Fatalf("Read %q, not %q", got, "kept")
+	}
+}
+
+// Removing a directory removes everything below it, so rmdir of a
+// directory holding a retained file has to fail rather than take the file
+// with it.
+func TestWormRmdirKeepsRetainedFile(t *testing.T) {
+	dir := t.TempDir()
+	fs := wormTestVolume(t, dir)
+	context := &fuse.Context{}
+	inode, code := fs.Root().Mkdir("dir", 0755, context)
+	if code != fuse.OK {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	file, _, code := inode.Node().(*AppendFSNode).Create("file", uint32(os.O_WRONLY), fuse.S_IFREG | 0644, context)
+	if code != fuse.OK {
+		t.Fatalf("Create: %v", code)
+	}
+	if _, code = file.Write([]byte("kept"), 0); code != fuse.OK {
+		t.Fatalf("Write: %v", code)
+	}
+	file.Flush()
+	file.Release()
+	if code = fs.Root().Rmdir("dir", context); code != fuse.Status(syscall.ENOTEMPTY) {
+		t.Fatalf("Rmdir: %v, not ENOTEMPTY", code)
+	}
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs = wormTestVolume(t, dir)
+	defer fs.Close()
+	parent := fs.Root().Inode().GetChild("dir")
+	if parent == nil || parent.GetChild("file") == nil {
+		t.Fatal("dir/file is gone")
+	}
+}
+
+func TestWormRetentionOnlyExtends(t *testing.T) {
+	fs := wormTestVolume(t, t.TempDir())
+	defer fs.Close()
+	context := &fuse.Context{}
+	node := writeTestFile(t, fs, "file", []byte("kept"))
+	retainUntil := retention(t, node)
+	earlier := []byte(fmt.Sprintf("%d", retainUntil - 60))
+	if code := node.SetXAttr(xattrRetention, earlier, 0, context); code != fuse.EPERM {
+		t.Fatalf("Shortening retention: %v, not EPERM", code)
+	}
+	if got := retention(t, node); got != retainUntil {
+		t.Fatalf("Retained until %d after shortening was refused, not %d", got, retainUntil)
+	}
+	later := []byte(fmt.Sprintf("%d", retainUntil + 60))
+	if code := node.SetXAttr(xattrRetention, later, 0, context); code != fuse.OK {
+		t.Fatalf("Extending retention: %v", code)
+	}
+	if got := retention(t, node); got != retainUntil + 60 {
+		t.Fatalf("Retained until %d, not %d", got, retainUntil + 60)
+	}
+}
+
+func TestWormRetentionSurvivesRemount(t *testing.T) {
+	dir := t.TempDir()
+	fs := wormTestVolume(t, dir)
+	retainUntil := retention(t, writeTestFile(t, fs, "file", []byte("kept")))
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Retention outlives WORM mode itself
+	fs = openTestVolume(t, dir, nil)
+	defer fs.Close()
+	node := fs.Root().Inode().GetChild("file").Node().(*AppendFSNode)
+	if got := retention(t, node); got != retainUntil {
+		t.Fatalf("Retained until %d after remounting, not %d", got, retainUntil)
+	}
+	if code := fs.Root().Unlink("file", &fuse.Context{}); code != fuse.EPERM {
+		t.Fatalf("Unlink after remounting: %v, not EPERM", code)
+	}
+	if code := node.Truncate(nil, 0, &fuse.Context{}); code != fuse.EPERM {
+		t.Fatalf("Truncate after remounting: %v, not EPERM", code)
+	}
+}